@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -12,6 +18,7 @@ import (
 	"onechat/internal/database"
 	"onechat/internal/handlers"
 	"onechat/internal/middleware"
+	"onechat/internal/models"
 	"onechat/internal/services"
 	"onechat/internal/websocket"
 )
@@ -24,9 +31,16 @@ func main() {
 
 	// Initialize configuration
 	cfg := config.LoadConfig()
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
 
 	// Initialize database
-	db, err := database.InitDB(cfg.DatabaseURL)
+	db, err := database.InitDB(cfg.DatabaseURL, database.PoolConfig{
+		MaxOpenConns:    cfg.DBMaxOpenConns,
+		MaxIdleConns:    cfg.DBMaxIdleConns,
+		ConnMaxLifetime: cfg.DBConnMaxLifetime,
+	})
 	if err != nil {
 		log.Fatalf("Failed to initialize database: %v", err)
 	}
@@ -37,47 +51,150 @@ func main() {
 	}
 
 	// Initialize services
-	authService := services.NewAuthService(db, cfg.JWTSecret)
-	chatService := services.NewChatService(db)
-	groupService := services.NewGroupService(db)
-	aiService := services.NewAIService(cfg.GeminiAPIKey)
-	mediaService := services.NewMediaService(cfg.CloudinaryURL)
-	eventService := services.NewEventService(db, aiService)
-	notificationService := services.NewNotificationService()
+	authService := services.NewAuthService(db, cfg.JWTSecret, cfg.RefreshSecret)
+	chatService := services.NewChatService(db, cfg.MaxMessageLength, cfg.MaxPinnedChats, cfg.DeleteWindow)
+	groupService := services.NewGroupService(db, cfg.MaxGroupMembers, cfg.MaxMessageLength)
+	aiService := services.NewAIService(db, cfg.GeminiAPIKey, cfg.GeminiModel, cfg.AISystemPrompt, cfg.GeminiMaxAttempts, cfg.EventConfirmationThreshold)
+	storage := newStorage(cfg)
+	mediaService := services.NewMediaService(storage, cfg.MaxUploadBytes, cfg.UploadAllowedTypes)
+	mediaService.SetDB(db)
+	eventService := services.NewEventService(db, aiService, chatService, cfg.EventReminderMinutes)
+	adminService := services.NewAdminService(db, chatService)
+	reportService := services.NewReportService(db, chatService)
+	uploadLimiter := services.NewUploadLimiter(cfg.UploadsPerMinute, cfg.UploadDailyBytes)
+	loginLimiter := services.NewLoginLimiter(cfg.LoginMaxFailures, cfg.LoginFailureWindow)
+	notificationService := services.NewNotificationService(db)
 
 	// Initialize WebSocket hub
-	hub := websocket.NewHub(chatService)
+	hub := websocket.NewHub(chatService, authService, cfg.WSMaxConnsPerUser)
+	hub.SetFrameLimits(int64(cfg.WSMaxFrameBytes), cfg.WSFramesPerSecond, cfg.WSFrameBurst)
+	if cfg.RedisURL != "" {
+		broker, err := websocket.NewRedisBroker(cfg.RedisURL)
+		if err != nil {
+			log.Fatalf("Failed to initialize Redis broker: %v", err)
+		}
+		hub.SetBroker(broker)
+		hub.SetPresence(broker)
+		log.Println("Sharing WebSocket broadcasts and presence through Redis")
+	}
 	go hub.Run()
 
 	// Initialize handlers
-	authHandler := handlers.NewAuthHandler(authService)
-	chatHandler := handlers.NewChatHandler(chatService, hub)
-	groupHandler := handlers.NewGroupHandler(groupService, hub)
-	aiHandler := handlers.NewAIHandler(aiService)
-	mediaHandler := handlers.NewMediaHandler(mediaService)
-	eventHandler := handlers.NewEventHandler(eventService)
-	wsHandler := handlers.NewWebSocketHandler(hub, authService)
+	messagePage := handlers.PageLimits{Default: cfg.MessagePageSize, Max: cfg.MessagePageMax}
+	listPage := handlers.PageLimits{Default: cfg.ListPageSize, Max: cfg.ListPageMax}
+	authHandler := handlers.NewAuthHandler(authService, loginLimiter, hub, handlers.PageLimits{Default: 20, Max: cfg.ListPageMax})
+	chatHandler := handlers.NewChatHandler(chatService, notificationService, hub, messagePage, listPage)
+	hub.SetMessageSender(chatHandler.SendFromSocket)
+	groupHandler := handlers.NewGroupHandler(groupService, hub, listPage)
+	aiHandler := handlers.NewAIHandler(aiService, chatService, messagePage, listPage)
+	mediaHandler := handlers.NewMediaHandler(mediaService, uploadLimiter, listPage, cfg.MediaURLTTL)
+	eventHandler := handlers.NewEventHandler(eventService, listPage)
+	wsHandler := handlers.NewWebSocketHandler(hub, authService, cfg.WSAllowedOrigins, cfg.WSCompression, cfg.WSCompressionThreshold)
+	adminHandler := handlers.NewAdminHandler(adminService, hub, listPage)
+	reportHandler := handlers.NewReportHandler(reportService, listPage)
+	capabilitiesHandler := handlers.NewCapabilitiesHandler(cfg, aiService, mediaService)
+	healthHandler := handlers.NewHealthHandler(db)
 
 	// Setup router
-	router := setupRouter(cfg, authHandler, chatHandler, groupHandler, aiHandler, mediaHandler, eventHandler, wsHandler)
+	router := setupRouter(cfg, authService, adminService, authHandler, chatHandler, groupHandler, aiHandler, mediaHandler, eventHandler, wsHandler, adminHandler, reportHandler, capabilitiesHandler, healthHandler)
+	if local, ok := storage.(*services.LocalStorage); ok {
+		router.GET(uploadsRoute+"/*filepath", gin.WrapH(http.StripPrefix(uploadsRoute, local)))
+	}
 
 	// Start media cleanup scheduler
 	go mediaService.StartCleanupScheduler(10 * 24 * time.Hour) // 10 days
 
+	// Drop revocations for tokens that have expired
+	authService.StartRevokedTokenSweeper(time.Hour)
+
+	// Resurface snoozed chats
+	chatService.StartSnoozeScheduler(time.Minute, func(snooze models.ChatSnooze) {
+		reminder, _ := json.Marshal(map[string]interface{}{
+			"type":    "chat_reminder",
+			"chat_id": snooze.ChatID,
+		})
+		hub.SendToUser(snooze.UserID, reminder)
+	})
+
+	// Remind users of upcoming events
+	eventService.StartReminderScheduler(time.Minute, notificationService)
+
 	// Start server
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	log.Printf("Server starting on port %s", port)
-	if err := router.Run(":" + port); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+	srv := &http.Server{
+		Addr:    ":" + port,
+		Handler: router,
+	}
+
+	go func() {
+		log.Printf("Server starting on port %s", port)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("Failed to start server: %v", err)
+		}
+	}()
+
+	// Wait for a shutdown signal, then stop taking requests, let in-flight
+	// ones finish and close WebSocket connections
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-quit
+	log.Printf("Received %s, shutting down", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	log.Println("Draining HTTP requests...")
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("HTTP requests did not finish in time: %v", err)
+	}
+
+	log.Println("Closing WebSocket connections...")
+	hub.Stop()
+
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+	log.Println("Server stopped")
+}
+
+// shutdownTimeout bounds how long in-flight HTTP requests may take to finish
+// once the server is asked to stop.
+const shutdownTimeout = 15 * time.Second
+
+// uploadsRoute is where files kept by local storage are served, to holders
+// of signed links.
+const uploadsRoute = "/uploads"
+
+// newStorage sets up the configured media storage backend. It returns nil,
+// which disables uploads, when Cloudinary is selected but not configured.
+func newStorage(cfg *config.Config) services.Storage {
+	if cfg.StorageBackend == "local" {
+		storage, err := services.NewLocalStorage(cfg.LocalStorageDir, cfg.PublicURL+uploadsRoute, []byte(cfg.JWTSecret))
+		if err != nil {
+			log.Fatalf("Failed to initialize local storage: %v", err)
+		}
+		return storage
+	}
+
+	if cfg.CloudinaryURL == "" {
+		return nil
+	}
+	storage, err := services.NewCloudinaryStorage(cfg.CloudinaryURL)
+	if err != nil {
+		log.Printf("%v", err)
+		return nil
 	}
+	return storage
 }
 
 func setupRouter(
 	cfg *config.Config,
+	authService *services.AuthService,
+	adminService *services.AdminService,
 	authHandler *handlers.AuthHandler,
 	chatHandler *handlers.ChatHandler,
 	groupHandler *handlers.GroupHandler,
@@ -85,12 +202,19 @@ func setupRouter(
 	mediaHandler *handlers.MediaHandler,
 	eventHandler *handlers.EventHandler,
 	wsHandler *handlers.WebSocketHandler,
+	adminHandler *handlers.AdminHandler,
+	reportHandler *handlers.ReportHandler,
+	capabilitiesHandler *handlers.CapabilitiesHandler,
+	healthHandler *handlers.HealthHandler,
 ) *gin.Engine {
 	router := gin.Default()
+	router.HandleMethodNotAllowed = true
+	router.NoRoute(handlers.NoRoute)
+	router.NoMethod(handlers.NoMethod)
 
 	// CORS configuration
 	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
+		AllowOrigins:     cfg.AllowedOrigins,
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowHeaders:     []string{"Origin", "Content-Type", "Authorization"},
 		ExposeHeaders:    []string{"Content-Length"},
@@ -98,32 +222,43 @@ func setupRouter(
 		MaxAge:           12 * time.Hour,
 	}))
 
-	// Health check
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(200, gin.H{"status": "healthy"})
-	})
+	// Liveness and readiness checks
+	router.GET("/health", healthHandler.Health)
+	router.GET("/ready", healthHandler.Ready)
 
 	// API v1 routes
 	v1 := router.Group("/api/v1")
 	{
 		// Public routes
+		v1.GET("/capabilities", capabilitiesHandler.GetCapabilities)
+		v1.GET("/calendar/:token", eventHandler.GetCalendarFeed)
+
 		auth := v1.Group("/auth")
 		{
 			auth.POST("/register", authHandler.Register)
 			auth.POST("/login", authHandler.Login)
 			auth.POST("/refresh", authHandler.RefreshToken)
+			auth.POST("/logout", middleware.AuthMiddleware(authService), authHandler.Logout)
 		}
 
 		// Protected routes
 		protected := v1.Group("")
-		protected.Use(middleware.AuthMiddleware(cfg.JWTSecret))
+		protected.Use(middleware.AuthMiddleware(authService))
 		{
 			// User routes
 			users := protected.Group("/users")
 			{
 				users.GET("/me", authHandler.GetProfile)
 				users.PUT("/me", authHandler.UpdateProfile)
+				users.PUT("/me/password", authHandler.ChangePassword)
+				users.POST("/me/avatar", mediaHandler.UploadAvatar)
+				users.DELETE("/me", authHandler.DeleteAccount)
+				users.GET("/me/blocks", authHandler.GetBlockedUsers)
+				users.POST("/me/blocks", authHandler.BlockUser)
+				users.DELETE("/me/blocks/:userId", authHandler.UnblockUser)
 				users.GET("/search", authHandler.SearchUsers)
+				users.GET("/presence", chatHandler.GetPresence)
+				users.POST("/match-contacts", middleware.RateLimitMiddleware(5, time.Hour), authHandler.MatchContacts)
 			}
 
 			// Chat routes
@@ -131,35 +266,83 @@ func setupRouter(
 			{
 				chats.GET("", chatHandler.GetChats)
 				chats.POST("", chatHandler.CreateChat)
+				chats.GET("/unread", chatHandler.GetUnreadCounts)
+				chats.POST("/read-all", chatHandler.MarkAllChatsRead)
+				chats.PUT("/pinned", chatHandler.ReorderPinnedChats)
 				chats.GET("/:chatId/messages", chatHandler.GetMessages)
+				chats.GET("/:chatId/messages/search", chatHandler.SearchMessages)
+				chats.GET("/:chatId/pinned", chatHandler.GetPinnedMessages)
+				chats.POST("/:chatId/snooze", chatHandler.SnoozeChat)
+				chats.GET("/:chatId/draft", chatHandler.GetDraft)
+				chats.PUT("/:chatId/draft", chatHandler.SaveDraft)
+				chats.POST("/:chatId/mute", chatHandler.MuteChat)
+				chats.DELETE("/:chatId/mute", chatHandler.UnmuteChat)
+				chats.POST("/:chatId/pin", chatHandler.PinChat)
+				chats.DELETE("/:chatId/pin", chatHandler.UnpinChat)
+				chats.POST("/:chatId/read", chatHandler.MarkChatRead)
+				chats.POST("/:chatId/archive", chatHandler.ArchiveChat)
+				chats.DELETE("/:chatId/archive", chatHandler.UnarchiveChat)
+				chats.GET("/:chatId/permissions", chatHandler.GetChatPermissions)
+				chats.GET("/:chatId/notification-settings", chatHandler.GetNotificationSetting)
+				chats.PUT("/:chatId/notification-settings", chatHandler.UpdateNotificationSetting)
 				chats.POST("/:chatId/messages", chatHandler.SendMessage)
+				chats.POST("/:chatId/summarize", aiHandler.SummarizeChat)
 				chats.PUT("/messages/:messageId/status", chatHandler.UpdateMessageStatus)
+				chats.PUT("/messages/:messageId", chatHandler.EditMessage)
 				chats.DELETE("/messages/:messageId", chatHandler.DeleteMessage)
+				chats.GET("/messages/:messageId/thread", chatHandler.GetThreadMessages)
+				chats.POST("/messages/:messageId/report", reportHandler.ReportMessage)
+				chats.POST("/messages/:messageId/translate", aiHandler.TranslateMessage)
+				chats.POST("/messages/:messageId/reactions", chatHandler.AddReaction)
+				chats.DELETE("/messages/:messageId/reactions", chatHandler.RemoveReaction)
+				chats.POST("/messages/:messageId/pin", chatHandler.PinMessage)
+				chats.DELETE("/messages/:messageId/pin", chatHandler.UnpinMessage)
+			}
+
+			// Search routes
+			search := protected.Group("/search")
+			{
+				search.GET("/messages", chatHandler.SearchAllMessages)
 			}
 
 			// Group routes
 			groups := protected.Group("/groups")
 			{
 				groups.POST("", groupHandler.CreateGroup)
+				groups.POST("/join/:token", groupHandler.JoinByInvite)
 				groups.GET("/:groupId", groupHandler.GetGroup)
 				groups.PUT("/:groupId", groupHandler.UpdateGroup)
+				groups.GET("/:groupId/read-stats", groupHandler.GetReadStats)
 				groups.DELETE("/:groupId", groupHandler.DeleteGroup)
 				groups.POST("/:groupId/members", groupHandler.AddMember)
+				groups.POST("/:groupId/members/bulk", groupHandler.AddMembers)
+				groups.POST("/:groupId/invites", groupHandler.CreateInvite)
+				groups.DELETE("/:groupId/members/me", groupHandler.LeaveGroup)
 				groups.DELETE("/:groupId/members/:userId", groupHandler.RemoveMember)
 				groups.PUT("/:groupId/members/:userId/role", groupHandler.UpdateMemberRole)
+				groups.PUT("/:groupId/members/:userId/nickname", groupHandler.SetMemberNickname)
 			}
 
 			// AI routes
 			ai := protected.Group("/ai")
 			{
 				ai.POST("/research", aiHandler.Research)
+				ai.POST("/research/stream", aiHandler.ResearchStream)
+				ai.GET("/conversations", aiHandler.GetConversations)
+				ai.DELETE("/conversations", aiHandler.ClearConversations)
+				ai.GET("/conversations/:conversationId", aiHandler.GetConversation)
+				ai.DELETE("/conversations/:conversationId", aiHandler.DeleteConversation)
 				ai.POST("/extract-event", aiHandler.ExtractEvent)
 			}
 
 			// Media routes
 			media := protected.Group("/media")
 			{
+				media.GET("", mediaHandler.ListMedia)
 				media.POST("/upload", mediaHandler.Upload)
+				media.POST("/upload/batch", mediaHandler.UploadBatch)
+				media.GET("/:id/url", mediaHandler.GetMediaURL)
+				media.DELETE("/*publicId", mediaHandler.DeleteMedia)
 			}
 
 			// Event routes
@@ -167,14 +350,31 @@ func setupRouter(
 			{
 				events.GET("", eventHandler.GetEvents)
 				events.POST("", eventHandler.CreateEvent)
+				events.GET("/upcoming", eventHandler.GetUpcomingEvents)
+				events.GET("/occurrences", eventHandler.GetOccurrences)
+				events.GET("/calendar.ics", eventHandler.ExportCalendar)
+				events.POST("/calendar/token", eventHandler.RotateCalendarToken)
+				events.DELETE("/calendar/token", eventHandler.RevokeCalendarToken)
+				events.POST("/import-from-message", eventHandler.ImportFromMessage)
 				events.PUT("/:eventId", eventHandler.UpdateEvent)
 				events.DELETE("/:eventId", eventHandler.DeleteEvent)
+				events.POST("/:eventId/occurrences/cancel", eventHandler.CancelOccurrence)
+			}
+
+			// Admin routes
+			admin := protected.Group("/admin")
+			admin.Use(middleware.AdminMiddleware(adminService))
+			{
+				admin.POST("/broadcast", adminHandler.Broadcast)
+				admin.GET("/users", adminHandler.ListUsers)
+				admin.GET("/reports", reportHandler.ListReports)
+				admin.POST("/maintenance/merge-private-chats", adminHandler.MergeDuplicatePrivateChats)
 			}
 		}
 	}
 
 	// WebSocket route
-	router.GET("/ws", middleware.WSAuthMiddleware(cfg.JWTSecret), wsHandler.HandleWebSocket)
+	router.GET("/ws", middleware.WSAuthMiddleware(authService), wsHandler.HandleWebSocket)
 
 	return router
 }
@@ -1,25 +1,162 @@
 package config
 
-import "os"
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Config struct {
 	DatabaseURL    string
 	JWTSecret      string
 	GeminiAPIKey   string
+	GeminiModel    string
 	CloudinaryURL  string
 	ServerPort     string
 	RefreshSecret  string
+
+	DBMaxOpenConns    int
+	DBMaxIdleConns    int
+	DBConnMaxLifetime time.Duration
+
+	UploadsPerMinute   int
+	UploadDailyBytes   int64
+	MaxUploadBytes     int64
+	UploadAllowedTypes []string
+
+	StorageBackend  string // cloudinary or local
+	LocalStorageDir string
+	PublicURL       string
+	MediaURLTTL     time.Duration
+
+	LoginMaxFailures   int
+	LoginFailureWindow time.Duration
+
+	AllowedOrigins   []string
+	WSAllowedOrigins []string
+
+	MaxMessageLength int
+	MaxPinnedChats   int
+	MaxGroupMembers  int
+	DeleteWindow     time.Duration
+	MessagePageSize  int
+	MessagePageMax   int
+	ListPageSize     int
+	ListPageMax      int
+
+	WSCompression          bool
+	WSCompressionThreshold int
+	WSMaxConnsPerUser      int
+	WSMaxFrameBytes        int
+	WSFramesPerSecond      float64
+	WSFrameBurst           int
+	RedisURL               string
+
+	EventConfirmationThreshold float64
+	EventReminderMinutes       int
+	AISystemPrompt             string
+	GeminiMaxAttempts          int
+}
+
+// MaxAISystemPromptLength bounds AI_SYSTEM_PROMPT, which is sent with every
+// research request.
+const MaxAISystemPromptLength = 4000
+
+// defaultUploadAllowedTypes are MIME prefixes accepted for upload, grouped
+// by the category the file is stored under.
+var defaultUploadAllowedTypes = []string{
+	// images
+	"image/jpeg", "image/png", "image/gif", "image/webp", "image/heic",
+	// video and audio
+	"video/", "audio/",
+	// documents
+	"application/pdf", "text/plain", "application/zip",
+	"application/msword", "application/vnd.ms-excel", "application/vnd.ms-powerpoint",
+	"application/vnd.openxmlformats-officedocument.",
 }
 
+const defaultAISystemPrompt = `You are a helpful AI assistant in a chat application.
+Provide clear, concise, and informative responses, formatted so they are easy to read and understand.`
+
 func LoadConfig() *Config {
-	return &Config{
+	cfg := &Config{
 		DatabaseURL:   getEnv("DATABASE_URL", "postgres://localhost:5432/onechat?sslmode=disable"),
 		JWTSecret:     getEnv("JWT_SECRET", "your-secret-key-change-in-production"),
 		RefreshSecret: getEnv("REFRESH_SECRET", "your-refresh-secret-change-in-production"),
 		GeminiAPIKey:  getEnv("GEMINI_API_KEY", ""),
+		GeminiModel:   getEnv("GEMINI_MODEL", "gemini-1.5-flash"),
 		CloudinaryURL: getEnv("CLOUDINARY_URL", ""),
 		ServerPort:    getEnv("PORT", "8080"),
+
+		DBMaxOpenConns:    getEnvInt("DB_MAX_OPEN_CONNS", 25),
+		DBMaxIdleConns:    getEnvInt("DB_MAX_IDLE_CONNS", 10),
+		DBConnMaxLifetime: getEnvDuration("DB_CONN_MAX_LIFETIME", 30*time.Minute),
+
+		UploadsPerMinute: getEnvInt("UPLOADS_PER_MINUTE", 10),
+		UploadDailyBytes: int64(getEnvInt("UPLOAD_DAILY_BYTES", 500*1024*1024)),
+		MaxUploadBytes:   int64(getEnvInt("MAX_UPLOAD_BYTES", 25*1024*1024)),
+
+		StorageBackend:  strings.ToLower(getEnv("STORAGE_BACKEND", "cloudinary")),
+		LocalStorageDir: getEnv("LOCAL_STORAGE_DIR", "./uploads"),
+		PublicURL:       strings.TrimSuffix(getEnv("PUBLIC_URL", ""), "/"),
+		MediaURLTTL:     getEnvDuration("MEDIA_URL_TTL", 15*time.Minute),
+
+		LoginMaxFailures:   getEnvInt("LOGIN_MAX_FAILURES", 5),
+		LoginFailureWindow: getEnvDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+
+		MaxMessageLength: getEnvInt("MAX_MESSAGE_LENGTH", 4096),
+		MaxPinnedChats:   getEnvInt("MAX_PINNED_CHATS", 3),
+		MaxGroupMembers:  getEnvInt("MAX_GROUP_MEMBERS", 256),
+		DeleteWindow:     getEnvDuration("DELETE_FOR_EVERYONE_WINDOW", time.Hour),
+		MessagePageSize:  getEnvInt("MESSAGE_PAGE_SIZE", 50),
+		MessagePageMax:   getEnvInt("MESSAGE_PAGE_MAX", 200),
+		ListPageSize:     getEnvInt("LIST_PAGE_SIZE", 50),
+		ListPageMax:      getEnvInt("LIST_PAGE_MAX", 100),
+
+		WSCompression:          getEnvBool("WS_COMPRESSION", true),
+		WSCompressionThreshold: getEnvInt("WS_COMPRESSION_THRESHOLD", 1024),
+		WSMaxConnsPerUser:      getEnvInt("WS_MAX_CONNECTIONS_PER_USER", 5),
+		WSMaxFrameBytes:        getEnvInt("WS_MAX_FRAME_BYTES", 64*1024),
+		WSFramesPerSecond:      getEnvFloat("WS_FRAMES_PER_SECOND", 10),
+		WSFrameBurst:           getEnvInt("WS_FRAME_BURST", 20),
+		RedisURL:               getEnv("REDIS_URL", ""),
+
+		EventConfirmationThreshold: getEnvFloat("EVENT_CONFIRMATION_THRESHOLD", 0.7),
+		EventReminderMinutes:       getEnvInt("EVENT_REMINDER_MINUTES", 30),
+		AISystemPrompt:             strings.TrimSpace(getEnv("AI_SYSTEM_PROMPT", defaultAISystemPrompt)),
+		GeminiMaxAttempts:          getEnvInt("GEMINI_MAX_ATTEMPTS", 3),
 	}
+
+	cfg.UploadAllowedTypes = getEnvList("UPLOAD_ALLOWED_TYPES", defaultUploadAllowedTypes)
+
+	cfg.AllowedOrigins = getEnvList("ALLOWED_ORIGINS", []string{"*"})
+	// WebSocket origins fall back to the HTTP list unless overridden
+	cfg.WSAllowedOrigins = getEnvList("WS_ALLOWED_ORIGINS", cfg.AllowedOrigins)
+
+	return cfg
+}
+
+// Validate reports settings that would make the server misbehave.
+func (c *Config) Validate() error {
+	if n := len([]rune(c.AISystemPrompt)); n > MaxAISystemPromptLength {
+		return fmt.Errorf("AI_SYSTEM_PROMPT is %d characters, the limit is %d", n, MaxAISystemPromptLength)
+	}
+	if c.StorageBackend != "cloudinary" && c.StorageBackend != "local" {
+		return fmt.Errorf("STORAGE_BACKEND is %q, it must be cloudinary or local", c.StorageBackend)
+	}
+	// The CORS middleware panics on an empty list or a malformed origin
+	if len(c.AllowedOrigins) == 0 {
+		return errors.New("ALLOWED_ORIGINS lists no origins; set it to * or to origins such as https://app.example.com")
+	}
+	for _, origin := range c.AllowedOrigins {
+		if origin != "*" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return fmt.Errorf("ALLOWED_ORIGINS entry %q must be * or start with http:// or https://", origin)
+		}
+	}
+	return nil
 }
 
 func getEnv(key, defaultValue string) string {
@@ -28,3 +165,54 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+func getEnvInt(key string, defaultValue int) int {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.Atoi(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := strconv.ParseBool(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if parsed, err := time.ParseDuration(value); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+func getEnvList(key string, defaultValue []string) []string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,34 @@
+package config
+
+import "testing"
+
+func TestValidateAllowedOrigins(t *testing.T) {
+	tests := []struct {
+		name    string
+		origins []string
+		wantErr bool
+	}{
+		{"any origin", []string{"*"}, false},
+		{"listed origins", []string{"https://app.example.com", "http://localhost:3000"}, false},
+		{"empty", nil, true},
+		{"missing scheme", []string{"app.example.com"}, true},
+		{"websocket scheme", []string{"wss://app.example.com"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{StorageBackend: "local", AllowedOrigins: tt.origins}
+			if err := cfg.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigSeparatorOnlyOrigins(t *testing.T) {
+	t.Setenv("ALLOWED_ORIGINS", " , ")
+
+	if err := LoadConfig().Validate(); err == nil {
+		t.Error("Validate() accepted ALLOWED_ORIGINS with no origins")
+	}
+}
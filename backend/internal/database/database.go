@@ -3,6 +3,7 @@ package database
 import (
 	"fmt"
 	"log"
+	"time"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
@@ -10,7 +11,15 @@ import (
 	"onechat/internal/models"
 )
 
-func InitDB(databaseURL string) (*gorm.DB, error) {
+// PoolConfig sizes the connection pool. Zero values leave database/sql's
+// defaults: unlimited open connections, 2 idle and no lifetime limit.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+func InitDB(databaseURL string, pool PoolConfig) (*gorm.DB, error) {
 	db, err := gorm.Open(postgres.Open(databaseURL), &gorm.Config{
 		Logger: logger.Default.LogMode(logger.Info),
 	})
@@ -18,12 +27,31 @@ func InitDB(databaseURL string) (*gorm.DB, error) {
 		return nil, fmt.Errorf("failed to connect to database: %w", err)
 	}
 
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database handle: %w", err)
+	}
+	if pool.MaxOpenConns > 0 {
+		sqlDB.SetMaxOpenConns(pool.MaxOpenConns)
+	}
+	if pool.MaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(pool.MaxIdleConns)
+	}
+	if pool.ConnMaxLifetime > 0 {
+		sqlDB.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	}
+	log.Printf("Database pool: max %d open, %d idle, %s lifetime", pool.MaxOpenConns, pool.MaxIdleConns, pool.ConnMaxLifetime)
+
 	log.Println("Database connection established successfully")
 	return db, nil
 }
 
 func AutoMigrate(db *gorm.DB) error {
 	log.Println("Running database migrations...")
+
+	if err := dedupeMessageStatuses(db); err != nil {
+		return fmt.Errorf("failed to migrate database: %w", err)
+	}
 	
 	err := db.AutoMigrate(
 		&models.User{},
@@ -32,14 +60,64 @@ func AutoMigrate(db *gorm.DB) error {
 		&models.Group{},
 		&models.GroupMember{},
 		&models.Event{},
+		&models.EventException{},
 		&models.Media{},
 		&models.MessageStatus{},
+		&models.ChatSnooze{},
+		&models.ChatPin{},
+		&models.Report{},
+		&models.ChatNotificationSetting{},
+		&models.RevokedToken{},
+		&models.RevokedSession{},
+		&models.MessageReaction{},
+		&models.MessageHide{},
+		&models.MessageMention{},
+		&models.GroupInvite{},
+		&models.BlockedUser{},
+		&models.AIConversation{},
+		&models.AIConversationMessage{},
+		&models.ChatMute{},
+		&models.ChatArchive{},
+		&models.ChatDraft{},
 	)
 	
 	if err != nil {
 		return fmt.Errorf("failed to migrate database: %w", err)
 	}
+
+	if err := backfillEventReminders(db); err != nil {
+		return fmt.Errorf("failed to migrate database: %w", err)
+	}
+
+	// Full-text index for message search. The expression must match the one
+	// ChatService queries with or Postgres won't use it.
+	if err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_messages_content_search
+		ON messages USING GIN (to_tsvector('simple', content))`).Error; err != nil {
+		return fmt.Errorf("failed to create message search index: %w", err)
+	}
 	
 	log.Println("Database migrations completed successfully")
 	return nil
 }
+
+// dedupeMessageStatuses drops duplicate status rows left from before they
+// were unique per message and user, so the unique index can be created. A
+// read row wins over a delivered one, then the newest row.
+func dedupeMessageStatuses(db *gorm.DB) error {
+	if !db.Migrator().HasTable(&models.MessageStatus{}) {
+		return nil
+	}
+	return db.Exec(`DELETE FROM message_statuses a USING message_statuses b
+		WHERE a.message_id = b.message_id AND a.user_id = b.user_id
+		AND (a.status = 'read', a.id) < (b.status = 'read', b.id)`).Error
+}
+
+// backfillEventReminders carries over reminders sent while they were
+// tracked with the notified flag, so those events aren't reminded again.
+func backfillEventReminders(db *gorm.DB) error {
+	if !db.Migrator().HasColumn(&models.Event{}, "notified") {
+		return nil
+	}
+	return db.Exec(`UPDATE events SET notified_for = event_date
+		WHERE notified AND notified_for IS NULL`).Error
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"onechat/internal/services"
+	"onechat/internal/websocket"
+)
+
+type AdminHandler struct {
+	adminService *services.AdminService
+	hub          *websocket.Hub
+	listPage     PageLimits
+}
+
+func NewAdminHandler(adminService *services.AdminService, hub *websocket.Hub, listPage PageLimits) *AdminHandler {
+	return &AdminHandler{
+		adminService: adminService,
+		hub:          hub,
+		listPage:     listPage,
+	}
+}
+
+type BroadcastRequest struct {
+	Content string `json:"content" binding:"required"`
+	ChatIDs []uint `json:"chat_ids"`
+}
+
+// Broadcast posts a system message into the requested chats, or pushes a
+// system_notice to every connected client when no chats are given.
+func (h *AdminHandler) Broadcast(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	var req BroadcastRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	if len(req.ChatIDs) == 0 {
+		notice, _ := json.Marshal(map[string]interface{}{
+			"type":    "system_notice",
+			"content": req.Content,
+		})
+		h.hub.SendToAll(notice)
+
+		c.JSON(http.StatusOK, gin.H{"success": true})
+		return
+	}
+
+	messages, err := h.adminService.BroadcastSystemMessage(userID, req.Content, req.ChatIDs)
+	for i := range messages {
+		messageJSON, _ := json.Marshal(map[string]interface{}{
+			"type":    "new_message",
+			"message": messages[i],
+		})
+		h.hub.BroadcastToChat(messages[i].ChatID, messageJSON, 0)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "messages": messages})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"messages": messages})
+}
+
+func (h *AdminHandler) ListUsers(c *gin.Context) {
+	limit, offset, err := parsePagination(c, h.listPage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sortBy := c.DefaultQuery("sort", "created_at")
+	if sortBy != "created_at" && sortBy != "last_seen" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "sort must be created_at or last_seen"})
+		return
+	}
+
+	var online *bool
+	if o := c.Query("online"); o != "" {
+		parsed, err := strconv.ParseBool(o)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid online filter"})
+			return
+		}
+		online = &parsed
+	}
+
+	users, total, err := h.adminService.AdminListUsers(limit, offset, sortBy, online)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"users": users,
+		"total": total,
+	})
+}
+
+// MergeDuplicatePrivateChats repairs user pairs that ended up with more than
+// one private chat.
+func (h *AdminHandler) MergeDuplicatePrivateChats(c *gin.Context) {
+	merged, err := h.adminService.MergeDuplicatePrivateChats()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "merged": merged})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"merged": merged})
+}
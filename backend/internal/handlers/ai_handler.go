@@ -1,22 +1,39 @@
 package handlers
 
 import (
+	"io"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	"onechat/internal/models"
 	"onechat/internal/services"
 )
 
 type AIHandler struct {
-	aiService *services.AIService
+	aiService   *services.AIService
+	chatService *services.ChatService
+	messagePage PageLimits
+	listPage    PageLimits
 }
 
-func NewAIHandler(aiService *services.AIService) *AIHandler {
-	return &AIHandler{aiService: aiService}
+func NewAIHandler(aiService *services.AIService, chatService *services.ChatService, messagePage, listPage PageLimits) *AIHandler {
+	return &AIHandler{
+		aiService:   aiService,
+		chatService: chatService,
+		messagePage: messagePage,
+		listPage:    listPage,
+	}
 }
 
 type ResearchRequest struct {
-	Query string `json:"query" binding:"required"`
+	Query          string `json:"query" binding:"required"`
+	ConversationID uint   `json:"conversation_id"` // continue a conversation; omit to start one
+}
+
+type TranslateRequest struct {
+	TargetLang string `json:"target_lang" binding:"required,max=50"` // language name or code, e.g. "es"
 }
 
 type ExtractEventRequest struct {
@@ -26,29 +43,78 @@ type ExtractEventRequest struct {
 func (h *AIHandler) Research(c *gin.Context) {
 	var req ResearchRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
-	response, err := h.aiService.Research(req.Query)
+	conversation, response, err := h.aiService.Research(c.GetUint("user_id"), req.ConversationID, req.Query)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondServiceError(c, err, http.StatusInternalServerError)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"response": response,
+		"response":        response,
+		"conversation_id": conversation.ID,
+	})
+}
+
+// ResearchStream answers a research query as Server-Sent Events: a "chunk"
+// event per piece of the answer, then "done" with the conversation the
+// exchange was saved to, or "error" if Gemini fails partway through.
+// Failures before anything has been sent get a plain JSON error response.
+func (h *AIHandler) ResearchStream(c *gin.Context) {
+	var req ResearchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	if !h.aiService.Configured() {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Gemini API key not configured"})
+		return
+	}
+
+	// The request context is cancelled when the client disconnects, which
+	// stops the upstream request too
+	chunks := make(chan string)
+	errCh := make(chan error, 1)
+	var conversation *models.AIConversation
+	go func() {
+		var err error
+		conversation, err = h.aiService.ResearchStream(c.Request.Context(), c.GetUint("user_id"), req.ConversationID, req.Query, chunks)
+		errCh <- err
+	}()
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Stream(func(w io.Writer) bool {
+		if chunk, ok := <-chunks; ok {
+			c.SSEvent("chunk", gin.H{"text": chunk})
+			return true
+		}
+
+		if err := <-errCh; err != nil {
+			if !c.Writer.Written() {
+				respondServiceError(c, err, http.StatusInternalServerError)
+			} else if c.Request.Context().Err() == nil {
+				c.SSEvent("error", gin.H{"error": err.Error()})
+			}
+			return false
+		}
+		c.SSEvent("done", gin.H{"conversation_id": conversation.ID})
+		return false
 	})
 }
 
 func (h *AIHandler) ExtractEvent(c *gin.Context) {
 	var req ExtractEventRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
-	event, err := h.aiService.ExtractEvent(req.MessageText)
+	event, err := h.aiService.ExtractEvent(c.GetUint("user_id"), req.MessageText)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -58,3 +124,147 @@ func (h *AIHandler) ExtractEvent(c *gin.Context) {
 		"event": event,
 	})
 }
+
+// SummarizeChat summarizes the chat's most recent messages; the limit query
+// parameter sets how many, up to the message page maximum.
+func (h *AIHandler) SummarizeChat(c *gin.Context) {
+	chatID, err := strconv.ParseUint(c.Param("chatId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	limit, _, err := parsePagination(c, h.messagePage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !h.chatService.IsChatMember(uint(chatID), c.GetUint("user_id")) {
+		c.JSON(http.StatusForbidden, gin.H{"error": services.ErrNotChatMember.Error()})
+		return
+	}
+
+	messages, err := h.chatService.GetMessages(uint(chatID), c.GetUint("user_id"), limit, 0)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	summary, err := h.aiService.SummarizeMessages(messages)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"summary":       summary,
+		"message_count": len(messages),
+	})
+}
+
+// TranslateMessage returns a message's content translated into target_lang.
+// The stored message is left as it is.
+func (h *AIHandler) TranslateMessage(c *gin.Context) {
+	messageID, err := strconv.ParseUint(c.Param("messageId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	var req TranslateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	message, err := h.chatService.GetMessageByID(uint(messageID))
+	if err != nil {
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	if !h.chatService.IsChatMember(message.ChatID, c.GetUint("user_id")) {
+		c.JSON(http.StatusForbidden, gin.H{"error": services.ErrNotChatMember.Error()})
+		return
+	}
+
+	if strings.TrimSpace(message.Content) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Message has no text to translate"})
+		return
+	}
+
+	translation, err := h.aiService.Translate(message.Content, req.TargetLang)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"message_id":  message.ID,
+		"target_lang": req.TargetLang,
+		"translation": translation,
+	})
+}
+
+func (h *AIHandler) GetConversations(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	limit, offset, err := parsePagination(c, h.listPage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	conversations, err := h.aiService.GetConversations(userID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"conversations": conversations})
+}
+
+func (h *AIHandler) GetConversation(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	conversationID, err := strconv.ParseUint(c.Param("conversationId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid conversation ID"})
+		return
+	}
+
+	conversation, err := h.aiService.GetConversation(userID, uint(conversationID))
+	if err != nil {
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"conversation": conversation})
+}
+
+func (h *AIHandler) DeleteConversation(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	conversationID, err := strconv.ParseUint(c.Param("conversationId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid conversation ID"})
+		return
+	}
+
+	if err := h.aiService.DeleteConversation(userID, uint(conversationID)); err != nil {
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func (h *AIHandler) ClearConversations(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	if err := h.aiService.ClearConversations(userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
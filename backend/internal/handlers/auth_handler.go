@@ -1,24 +1,36 @@
 package handlers
 
 import (
+	"errors"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"onechat/internal/services"
+	"onechat/internal/websocket"
 )
 
 type AuthHandler struct {
-	authService *services.AuthService
+	authService  *services.AuthService
+	loginLimiter *services.LoginLimiter
+	hub          *websocket.Hub
+	searchPage   PageLimits
 }
 
-func NewAuthHandler(authService *services.AuthService) *AuthHandler {
-	return &AuthHandler{authService: authService}
+func NewAuthHandler(authService *services.AuthService, loginLimiter *services.LoginLimiter, hub *websocket.Hub, searchPage PageLimits) *AuthHandler {
+	return &AuthHandler{
+		authService:  authService,
+		loginLimiter: loginLimiter,
+		hub:          hub,
+		searchPage:   searchPage,
+	}
 }
 
 type RegisterRequest struct {
 	Phone    string `json:"phone" binding:"required"`
 	Username string `json:"username" binding:"required"`
-	Password string `json:"password" binding:"required,min=6"`
+	Password string `json:"password" binding:"required"`
 }
 
 type LoginRequest struct {
@@ -30,10 +42,40 @@ type RefreshTokenRequest struct {
 	RefreshToken string `json:"refresh_token" binding:"required"`
 }
 
+type BlockUserRequest struct {
+	UserID uint `json:"user_id" binding:"required"`
+}
+
+type ChangePasswordRequest struct {
+	OldPassword        string `json:"old_password" binding:"required"`
+	NewPassword        string `json:"new_password" binding:"required"`
+	LogoutOtherDevices bool   `json:"logout_other_devices"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// UpdateProfileRequest lists the profile fields users can edit. Anything
+// else in the body, such as is_admin, is ignored.
+type UpdateProfileRequest struct {
+	Username        *string `json:"username"`
+	Phone           *string `json:"phone"`
+	ProfilePic      *string `json:"profile_pic"`
+	Status          *string `json:"status"`
+	GroupAddPolicy  *string `json:"group_add_policy"`  // everyone, contacts, nobody
+	LastSeenPrivacy *string `json:"last_seen_privacy"` // everyone, contacts, nobody
+	Timezone        *string `json:"timezone"`          // IANA name, empty for UTC
+}
+
+type MatchContactsRequest struct {
+	Phones []string `json:"phones" binding:"required"`
+}
+
 func (h *AuthHandler) Register(c *gin.Context) {
 	var req RegisterRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
@@ -53,15 +95,27 @@ func (h *AuthHandler) Register(c *gin.Context) {
 func (h *AuthHandler) Login(c *gin.Context) {
 	var req LoginRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
+		return
+	}
+
+	ip := c.ClientIP()
+	if allowed, lockedUntil := h.loginLimiter.Allow(req.Phone, ip); !allowed {
+		c.Header("Retry-After", strconv.Itoa(int(time.Until(lockedUntil).Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error":        "Too many failed login attempts, try again later",
+			"locked_until": lockedUntil,
+		})
 		return
 	}
 
 	user, accessToken, refreshToken, err := h.authService.Login(req.Phone, req.Password)
 	if err != nil {
+		h.loginLimiter.RecordFailure(req.Phone, ip)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
 		return
 	}
+	h.loginLimiter.Reset(req.Phone, ip)
 
 	c.JSON(http.StatusOK, gin.H{
 		"user":          user,
@@ -73,7 +127,7 @@ func (h *AuthHandler) Login(c *gin.Context) {
 func (h *AuthHandler) RefreshToken(c *gin.Context) {
 	var req RefreshTokenRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
@@ -88,33 +142,92 @@ func (h *AuthHandler) RefreshToken(c *gin.Context) {
 	})
 }
 
+// Logout ends the session of the access token used for the request,
+// revoking it and the refresh token issued with it. Tokens from before
+// sessions were tracked don't name theirs, so a refresh_token in the body
+// is still revoked too.
+func (h *AuthHandler) Logout(c *gin.Context) {
+	var req LogoutRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			respondBindingError(c, err)
+			return
+		}
+	}
+
+	if err := h.authService.RevokeSession(c.GetString("token")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.RefreshToken != "" {
+		if err := h.authService.RevokeToken(req.RefreshToken); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid refresh token"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
 func (h *AuthHandler) GetProfile(c *gin.Context) {
 	userID := c.GetUint("user_id")
 
 	user, err := h.authService.GetUserByID(userID)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		respondServiceError(c, err, http.StatusInternalServerError)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"user": user})
 }
 
-func (h *AuthHandler) UpdateProfile(c *gin.Context) {
+// DeleteAccount deletes the caller's account. Pass anonymize_messages=true
+// to also blank out the messages they sent.
+func (h *AuthHandler) DeleteAccount(c *gin.Context) {
 	userID := c.GetUint("user_id")
 
-	var updates map[string]interface{}
-	if err := c.ShouldBindJSON(&updates); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	anonymize, err := strconv.ParseBool(c.DefaultQuery("anonymize_messages", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "anonymize_messages must be true or false"})
+		return
+	}
+
+	if err := h.authService.DeleteAccount(userID, anonymize); err != nil {
+		respondServiceError(c, err, http.StatusInternalServerError)
 		return
 	}
 
-	// Remove sensitive fields
-	delete(updates, "password")
-	delete(updates, "id")
-	delete(updates, "created_at")
+	// Deleting the account ended its sessions, so close the sockets they
+	// opened too
+	h.hub.DisconnectUser(userID)
 
-	user, err := h.authService.UpdateProfile(userID, updates)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func (h *AuthHandler) UpdateProfile(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	var req UpdateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	user, err := h.authService.UpdateProfile(userID, services.ProfileUpdate{
+		Username:        req.Username,
+		Phone:           req.Phone,
+		ProfilePic:      req.ProfilePic,
+		Status:          req.Status,
+		GroupAddPolicy:  req.GroupAddPolicy,
+		LastSeenPrivacy: req.LastSeenPrivacy,
+		Timezone:        req.Timezone,
+	})
+	if errors.Is(err, services.ErrInvalidGroupAddPolicy) || errors.Is(err, services.ErrInvalidLastSeenPrivacy) || errors.Is(err, services.ErrInvalidTimezone) ||
+		errors.Is(err, services.ErrInvalidUsername) || errors.Is(err, services.ErrInvalidPhone) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -123,6 +236,48 @@ func (h *AuthHandler) UpdateProfile(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"user": user})
 }
 
+// ChangePassword sets a new password for the caller. With
+// logout_other_devices, every other session is signed out too, and the
+// response carries new tokens for this one.
+func (h *AuthHandler) ChangePassword(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	if err := h.authService.ChangePassword(userID, req.OldPassword, req.NewPassword); err != nil {
+		switch {
+		case errors.Is(err, services.ErrWrongPassword):
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrWeakPassword), errors.Is(err, services.ErrPasswordReused):
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			respondServiceError(c, err, http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if !req.LogoutOtherDevices {
+		c.JSON(http.StatusOK, gin.H{"success": true})
+		return
+	}
+
+	accessToken, refreshToken, err := h.authService.ResetSessions(userID)
+	if err != nil {
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success":       true,
+		"access_token":  accessToken,
+		"refresh_token": refreshToken,
+	})
+}
+
 func (h *AuthHandler) SearchUsers(c *gin.Context) {
 	userID := c.GetUint("user_id")
 	query := c.Query("q")
@@ -132,11 +287,84 @@ func (h *AuthHandler) SearchUsers(c *gin.Context) {
 		return
 	}
 
-	users, err := h.authService.SearchUsers(query, userID)
+	limit, offset, err := parsePagination(c, h.searchPage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	users, total, err := h.authService.SearchUsers(query, userID, limit, offset)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	c.JSON(http.StatusOK, gin.H{
+		"users": users,
+		"total": total,
+	})
+}
+
+func (h *AuthHandler) MatchContacts(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	var req MatchContactsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	users, err := h.authService.MatchContacts(req.Phones, userID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
 	c.JSON(http.StatusOK, gin.H{"users": users})
 }
+
+func (h *AuthHandler) GetBlockedUsers(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	blocks, err := h.authService.GetBlockedUsers(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"blocks": blocks})
+}
+
+func (h *AuthHandler) BlockUser(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	var req BlockUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	block, err := h.authService.BlockUser(userID, req.UserID)
+	if err != nil {
+		respondServiceError(c, err, http.StatusBadRequest)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"block": block})
+}
+
+func (h *AuthHandler) UnblockUser(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	blockedID, err := strconv.ParseUint(c.Param("userId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	if err := h.authService.UnblockUser(userID, uint(blockedID)); err != nil {
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
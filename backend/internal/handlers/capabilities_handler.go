@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"onechat/internal/config"
+	"onechat/internal/services"
+)
+
+type CapabilitiesHandler struct {
+	capabilities gin.H
+}
+
+// NewCapabilitiesHandler computes the capabilities document once at startup;
+// none of its inputs change while the server is running.
+func NewCapabilitiesHandler(cfg *config.Config, aiService *services.AIService, mediaService *services.MediaService) *CapabilitiesHandler {
+	return &CapabilitiesHandler{
+		capabilities: gin.H{
+			"features": gin.H{
+				"ai":             aiService.Configured(),
+				"media":          mediaService.Configured(),
+				"ws_compression": cfg.WSCompression,
+			},
+			"limits": gin.H{
+				"max_message_length":    cfg.MaxMessageLength,
+				"max_group_members":     cfg.MaxGroupMembers,
+				"max_pinned_chats":      cfg.MaxPinnedChats,
+				"delete_window_seconds": int(cfg.DeleteWindow.Seconds()),
+				"message_page_max":      cfg.MessagePageMax,
+				"list_page_max":         cfg.ListPageMax,
+				"uploads_per_minute":    cfg.UploadsPerMinute,
+				"upload_daily_bytes":    cfg.UploadDailyBytes,
+				"max_upload_bytes":      cfg.MaxUploadBytes,
+				"upload_allowed_types":  cfg.UploadAllowedTypes,
+				"ws_max_conns_per_user": cfg.WSMaxConnsPerUser,
+			},
+		},
+	}
+}
+
+// GetCapabilities tells clients which features are enabled and the limits
+// they should enforce in the UI.
+func (h *CapabilitiesHandler) GetCapabilities(c *gin.Context) {
+	c.JSON(http.StatusOK, h.capabilities)
+}
@@ -2,23 +2,38 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"onechat/internal/models"
 	"onechat/internal/services"
 	"onechat/internal/websocket"
 )
 
 type ChatHandler struct {
-	chatService *services.ChatService
-	hub         *websocket.Hub
+	chatService         *services.ChatService
+	notificationService *services.NotificationService
+	hub                 *websocket.Hub
+	messagePage         PageLimits
+	listPage            PageLimits
 }
 
-func NewChatHandler(chatService *services.ChatService, hub *websocket.Hub) *ChatHandler {
+func NewChatHandler(chatService *services.ChatService, notificationService *services.NotificationService, hub *websocket.Hub, messagePage, listPage PageLimits) *ChatHandler {
 	return &ChatHandler{
-		chatService: chatService,
-		hub:         hub,
+		chatService:         chatService,
+		notificationService: notificationService,
+		hub:                 hub,
+		messagePage:         messagePage,
+		listPage:            listPage,
 	}
 }
 
@@ -27,20 +42,75 @@ type CreateChatRequest struct {
 }
 
 type SendMessageRequest struct {
-	Type      string `json:"type" binding:"required"`
-	Content   string `json:"content"`
-	MediaURL  string `json:"media_url"`
-	ReplyToID *uint  `json:"reply_to_id"`
+	Type         string `json:"type" binding:"required"`
+	Content      string `json:"content"`
+	MediaURL     string `json:"media_url"`
+	ReplyToID    *uint  `json:"reply_to_id"`
+	ThreadRootID *uint  `json:"thread_root_id"`
+	EventID      *uint  `json:"event_id"`
+	ClientID     string `json:"client_id" binding:"max=64"` // temporary ID echoed back in the ack
+
+	// Location messages
+	Latitude      *float64 `json:"latitude"`
+	Longitude     *float64 `json:"longitude"`
+	LocationLabel string   `json:"location_label" binding:"max=200"`
+
+	// Contact messages
+	ContactName  string `json:"contact_name"`
+	ContactPhone string `json:"contact_phone"`
+}
+
+type EditMessageRequest struct {
+	Content string `json:"content" binding:"required"`
+}
+
+type ReactionRequest struct {
+	Emoji string `json:"emoji" binding:"required,max=32"`
+}
+
+type ReorderPinnedChatsRequest struct {
+	ChatIDs []uint `json:"chat_ids" binding:"required"`
+}
+
+type NotificationSettingRequest struct {
+	Sound      *string `json:"sound" binding:"omitempty,max=64"`
+	CustomName *string `json:"custom_name" binding:"omitempty,max=64"`
+	Muted      *bool   `json:"muted"`
+}
+
+type SnoozeChatRequest struct {
+	RemindAt string `json:"remind_at" binding:"required"`
+}
+
+type SaveDraftRequest struct {
+	Content string `json:"content"` // empty clears the draft
+}
+
+type MuteChatRequest struct {
+	Until string `json:"until"` // RFC 3339; omit to mute until unmuted
 }
 
 type UpdateMessageStatusRequest struct {
-	Status string `json:"status" binding:"required"`
+	Status string `json:"status" binding:"required,oneof=delivered read"`
 }
 
 func (h *ChatHandler) GetChats(c *gin.Context) {
 	userID := c.GetUint("user_id")
 
-	chats, err := h.chatService.GetUserChats(userID)
+	limit, offset, err := parsePagination(c, h.listPage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// Archived chats are listed separately from the main list
+	archived, err := strconv.ParseBool(c.DefaultQuery("archived", "false"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "archived must be true or false"})
+		return
+	}
+
+	chats, err := h.chatService.GetUserChats(userID, archived, limit, offset)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -49,18 +119,33 @@ func (h *ChatHandler) GetChats(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"chats": chats})
 }
 
+func (h *ChatHandler) GetUnreadCounts(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	counts, total, err := h.chatService.GetUnreadCounts(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"counts": counts,
+		"total":  total,
+	})
+}
+
 func (h *ChatHandler) CreateChat(c *gin.Context) {
 	userID := c.GetUint("user_id")
 
 	var req CreateChatRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
 	chat, err := h.chatService.GetOrCreatePrivateChat(userID, req.RecipientID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondServiceError(c, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -74,24 +159,15 @@ func (h *ChatHandler) GetMessages(c *gin.Context) {
 		return
 	}
 
-	limit := 50
-	offset := 0
-
-	if l := c.Query("limit"); l != "" {
-		if parsedLimit, err := strconv.Atoi(l); err == nil {
-			limit = parsedLimit
-		}
-	}
-
-	if o := c.Query("offset"); o != "" {
-		if parsedOffset, err := strconv.Atoi(o); err == nil {
-			offset = parsedOffset
-		}
+	limit, offset, err := parsePagination(c, h.messagePage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
-	messages, err := h.chatService.GetMessages(uint(chatID), limit, offset)
+	messages, err := h.chatService.GetMessages(uint(chatID), c.GetUint("user_id"), limit, offset)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondServiceError(c, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -108,21 +184,102 @@ func (h *ChatHandler) SendMessage(c *gin.Context) {
 
 	var req SendMessageRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
+		return
+	}
+
+	message, err := h.sendMessage(userID, uint(chatID), &req)
+	if err != nil {
+		if errors.Is(err, errSystemMessage) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		var tooLong *services.MessageTooLongError
+		if errors.As(err, &tooLong) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "max_length": tooLong.Limit})
+			return
+		}
+		if errors.Is(err, services.ErrInvalidEventMessage) || errors.Is(err, services.ErrInvalidLocation) ||
+			errors.Is(err, services.ErrInvalidContact) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, services.ErrNotChatMember) || errors.Is(err, services.ErrAnnounceOnly) ||
+			errors.Is(err, services.ErrRestrictedMember) || errors.Is(err, services.ErrBlocked) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		var slowMode *services.SlowModeError
+		if errors.As(err, &slowMode) {
+			c.Header("Retry-After", strconv.Itoa(slowMode.RetryAfter))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error(), "retry_after": slowMode.RetryAfter})
+			return
+		}
+		respondServiceError(c, err, http.StatusInternalServerError)
 		return
 	}
 
+	c.JSON(http.StatusCreated, gin.H{"message": message, "client_id": req.ClientID})
+}
+
+// errSystemMessage is returned when a user tries to send a system message.
+var errSystemMessage = errors.New("System messages can only be sent by admins")
+
+// SendFromSocket sends a message that arrived as a send_message WebSocket
+// frame. The payload takes the same fields as SendMessage and goes through
+// the same validation; the hub reports a returned error to the client.
+func (h *ChatHandler) SendFromSocket(userID, chatID uint, payload json.RawMessage) error {
+	var req SendMessageRequest
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return fmt.Errorf("invalid message: %w", err)
+	}
+	if err := binding.Validator.ValidateStruct(&req); err != nil {
+		var validationErrors validator.ValidationErrors
+		if errors.As(err, &validationErrors) {
+			return errors.New(validationMessage(validationErrors[0]))
+		}
+		return err
+	}
+
+	_, err := h.sendMessage(userID, chatID, &req)
+	return err
+}
+
+// sendMessage stores a user's message, broadcasts it to the chat, acks it
+// to the sender and notifies offline members.
+func (h *ChatHandler) sendMessage(userID, chatID uint, req *SendMessageRequest) (*models.Message, error) {
+	if req.Type == "system" {
+		return nil, errSystemMessage
+	}
+
+	var location *services.Location
+	if req.Latitude != nil || req.Longitude != nil || req.LocationLabel != "" {
+		location = &services.Location{
+			Latitude:  req.Latitude,
+			Longitude: req.Longitude,
+			Label:     req.LocationLabel,
+		}
+	}
+
+	var contact *services.Contact
+	if req.ContactName != "" || req.ContactPhone != "" {
+		contact = &services.Contact{Name: req.ContactName, Phone: req.ContactPhone}
+	}
+
 	message, err := h.chatService.CreateMessage(
-		uint(chatID),
+		chatID,
 		userID,
 		req.Type,
 		req.Content,
 		req.MediaURL,
 		req.ReplyToID,
+		req.ThreadRootID,
+		req.EventID,
+		location,
+		contact,
 	)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
+		return nil, err
 	}
 
 	// Broadcast to WebSocket
@@ -130,9 +287,140 @@ func (h *ChatHandler) SendMessage(c *gin.Context) {
 		"type":    "new_message",
 		"message": message,
 	})
-	h.hub.BroadcastToChat(uint(chatID), messageJSON, userID)
+	h.hub.BroadcastNewMessage(chatID, message.ID, messageJSON, userID)
+	h.hub.SendAck(message, req.ClientID)
+
+	// Mentioned members hear about it even if they haven't joined the
+	// chat's room
+	if len(message.Mentions) > 0 {
+		mentionJSON, _ := json.Marshal(map[string]interface{}{
+			"type":    "mention",
+			"chat_id": chatID,
+			"message": message,
+		})
+		for _, mention := range message.Mentions {
+			h.hub.SendToUser(mention.UserID, mentionJSON)
+		}
+	}
+
+	go h.notifyOfflineMembers(message)
+
+	return message, nil
+}
+
+// notifyOfflineMembers sends a push notification for a new message to the
+// chat's members who have no open WebSocket connection. Mentioned members
+// get a mention notification instead, which mutes don't silence.
+func (h *ChatHandler) notifyOfflineMembers(message *models.Message) {
+	memberIDs, err := h.chatService.GetChatMemberIDs(message.ChatID)
+	if err != nil {
+		log.Printf("Failed to load members of chat %d: %v", message.ChatID, err)
+		return
+	}
+
+	mentioned := make(map[uint]bool, len(message.Mentions))
+	for _, mention := range message.Mentions {
+		mentioned[mention.UserID] = true
+	}
+
+	var offline, offlineMentioned []uint
+	for _, memberID := range memberIDs {
+		if memberID == message.SenderID || h.hub.IsOnline(memberID) {
+			continue
+		}
+		if mentioned[memberID] {
+			offlineMentioned = append(offlineMentioned, memberID)
+		} else {
+			offline = append(offline, memberID)
+		}
+	}
+
+	if err := h.notificationService.NotifyNewMessage(message, offline); err != nil {
+		log.Printf("Failed to send notifications for message %d: %v", message.ID, err)
+	}
+	if len(offlineMentioned) > 0 {
+		if err := h.notificationService.NotifyMention(message, offlineMentioned); err != nil {
+			log.Printf("Failed to send mention notifications for message %d: %v", message.ID, err)
+		}
+	}
+}
+
+func (h *ChatHandler) SearchMessages(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	chatID, err := strconv.ParseUint(c.Param("chatId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Search query is required"})
+		return
+	}
+
+	limit, offset, err := parsePagination(c, h.listPage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	results, err := h.chatService.SearchMessages(uint(chatID), userID, query, limit, offset)
+	if err != nil {
+		respondServiceError(c, err, http.StatusForbidden)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+// SearchAllMessages searches every chat the user belongs to, grouping the
+// matches by chat.
+func (h *ChatHandler) SearchAllMessages(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Search query is required"})
+		return
+	}
+
+	limit, offset, err := parsePagination(c, h.listPage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
-	c.JSON(http.StatusCreated, gin.H{"message": message})
+	results, err := h.chatService.SearchAllMessages(userID, query, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+func (h *ChatHandler) GetThreadMessages(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	messageID, err := strconv.ParseUint(c.Param("messageId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	limit, offset, err := parsePagination(c, h.messagePage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	messages, err := h.chatService.GetThreadMessages(uint(messageID), userID, limit, offset)
+	if err != nil {
+		respondServiceError(c, err, http.StatusForbidden)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"messages": messages})
 }
 
 func (h *ChatHandler) UpdateMessageStatus(c *gin.Context) {
@@ -145,28 +433,70 @@ func (h *ChatHandler) UpdateMessageStatus(c *gin.Context) {
 
 	var req UpdateMessageStatusRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	message, err := h.chatService.UpdateMessageStatus(uint(messageID), userID, req.Status)
+	if errors.Is(err, services.ErrNotChatMember) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if errors.Is(err, services.ErrInvalidMessageStatus) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if err != nil {
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
 
-	if err := h.chatService.UpdateMessageStatus(uint(messageID), userID, req.Status); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// Receipts go only to the sender so members don't see each other's read state
+	h.hub.SendReceipt(message, userID, req.Status)
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func (h *ChatHandler) EditMessage(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	messageID, err := strconv.ParseUint(c.Param("messageId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
 		return
 	}
 
-	// Get message to broadcast update
-	message, _ := h.chatService.GetMessageByID(uint(messageID))
-	if message != nil {
-		statusUpdate, _ := json.Marshal(map[string]interface{}{
-			"type":       "message_status",
-			"message_id": messageID,
-			"status":     req.Status,
-			"user_id":    userID,
-		})
-		h.hub.BroadcastToChat(message.ChatID, statusUpdate, 0)
+	var req EditMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"success": true})
+	message, err := h.chatService.EditMessage(uint(messageID), userID, req.Content)
+	if err != nil {
+		var tooLong *services.MessageTooLongError
+		if errors.As(err, &tooLong) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "max_length": tooLong.Limit})
+			return
+		}
+		if errors.Is(err, services.ErrNotMessageSender) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, services.ErrMessageNotEditable) || errors.Is(err, services.ErrMessageDeleted) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	editNotif, _ := json.Marshal(map[string]interface{}{
+		"type":    "message_edited",
+		"message": message,
+	})
+	h.hub.BroadcastToChat(message.ChatID, editNotif, 0)
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
 }
 
 func (h *ChatHandler) DeleteMessage(c *gin.Context) {
@@ -177,21 +507,614 @@ func (h *ChatHandler) DeleteMessage(c *gin.Context) {
 		return
 	}
 
+	scope := c.DefaultQuery("scope", services.DeleteForEveryone)
+
 	// Get message before deleting to get chat ID
 	message, _ := h.chatService.GetMessageByID(uint(messageID))
-	
-	if err := h.chatService.DeleteMessage(uint(messageID), userID); err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+
+	if err := h.chatService.DeleteMessage(uint(messageID), userID, scope); err != nil {
+		if errors.Is(err, services.ErrInvalidDeleteScope) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, services.ErrDeleteWindowPassed) {
+			// Tell the client it can still offer deleting for me
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":          err.Error(),
+				"code":           "delete_window_passed",
+				"allowed_scopes": []string{services.DeleteForMe},
+			})
+			return
+		}
+		respondServiceError(c, err, http.StatusForbidden)
+		return
+	}
+
+	if message == nil {
+		c.JSON(http.StatusOK, gin.H{"success": true})
 		return
 	}
 
-	// Broadcast deletion
-	if message != nil {
+	// Deleting for me only concerns the user's other devices
+	if scope == services.DeleteForMe {
 		deleteNotif, _ := json.Marshal(map[string]interface{}{
 			"type":       "message_deleted",
+			"scope":      scope,
+			"chat_id":    message.ChatID,
 			"message_id": messageID,
 		})
-		h.hub.BroadcastToChat(message.ChatID, deleteNotif, 0)
+		h.hub.SendToUser(userID, deleteNotif)
+		c.JSON(http.StatusOK, gin.H{"success": true})
+		return
+	}
+
+	deleted, _ := h.chatService.GetMessageByID(uint(messageID))
+	deleteNotif, _ := json.Marshal(map[string]interface{}{
+		"type":       "message_deleted",
+		"scope":      scope,
+		"chat_id":    message.ChatID,
+		"message_id": messageID,
+		"message":    deleted,
+	})
+	h.hub.BroadcastToChat(message.ChatID, deleteNotif, 0)
+	if message.IsPinned {
+		h.broadcastPinnedMessages(message.ChatID, userID)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": deleted})
+}
+
+func (h *ChatHandler) AddReaction(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	messageID, err := strconv.ParseUint(c.Param("messageId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	var req ReactionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	message, err := h.chatService.AddReaction(uint(messageID), userID, req.Emoji)
+	if err != nil {
+		if errors.Is(err, services.ErrMessageDeleted) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		respondServiceError(c, err, http.StatusForbidden)
+		return
+	}
+
+	h.broadcastReaction("reaction_added", message, userID, req.Emoji)
+
+	c.JSON(http.StatusOK, gin.H{"reactions": message.Reactions})
+}
+
+// RemoveReaction takes the emoji from the query string, since DELETE
+// requests shouldn't rely on a body.
+func (h *ChatHandler) RemoveReaction(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	messageID, err := strconv.ParseUint(c.Param("messageId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	emoji := c.Query("emoji")
+	if emoji == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "emoji is required"})
+		return
+	}
+
+	message, err := h.chatService.RemoveReaction(uint(messageID), userID, emoji)
+	if err != nil {
+		respondServiceError(c, err, http.StatusForbidden)
+		return
+	}
+
+	h.broadcastReaction("reaction_removed", message, userID, emoji)
+
+	c.JSON(http.StatusOK, gin.H{"reactions": message.Reactions})
+}
+
+// broadcastReaction tells the chat room about a reaction change, including
+// the message's new counts so clients don't have to refetch.
+func (h *ChatHandler) broadcastReaction(eventType string, message *models.Message, userID uint, emoji string) {
+	reactions := message.Reactions
+	if reactions == nil {
+		reactions = []models.ReactionCount{}
+	}
+
+	notif, _ := json.Marshal(map[string]interface{}{
+		"type":       eventType,
+		"chat_id":    message.ChatID,
+		"message_id": message.ID,
+		"user_id":    userID,
+		"emoji":      emoji,
+		"reactions":  reactions,
+	})
+	h.hub.BroadcastToChat(message.ChatID, notif, 0)
+}
+
+func (h *ChatHandler) GetPinnedMessages(c *gin.Context) {
+	chatID, err := strconv.ParseUint(c.Param("chatId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	messages, err := h.chatService.GetPinnedMessages(uint(chatID), c.GetUint("user_id"))
+	if errors.Is(err, services.ErrNotChatMember) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"messages": messages})
+}
+
+func (h *ChatHandler) PinMessage(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	messageID, err := strconv.ParseUint(c.Param("messageId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	message, err := h.chatService.PinMessage(uint(messageID), userID)
+	if err != nil {
+		if errors.Is(err, services.ErrNotChatMember) || errors.Is(err, services.ErrPinNotAllowed) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		if errors.Is(err, services.ErrMessageDeleted) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	pinNotif, _ := json.Marshal(map[string]interface{}{
+		"type":    "message_pinned",
+		"message": message,
+	})
+	h.hub.BroadcastToChat(message.ChatID, pinNotif, 0)
+	h.broadcastPinnedMessages(message.ChatID, userID)
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+func (h *ChatHandler) UnpinMessage(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	messageID, err := strconv.ParseUint(c.Param("messageId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	message, err := h.chatService.UnpinMessage(uint(messageID), userID)
+	if errors.Is(err, services.ErrNotChatMember) || errors.Is(err, services.ErrPinNotAllowed) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	unpinNotif, _ := json.Marshal(map[string]interface{}{
+		"type":       "message_unpinned",
+		"message_id": messageID,
+	})
+	h.hub.BroadcastToChat(message.ChatID, unpinNotif, 0)
+	h.broadcastPinnedMessages(message.ChatID, userID)
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// broadcastPinnedMessages sends the chat's current pinned list so clients can
+// refresh their pinned bar. userID is the member whose change prompted it.
+func (h *ChatHandler) broadcastPinnedMessages(chatID, userID uint) {
+	pinned, err := h.chatService.GetPinnedMessages(chatID, userID)
+	if err != nil {
+		return
+	}
+
+	pinnedNotif, _ := json.Marshal(map[string]interface{}{
+		"type":     "pinned_messages_updated",
+		"chat_id":  chatID,
+		"messages": pinned,
+	})
+	h.hub.BroadcastToChat(chatID, pinnedNotif, 0)
+}
+
+func (h *ChatHandler) SnoozeChat(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	chatID, err := strconv.ParseUint(c.Param("chatId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	var req SnoozeChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	remindAt, err := time.Parse(time.RFC3339, req.RemindAt)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid remind_at format"})
+		return
+	}
+
+	snooze, err := h.chatService.SnoozeChat(uint(chatID), userID, remindAt)
+	if err != nil {
+		respondServiceError(c, err, http.StatusBadRequest)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"snooze": snooze})
+}
+
+func (h *ChatHandler) GetDraft(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	chatID, err := strconv.ParseUint(c.Param("chatId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	draft, err := h.chatService.GetDraft(uint(chatID), userID)
+	if err != nil {
+		respondServiceError(c, err, http.StatusForbidden)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"draft": draft})
+}
+
+// SaveDraft stores the current user's draft for the chat and syncs it to
+// their other devices.
+func (h *ChatHandler) SaveDraft(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	chatID, err := strconv.ParseUint(c.Param("chatId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	var req SaveDraftRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	draft, err := h.chatService.SaveDraft(uint(chatID), userID, req.Content)
+	if err != nil {
+		var tooLong *services.MessageTooLongError
+		if errors.As(err, &tooLong) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "max_length": tooLong.Limit})
+			return
+		}
+		respondServiceError(c, err, http.StatusForbidden)
+		return
+	}
+
+	content := ""
+	if draft != nil {
+		content = draft.Content
+	}
+	draftNotif, _ := json.Marshal(map[string]interface{}{
+		"type":    "draft_updated",
+		"chat_id": chatID,
+		"content": content,
+	})
+	h.hub.SendToUser(userID, draftNotif)
+
+	c.JSON(http.StatusOK, gin.H{"draft": draft})
+}
+
+// MuteChat stops push notifications from the chat for the current user,
+// indefinitely or until the optional until time. The body may be empty.
+func (h *ChatHandler) MuteChat(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	chatID, err := strconv.ParseUint(c.Param("chatId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	var req MuteChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		respondBindingError(c, err)
+		return
+	}
+
+	var until *time.Time
+	if req.Until != "" {
+		parsed, err := time.Parse(time.RFC3339, req.Until)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid until format"})
+			return
+		}
+		until = &parsed
+	}
+
+	mute, err := h.chatService.MuteChat(uint(chatID), userID, until)
+	if err != nil {
+		respondServiceError(c, err, http.StatusBadRequest)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"mute": mute})
+}
+
+func (h *ChatHandler) UnmuteChat(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	chatID, err := strconv.ParseUint(c.Param("chatId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	if err := h.chatService.UnmuteChat(uint(chatID), userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func (h *ChatHandler) GetNotificationSetting(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	chatID, err := strconv.ParseUint(c.Param("chatId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	setting, err := h.chatService.GetNotificationSetting(uint(chatID), userID)
+	if err != nil {
+		respondServiceError(c, err, http.StatusForbidden)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"settings": setting})
+}
+
+func (h *ChatHandler) UpdateNotificationSetting(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	chatID, err := strconv.ParseUint(c.Param("chatId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	var req NotificationSettingRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	setting, err := h.chatService.UpdateNotificationSetting(uint(chatID), userID, req.Sound, req.CustomName, req.Muted)
+	if err != nil {
+		respondServiceError(c, err, http.StatusForbidden)
+		return
+	}
+
+	// Let the user's other devices pick up the change
+	settingsNotif, _ := json.Marshal(map[string]interface{}{
+		"type":     "notification_settings_updated",
+		"settings": setting,
+	})
+	h.hub.SendToUser(userID, settingsNotif)
+
+	c.JSON(http.StatusOK, gin.H{"settings": setting})
+}
+
+func (h *ChatHandler) GetChatPermissions(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	chatID, err := strconv.ParseUint(c.Param("chatId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	permissions, err := h.chatService.GetChatPermissions(uint(chatID), userID)
+	if err != nil {
+		respondServiceError(c, err, http.StatusForbidden)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"permissions": permissions})
+}
+
+func (h *ChatHandler) MarkAllChatsRead(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	receipts, err := h.chatService.MarkAllChatsRead(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	for _, receipt := range receipts {
+		h.sendChatRead(userID, receipt)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"chats": receipts})
+}
+
+// sendChatRead tells the senders of the messages the user just read, and
+// nobody else, that the user has read up to the receipt's last message.
+func (h *ChatHandler) sendChatRead(userID uint, receipt services.ChatReadReceipt) {
+	readNotif, _ := json.Marshal(map[string]interface{}{
+		"type":            "chat_read",
+		"chat_id":         receipt.ChatID,
+		"user_id":         userID,
+		"last_message_id": receipt.LastMessageID,
+	})
+	for _, senderID := range receipt.SenderIDs {
+		h.hub.SendToUser(senderID, readNotif)
+	}
+}
+
+// GetPresence reports the online state of the users listed in the ids
+// query parameter, e.g. ?ids=1,2,3. Users the caller doesn't share a chat
+// with are left out. Users connected to this instance count as online even
+// before their stored state catches up.
+func (h *ChatHandler) GetPresence(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	var ids []uint
+	seen := make(map[uint]bool)
+	for _, field := range strings.Split(c.Query("ids"), ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID: " + field})
+			return
+		}
+		if !seen[uint(id)] {
+			seen[uint(id)] = true
+			ids = append(ids, uint(id))
+		}
+	}
+	if len(ids) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ids is required"})
+		return
+	}
+	if len(ids) > services.MaxPresenceQuery {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d users can be queried at once", services.MaxPresenceQuery)})
+		return
+	}
+
+	presence, err := h.chatService.GetPresence(userID, ids)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for i := range presence {
+		if h.hub.IsOnline(presence[i].UserID) {
+			presence[i].IsOnline = true
+			presence[i].LastSeen = nil
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"presence": presence})
+}
+
+// MarkChatRead marks everything sent to the current user in the chat as
+// read, and sends one chat_read event to each user whose messages were
+// among them.
+func (h *ChatHandler) MarkChatRead(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	chatID, err := strconv.ParseUint(c.Param("chatId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	receipt, err := h.chatService.MarkChatRead(uint(chatID), userID)
+	if err != nil {
+		respondServiceError(c, err, http.StatusForbidden)
+		return
+	}
+
+	if receipt.LastMessageID != 0 {
+		h.sendChatRead(userID, *receipt)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"chat": receipt})
+}
+
+func (h *ChatHandler) ArchiveChat(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	chatID, err := strconv.ParseUint(c.Param("chatId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	if err := h.chatService.ArchiveChat(uint(chatID), userID); err != nil {
+		respondServiceError(c, err, http.StatusForbidden)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func (h *ChatHandler) UnarchiveChat(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	chatID, err := strconv.ParseUint(c.Param("chatId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	if err := h.chatService.UnarchiveChat(uint(chatID), userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func (h *ChatHandler) PinChat(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	chatID, err := strconv.ParseUint(c.Param("chatId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	if err := h.chatService.PinChat(uint(chatID), userID); err != nil {
+		respondServiceError(c, err, http.StatusBadRequest)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func (h *ChatHandler) UnpinChat(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	chatID, err := strconv.ParseUint(c.Param("chatId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid chat ID"})
+		return
+	}
+
+	if err := h.chatService.UnpinChat(uint(chatID), userID); err != nil {
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func (h *ChatHandler) ReorderPinnedChats(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	var req ReorderPinnedChatsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	if err := h.chatService.ReorderPinnedChats(userID, req.ChatIDs); err != nil {
+		respondServiceError(c, err, http.StatusBadRequest)
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"success": true})
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"gorm.io/gorm"
+)
+
+// APIError is the JSON error body. Message keeps the "error" key every
+// handler already uses; Code gives clients a stable value to switch on.
+type APIError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"error"`
+	Fields  []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError describes one failed validation rule on a request field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+func init() {
+	// Report fields by their JSON names rather than Go struct names
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+			if name == "-" {
+				return ""
+			}
+			return name
+		})
+	}
+}
+
+func respondError(c *gin.Context, status int, code, message string) {
+	c.AbortWithStatusJSON(status, APIError{Code: code, Message: message})
+}
+
+// respondServiceError reports a service error, turning a missing record into
+// a 404 and anything else into the given fallback status.
+func respondServiceError(c *gin.Context, err error, fallback int) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		respondError(c, http.StatusNotFound, "NOT_FOUND", "Resource not found")
+		return
+	}
+	c.JSON(fallback, gin.H{"error": err.Error()})
+}
+
+// respondBindingError turns a ShouldBindJSON failure into a 400, listing each
+// failed validation rule when the body parsed but didn't validate.
+func respondBindingError(c *gin.Context, err error) {
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		respondError(c, http.StatusBadRequest, "INVALID_REQUEST", err.Error())
+		return
+	}
+
+	fields := make([]FieldError, 0, len(validationErrors))
+	for _, fe := range validationErrors {
+		fields = append(fields, FieldError{
+			Field:   fe.Field(),
+			Rule:    fe.Tag(),
+			Message: validationMessage(fe),
+		})
+	}
+
+	c.AbortWithStatusJSON(http.StatusBadRequest, APIError{
+		Code:    "VALIDATION_ERROR",
+		Message: "Request validation failed",
+		Fields:  fields,
+	})
+}
+
+func validationMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return fmt.Sprintf("%s is required", fe.Field())
+	case "min":
+		if fe.Kind() == reflect.String {
+			return fmt.Sprintf("%s must be at least %s characters", fe.Field(), fe.Param())
+		}
+		return fmt.Sprintf("%s must be at least %s", fe.Field(), fe.Param())
+	case "max":
+		if fe.Kind() == reflect.String {
+			return fmt.Sprintf("%s must be at most %s characters", fe.Field(), fe.Param())
+		}
+		return fmt.Sprintf("%s must be at most %s", fe.Field(), fe.Param())
+	case "oneof":
+		return fmt.Sprintf("%s must be one of: %s", fe.Field(), fe.Param())
+	default:
+		return fmt.Sprintf("%s failed the '%s' rule", fe.Field(), fe.Tag())
+	}
+}
+
+func NoRoute(c *gin.Context) {
+	respondError(c, http.StatusNotFound, "NOT_FOUND", "Route not found")
+}
+
+func NoMethod(c *gin.Context) {
+	respondError(c, http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "Method not allowed")
+}
@@ -1,8 +1,12 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"math"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -11,24 +15,108 @@ import (
 
 type EventHandler struct {
 	eventService *services.EventService
+	listPage     PageLimits
 }
 
-func NewEventHandler(eventService *services.EventService) *EventHandler {
-	return &EventHandler{eventService: eventService}
+func NewEventHandler(eventService *services.EventService, listPage PageLimits) *EventHandler {
+	return &EventHandler{
+		eventService: eventService,
+		listPage:     listPage,
+	}
 }
 
 type CreateEventRequest struct {
 	Title           string `json:"title" binding:"required"`
 	Description     string `json:"description"`
 	Location        string `json:"location"`
-	EventDate       string `json:"event_date" binding:"required"`
+	EventDate       string `json:"event_date" binding:"required"` // RFC 3339, or local time in the timezone without an offset
 	SourceMessageID *uint  `json:"source_message_id"`
+	ReminderMinutes *int   `json:"reminder_minutes" binding:"omitempty,min=0,max=10080"` // omit for the default; 0 for no reminder
+	RecurrenceRule  string `json:"recurrence_rule"`                                      // daily, weekly, monthly or an RRULE subset
+	Timezone        string `json:"timezone"`                                             // IANA name; defaults to the user's
+}
+
+type CancelOccurrenceRequest struct {
+	OccurrenceDate string `json:"occurrence_date" binding:"required"` // start of the occurrence; RFC 3339, or local time in the event's timezone
+}
+
+type ImportEventRequest struct {
+	MessageID uint `json:"message_id" binding:"required"`
 }
 
 func (h *EventHandler) GetEvents(c *gin.Context) {
 	userID := c.GetUint("user_id")
 
-	events, err := h.eventService.GetUserEvents(userID)
+	limit, offset, err := parsePagination(c, h.listPage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	events, err := h.eventService.GetUserEvents(userID, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
+
+// GetUpcomingEvents returns the user's next events, with recurring events
+// expanded into their upcoming occurrences.
+func (h *EventHandler) GetUpcomingEvents(c *gin.Context) {
+	limit, _, err := parsePagination(c, h.listPage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	events, err := h.eventService.GetUpcomingEvents(c.GetUint("user_id"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"events": events})
+}
+
+// maxOccurrenceRange bounds the span GetOccurrences expands events over.
+const maxOccurrenceRange = 366 * 24 * time.Hour
+
+// GetOccurrences lists every occurrence of the user's events between the
+// from and to query parameters (RFC 3339). from defaults to now and to to 30
+// days after from.
+func (h *EventHandler) GetOccurrences(c *gin.Context) {
+	from := time.Now()
+	if v := c.Query("from"); v != "" {
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from date format"})
+			return
+		}
+		from = parsed
+	}
+
+	to := from.AddDate(0, 0, 30)
+	if v := c.Query("to"); v != "" {
+		parsed, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to date format"})
+			return
+		}
+		to = parsed
+	}
+
+	if !to.After(from) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must be after from"})
+		return
+	}
+	if to.Sub(from) > maxOccurrenceRange {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Date range can't be longer than a year"})
+		return
+	}
+
+	events, err := h.eventService.GetEventOccurrences(c.GetUint("user_id"), from, to)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -42,12 +130,18 @@ func (h *EventHandler) CreateEvent(c *gin.Context) {
 
 	var req CreateEventRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	loc, err := h.eventService.ResolveTimezone(userID, req.Timezone)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Parse event date
-	eventDate, err := time.Parse(time.RFC3339, req.EventDate)
+	// Parse event date; a time without an offset is local to the timezone
+	eventDate, err := services.ParseEventTime(req.EventDate, loc)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event date format"})
 		return
@@ -60,8 +154,15 @@ func (h *EventHandler) CreateEvent(c *gin.Context) {
 		req.Location,
 		eventDate,
 		req.SourceMessageID,
+		req.ReminderMinutes,
+		req.RecurrenceRule,
+		req.Timezone,
 	)
 	if err != nil {
+		if errors.Is(err, services.ErrInvalidRecurrence) || errors.Is(err, services.ErrInvalidTimezone) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -79,7 +180,7 @@ func (h *EventHandler) UpdateEvent(c *gin.Context) {
 
 	var updates map[string]interface{}
 	if err := c.ShouldBindJSON(&updates); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
@@ -87,16 +188,45 @@ func (h *EventHandler) UpdateEvent(c *gin.Context) {
 	delete(updates, "id")
 	delete(updates, "user_id")
 	delete(updates, "created_at")
+	delete(updates, "notified_for")
+
+	if value, ok := updates["reminder_minutes"]; ok {
+		minutes, ok := reminderMinutes(value)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("reminder_minutes must be a whole number from 0 to %d", maxReminderMinutes)})
+			return
+		}
+		updates["reminder_minutes"] = minutes
+	}
 
 	event, err := h.eventService.UpdateEvent(uint(eventID), userID, updates)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		if errors.Is(err, services.ErrInvalidRecurrence) || errors.Is(err, services.ErrInvalidTimezone) ||
+			errors.Is(err, services.ErrInvalidEventTime) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		respondServiceError(c, err, http.StatusInternalServerError)
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"event": event})
 }
 
+// maxReminderMinutes is the longest reminder lead time, a week, matching
+// the bound on CreateEventRequest.
+const maxReminderMinutes = 10080
+
+// reminderMinutes reads a reminder lead time from a decoded JSON update,
+// accepting only whole numbers from 0 to maxReminderMinutes.
+func reminderMinutes(value interface{}) (int, bool) {
+	number, ok := value.(float64)
+	if !ok || number != math.Trunc(number) || number < 0 || number > maxReminderMinutes {
+		return 0, false
+	}
+	return int(number), true
+}
+
 func (h *EventHandler) DeleteEvent(c *gin.Context) {
 	userID := c.GetUint("user_id")
 	eventID, err := strconv.ParseUint(c.Param("eventId"), 10, 32)
@@ -106,6 +236,114 @@ func (h *EventHandler) DeleteEvent(c *gin.Context) {
 	}
 
 	if err := h.eventService.DeleteEvent(uint(eventID), userID); err != nil {
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// CancelOccurrence cancels one occurrence of a recurring event, so it no
+// longer appears in occurrences, reminders or the calendar export.
+func (h *EventHandler) CancelOccurrence(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	eventID, err := strconv.ParseUint(c.Param("eventId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event ID"})
+		return
+	}
+
+	var req CancelOccurrenceRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	if err := h.eventService.CancelOccurrence(uint(eventID), userID, req.OccurrenceDate); err != nil {
+		if errors.Is(err, services.ErrNotRecurring) || errors.Is(err, services.ErrNoSuchOccurrence) ||
+			errors.Is(err, services.ErrInvalidEventTime) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// ImportFromMessage adds the event shared in a chat message to the current
+// user's calendar.
+func (h *EventHandler) ImportFromMessage(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	var req ImportEventRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	event, err := h.eventService.ImportEventFromMessage(userID, req.MessageID)
+	if err != nil {
+		if errors.Is(err, services.ErrEventAlreadyImported) {
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+			return
+		}
+		respondServiceError(c, err, http.StatusBadRequest)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"event": event})
+}
+
+// ExportCalendar returns the current user's events as an iCalendar file.
+func (h *EventHandler) ExportCalendar(c *gin.Context) {
+	h.writeCalendar(c, c.GetUint("user_id"))
+}
+
+// GetCalendarFeed serves a user's calendar at their secret feed URL, for
+// calendar apps that can't send an Authorization header.
+func (h *EventHandler) GetCalendarFeed(c *gin.Context) {
+	token := strings.TrimSuffix(c.Param("token"), ".ics")
+
+	userID, err := h.eventService.UserForCalendarToken(token)
+	if err != nil {
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	h.writeCalendar(c, userID)
+}
+
+func (h *EventHandler) writeCalendar(c *gin.Context, userID uint) {
+	ics, err := h.eventService.ExportICS(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Content-Disposition", `inline; filename="onechat.ics"`)
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", ics)
+}
+
+// RotateCalendarToken creates a secret calendar feed URL for the current
+// user, replacing any earlier one.
+func (h *EventHandler) RotateCalendarToken(c *gin.Context) {
+	token, err := h.eventService.RotateCalendarToken(c.GetUint("user_id"))
+	if err != nil {
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"token": token,
+		"path":  "/api/v1/calendar/" + token + ".ics",
+	})
+}
+
+// RevokeCalendarToken turns off the current user's calendar feed URL.
+func (h *EventHandler) RevokeCalendarToken(c *gin.Context) {
+	if err := h.eventService.RevokeCalendarToken(c.GetUint("user_id")); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestReminderMinutes(t *testing.T) {
+	tests := []struct {
+		body   string
+		want   int
+		wantOK bool
+	}{
+		{`0`, 0, true},
+		{`30`, 30, true},
+		{`10080`, 10080, true},
+		{`-5`, 0, false},
+		{`10081`, 0, false},
+		{`2.5`, 0, false},
+		{`"30"`, 0, false},
+		{`null`, 0, false},
+		{`true`, 0, false},
+	}
+
+	for _, tt := range tests {
+		var value interface{}
+		if err := json.Unmarshal([]byte(tt.body), &value); err != nil {
+			t.Fatal(err)
+		}
+		got, ok := reminderMinutes(value)
+		if ok != tt.wantOK || got != tt.want {
+			t.Errorf("reminderMinutes(%s) = %d, %v, want %d, %v", tt.body, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -2,8 +2,12 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
+	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"onechat/internal/services"
@@ -13,12 +17,14 @@ import (
 type GroupHandler struct {
 	groupService *services.GroupService
 	hub          *websocket.Hub
+	listPage     PageLimits
 }
 
-func NewGroupHandler(groupService *services.GroupService, hub *websocket.Hub) *GroupHandler {
+func NewGroupHandler(groupService *services.GroupService, hub *websocket.Hub, listPage PageLimits) *GroupHandler {
 	return &GroupHandler{
 		groupService: groupService,
 		hub:          hub,
+		listPage:     listPage,
 	}
 }
 
@@ -33,16 +39,41 @@ type AddMemberRequest struct {
 	UserID uint `json:"user_id" binding:"required"`
 }
 
+type AddMembersRequest struct {
+	UserIDs []uint `json:"user_ids" binding:"required,min=1"`
+}
+
 type UpdateMemberRoleRequest struct {
 	Role string `json:"role" binding:"required"`
 }
 
+type CreateInviteRequest struct {
+	MaxUses   int    `json:"max_uses" binding:"min=0"`
+	ExpiresAt string `json:"expires_at"` // RFC 3339, defaults to a week from now
+}
+
+// UpdateGroupRequest lists the group settings admins can edit. Anything
+// else in the body, such as created_by_id, is ignored.
+type UpdateGroupRequest struct {
+	Name             *string `json:"name" binding:"omitempty,min=1"`
+	Description      *string `json:"description"`
+	Icon             *string `json:"icon"`
+	MaxMessageLength *int    `json:"max_message_length"`
+	AnnounceOnly     *bool   `json:"announce_only"`
+	SlowModeSeconds  *int    `json:"slow_mode_seconds"`
+	DefaultRole      *string `json:"default_role"` // member or restricted
+}
+
+type SetNicknameRequest struct {
+	Nickname string `json:"nickname"`
+}
+
 func (h *GroupHandler) CreateGroup(c *gin.Context) {
 	userID := c.GetUint("user_id")
 
 	var req CreateGroupRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
@@ -64,7 +95,7 @@ func (h *GroupHandler) GetGroup(c *gin.Context) {
 
 	group, err := h.groupService.GetGroup(uint(groupID))
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		respondServiceError(c, err, http.StatusInternalServerError)
 		return
 	}
 
@@ -79,20 +110,29 @@ func (h *GroupHandler) UpdateGroup(c *gin.Context) {
 		return
 	}
 
-	var updates map[string]interface{}
-	if err := c.ShouldBindJSON(&updates); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	var req UpdateGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
 		return
 	}
 
-	// Remove protected fields
-	delete(updates, "id")
-	delete(updates, "created_by_id")
-	delete(updates, "created_at")
-
-	group, err := h.groupService.UpdateGroup(uint(groupID), userID, updates)
+	group, err := h.groupService.UpdateGroup(uint(groupID), userID, services.GroupUpdate{
+		Name:             req.Name,
+		Description:      req.Description,
+		Icon:             req.Icon,
+		MaxMessageLength: req.MaxMessageLength,
+		AnnounceOnly:     req.AnnounceOnly,
+		SlowModeSeconds:  req.SlowModeSeconds,
+		DefaultRole:      req.DefaultRole,
+	})
+	var invalidLength *services.InvalidMaxMessageLengthError
+	if errors.Is(err, services.ErrInvalidDefaultRole) || errors.Is(err, services.ErrInvalidSlowMode) ||
+		errors.As(err, &invalidLength) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		respondServiceError(c, err, http.StatusForbidden)
 		return
 	}
 
@@ -101,7 +141,7 @@ func (h *GroupHandler) UpdateGroup(c *gin.Context) {
 		"type":  "group_updated",
 		"group": group,
 	})
-	h.hub.BroadcastToChat(uint(groupID), updateNotif, 0)
+	h.broadcastToGroup(uint(groupID), updateNotif)
 
 	c.JSON(http.StatusOK, gin.H{"group": group})
 }
@@ -115,7 +155,7 @@ func (h *GroupHandler) DeleteGroup(c *gin.Context) {
 	}
 
 	if err := h.groupService.DeleteGroup(uint(groupID), userID); err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		respondServiceError(c, err, http.StatusForbidden)
 		return
 	}
 
@@ -132,12 +172,12 @@ func (h *GroupHandler) AddMember(c *gin.Context) {
 
 	var req AddMemberRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
 	if err := h.groupService.AddMember(uint(groupID), userID, req.UserID); err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		respondServiceError(c, err, http.StatusForbidden)
 		return
 	}
 
@@ -147,11 +187,111 @@ func (h *GroupHandler) AddMember(c *gin.Context) {
 		"group_id": groupID,
 		"user_id":  req.UserID,
 	})
-	h.hub.BroadcastToChat(uint(groupID), memberNotif, 0)
+	h.announceNewMembers(uint(groupID), memberNotif, []uint{req.UserID})
 
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
+// defaultInviteLifetime applies when an invite is created without expires_at.
+const defaultInviteLifetime = 7 * 24 * time.Hour
+
+func (h *GroupHandler) CreateInvite(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	groupID, err := strconv.ParseUint(c.Param("groupId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		return
+	}
+
+	var req CreateInviteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	expiresAt := time.Now().Add(defaultInviteLifetime)
+	if req.ExpiresAt != "" {
+		if expiresAt, err = time.Parse(time.RFC3339, req.ExpiresAt); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid expires_at format"})
+			return
+		}
+	}
+
+	invite, err := h.groupService.CreateInvite(uint(groupID), userID, req.MaxUses, expiresAt)
+	if err != nil {
+		respondServiceError(c, err, http.StatusForbidden)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"invite": invite})
+}
+
+func (h *GroupHandler) JoinByInvite(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	group, err := h.groupService.JoinByInvite(c.Param("token"), userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrInvalidInvite):
+			c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		case errors.Is(err, services.ErrAlreadyMember):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			respondServiceError(c, err, http.StatusForbidden)
+		}
+		return
+	}
+
+	memberNotif, _ := json.Marshal(map[string]interface{}{
+		"type":     "member_added",
+		"group_id": group.ID,
+		"user_id":  userID,
+	})
+	h.broadcastToGroup(group.ID, memberNotif)
+
+	c.JSON(http.StatusOK, gin.H{"group": group})
+}
+
+func (h *GroupHandler) AddMembers(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	groupID, err := strconv.ParseUint(c.Param("groupId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		return
+	}
+
+	var req AddMembersRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	results, err := h.groupService.AddMembers(uint(groupID), userID, req.UserIDs)
+	if err != nil {
+		respondServiceError(c, err, http.StatusForbidden)
+		return
+	}
+
+	var added []uint
+	for _, result := range results {
+		if result.Added {
+			added = append(added, result.UserID)
+		}
+	}
+
+	// Broadcast one event for the whole batch
+	if len(added) > 0 {
+		membersNotif, _ := json.Marshal(map[string]interface{}{
+			"type":     "members_added",
+			"group_id": groupID,
+			"user_ids": added,
+		})
+		h.announceNewMembers(uint(groupID), membersNotif, added)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
 func (h *GroupHandler) RemoveMember(c *gin.Context) {
 	userID := c.GetUint("user_id")
 	groupID, err := strconv.ParseUint(c.Param("groupId"), 10, 32)
@@ -167,7 +307,7 @@ func (h *GroupHandler) RemoveMember(c *gin.Context) {
 	}
 
 	if err := h.groupService.RemoveMember(uint(groupID), userID, uint(memberID)); err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		respondServiceError(c, err, http.StatusForbidden)
 		return
 	}
 
@@ -177,7 +317,42 @@ func (h *GroupHandler) RemoveMember(c *gin.Context) {
 		"group_id": groupID,
 		"user_id":  memberID,
 	})
-	h.hub.BroadcastToChat(uint(groupID), removeNotif, 0)
+	h.broadcastToGroup(uint(groupID), removeNotif)
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// LeaveGroup lets the current user leave a group without admin rights.
+func (h *GroupHandler) LeaveGroup(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	groupID, err := strconv.ParseUint(c.Param("groupId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		return
+	}
+
+	promoted, err := h.groupService.LeaveGroup(uint(groupID), userID)
+	if err != nil {
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	leftNotif, _ := json.Marshal(map[string]interface{}{
+		"type":     "member_left",
+		"group_id": groupID,
+		"user_id":  userID,
+	})
+	h.broadcastToGroup(uint(groupID), leftNotif)
+
+	if promoted != nil {
+		roleNotif, _ := json.Marshal(map[string]interface{}{
+			"type":     "role_updated",
+			"group_id": groupID,
+			"user_id":  promoted.UserID,
+			"role":     "admin",
+		})
+		h.broadcastToGroup(uint(groupID), roleNotif)
+	}
 
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
@@ -198,12 +373,12 @@ func (h *GroupHandler) UpdateMemberRole(c *gin.Context) {
 
 	var req UpdateMemberRoleRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondBindingError(c, err)
 		return
 	}
 
 	if err := h.groupService.UpdateMemberRole(uint(groupID), userID, uint(memberID), req.Role); err != nil {
-		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		respondServiceError(c, err, http.StatusForbidden)
 		return
 	}
 
@@ -214,7 +389,91 @@ func (h *GroupHandler) UpdateMemberRole(c *gin.Context) {
 		"user_id":  memberID,
 		"role":     req.Role,
 	})
-	h.hub.BroadcastToChat(uint(groupID), roleNotif, 0)
+	h.broadcastToGroup(uint(groupID), roleNotif)
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+func (h *GroupHandler) SetMemberNickname(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	groupID, err := strconv.ParseUint(c.Param("groupId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		return
+	}
+
+	memberID, err := strconv.ParseUint(c.Param("userId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var req SetNicknameRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	if err := h.groupService.SetMemberNickname(uint(groupID), userID, uint(memberID), req.Nickname); err != nil {
+		respondServiceError(c, err, http.StatusForbidden)
+		return
+	}
+
+	nicknameNotif, _ := json.Marshal(map[string]interface{}{
+		"type":     "nickname_changed",
+		"group_id": groupID,
+		"user_id":  memberID,
+		"nickname": strings.TrimSpace(req.Nickname),
+	})
+	h.broadcastToGroup(uint(groupID), nicknameNotif)
 
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
+
+// GetReadStats returns aggregate read counts for the group's recent messages.
+func (h *GroupHandler) GetReadStats(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	groupID, err := strconv.ParseUint(c.Param("groupId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid group ID"})
+		return
+	}
+
+	limit, _, err := parsePagination(c, h.listPage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	memberCount, stats, err := h.groupService.GetGroupReadStats(uint(groupID), userID, limit)
+	if err != nil {
+		respondServiceError(c, err, http.StatusForbidden)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"member_count": memberCount,
+		"messages":     stats,
+	})
+}
+
+// announceNewMembers sends a member_added style event to the group's chat
+// room and straight to the new members, who haven't joined the room yet but
+// should still learn in real time that they're in the group.
+func (h *GroupHandler) announceNewMembers(groupID uint, message []byte, added []uint) {
+	h.broadcastToGroup(groupID, message)
+	for _, userID := range added {
+		h.hub.SendToUser(userID, message)
+	}
+}
+
+// broadcastToGroup sends a message to the members connected to the group's
+// chat. Hub rooms are keyed by chat ID, which differs from the group ID.
+func (h *GroupHandler) broadcastToGroup(groupID uint, message []byte) {
+	chatID, err := h.groupService.GetGroupChatID(groupID)
+	if err != nil {
+		log.Printf("Failed to find chat for group %d: %v", groupID, err)
+		return
+	}
+	h.hub.BroadcastToChat(chatID, message, 0)
+}
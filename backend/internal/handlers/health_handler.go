@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// readyTimeout bounds the database ping behind /ready, so a hung database
+// fails the check instead of stalling it.
+const readyTimeout = 2 * time.Second
+
+type HealthHandler struct {
+	db *gorm.DB
+}
+
+func NewHealthHandler(db *gorm.DB) *HealthHandler {
+	return &HealthHandler{db: db}
+}
+
+// Health is a liveness check: it only reports that the process is serving
+// requests.
+func (h *HealthHandler) Health(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "healthy"})
+}
+
+// Ready is a readiness check: it returns 503 unless the database answers a
+// ping, and reports how long the round trip took.
+func (h *HealthHandler) Ready(c *gin.Context) {
+	sqlDB, err := h.db.DB()
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "error": err.Error()})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readyTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err = sqlDB.PingContext(ctx)
+	latencyMs := float64(time.Since(start).Microseconds()) / 1000
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":        "unavailable",
+			"error":         "database unreachable: " + err.Error(),
+			"db_latency_ms": latencyMs,
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"status":        "ready",
+		"db_latency_ms": latencyMs,
+	})
+}
@@ -1,35 +1,340 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+	"mime/multipart"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"onechat/internal/services"
 )
 
 type MediaHandler struct {
-	mediaService *services.MediaService
+	mediaService  *services.MediaService
+	uploadLimiter *services.UploadLimiter
+	listPage      PageLimits
+	urlTTL        time.Duration
 }
 
-func NewMediaHandler(mediaService *services.MediaService) *MediaHandler {
-	return &MediaHandler{mediaService: mediaService}
+// NewMediaHandler hands out signed links to media that stay valid for
+// urlTTL.
+func NewMediaHandler(mediaService *services.MediaService, uploadLimiter *services.UploadLimiter, listPage PageLimits, urlTTL time.Duration) *MediaHandler {
+	return &MediaHandler{
+		mediaService:  mediaService,
+		uploadLimiter: uploadLimiter,
+		listPage:      listPage,
+		urlTTL:        urlTTL,
+	}
 }
 
+// multipartOverhead is allowed on top of the file size limit for the form's
+// boundaries and part headers.
+const multipartOverhead = 1 << 20
+
 func (h *MediaHandler) Upload(c *gin.Context) {
 	userID := c.GetUint("user_id")
 
+	// Stop reading oversized bodies early instead of spooling them to disk;
+	// the slack covers the multipart framing around the file
+	if max := h.mediaService.MaxUploadBytes(); max > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, max+multipartOverhead)
+	}
+
 	file, header, err := c.Request.FormFile("file")
 	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			h.respondTooLarge(c)
+			return
+		}
 		c.JSON(http.StatusBadRequest, gin.H{"error": "No file provided"})
 		return
 	}
 	defer file.Close()
 
-	result, err := h.mediaService.Upload(file, header, userID)
+	result, status, body := h.store(file, header, userID)
+	if body != nil {
+		if resetAt, ok := body["reset_at"].(time.Time); ok {
+			c.Header("Retry-After", strconv.Itoa(int(time.Until(resetAt).Seconds())+1))
+		}
+		c.JSON(status, body)
+		return
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// Batch upload bounds: files per request, and how many are sent to storage
+// at once.
+const (
+	maxBatchFiles = 10
+	uploadWorkers = 4
+)
+
+// BatchUploadResult is the outcome for one file of a batch upload. Status
+// is the HTTP status the file would have got uploaded on its own.
+type BatchUploadResult struct {
+	Filename string `json:"filename"`
+	Status   int    `json:"status"`
+	Error    gin.H  `json:"error,omitempty"`
+	*services.UploadResult
+}
+
+// UploadBatch stores every file in the files[] form field, a few at a time.
+// Each file is checked, rate limited and uploaded on its own, so one bad
+// file doesn't fail the rest; results come back in the order sent.
+func (h *MediaHandler) UploadBatch(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	if max := h.mediaService.MaxUploadBytes(); max > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBatchFiles*max+multipartOverhead)
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			h.respondTooLarge(c)
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No files provided"})
+		return
+	}
+	headers := form.File["files[]"]
+	if len(headers) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No files provided"})
+		return
+	}
+	if len(headers) > maxBatchFiles {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d files can be uploaded at once", maxBatchFiles)})
+		return
+	}
+
+	results := make([]BatchUploadResult, len(headers))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < uploadWorkers && w < len(headers); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = h.storeBatchFile(headers[i], userID)
+			}
+		}()
+	}
+	for i := range headers {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+func (h *MediaHandler) storeBatchFile(header *multipart.FileHeader, userID uint) BatchUploadResult {
+	entry := BatchUploadResult{Filename: header.Filename}
+
+	file, err := header.Open()
+	if err != nil {
+		entry.Status = http.StatusBadRequest
+		entry.Error = gin.H{"error": "Failed to read file"}
+		return entry
+	}
+	defer file.Close()
+
+	result, status, body := h.store(file, header, userID)
+	entry.Status = status
+	entry.Error = body
+	entry.UploadResult = result
+	return entry
+}
+
+// store checks, rate limits and uploads one file. On failure it returns
+// the status and error body to respond with instead of a result.
+func (h *MediaHandler) store(file multipart.File, header *multipart.FileHeader, userID uint) (*services.UploadResult, int, gin.H) {
+	contentType, status, body := h.admit(file, header, userID)
+	if body != nil {
+		return nil, status, body
+	}
+
+	result, err := h.mediaService.Upload(file, header, contentType, userID)
+	if err != nil {
+		return nil, http.StatusInternalServerError, gin.H{"error": err.Error()}
+	}
+	return result, http.StatusOK, nil
+}
+
+// ListMedia returns the caller's uploads that haven't expired yet.
+func (h *MediaHandler) ListMedia(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	limit, offset, err := parsePagination(c, h.listPage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	media, err := h.mediaService.GetUserMedia(userID, limit, offset)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, result)
+	c.JSON(http.StatusOK, gin.H{"media": media})
+}
+
+// GetMediaURL returns a short-lived signed link to an upload, along with a
+// preview link for images and videos, as long as the caller uploaded it or
+// shares a chat with whoever did.
+func (h *MediaHandler) GetMediaURL(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	mediaID, err := strconv.ParseUint(c.Param("id"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid media ID"})
+		return
+	}
+
+	media, err := h.mediaService.GetViewableMedia(uint(mediaID), userID)
+	if err != nil {
+		if errors.Is(err, services.ErrMediaAccessDenied) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	expiresAt := time.Now().Add(h.urlTTL)
+	url, err := h.mediaService.GetSignedURL(media.PublicID, h.urlTTL)
+	if err != nil {
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	thumbnail, err := h.mediaService.GetThumbnailURL(media, h.urlTTL)
+	if err != nil {
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	response := gin.H{
+		"url":        url,
+		"expires_at": expiresAt,
+	}
+	if thumbnail != "" {
+		response["thumbnail_url"] = thumbnail
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// DeleteMedia removes one of the caller's uploads. Cloudinary public IDs
+// contain slashes, so the route captures the rest of the path.
+func (h *MediaHandler) DeleteMedia(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	publicID := strings.TrimPrefix(c.Param("publicId"), "/")
+	if publicID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid public ID"})
+		return
+	}
+
+	if err := h.mediaService.DeleteUserMedia(publicID, userID); err != nil {
+		if errors.Is(err, services.ErrNotMediaOwner) {
+			c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+			return
+		}
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// admit applies the size limit, type allowlist and upload rate limit to a
+// file, returning its content type or the status and error body to respond
+// with.
+func (h *MediaHandler) admit(file multipart.File, header *multipart.FileHeader, userID uint) (string, int, gin.H) {
+	contentType, err := h.mediaService.CheckUpload(file, header)
+	if err != nil {
+		var tooLarge *services.UploadTooLargeError
+		var unsupported *services.UnsupportedMediaTypeError
+		switch {
+		case errors.As(err, &tooLarge):
+			return "", http.StatusRequestEntityTooLarge, h.tooLargeBody()
+		case errors.As(err, &unsupported):
+			return "", http.StatusUnsupportedMediaType, gin.H{
+				"error":         err.Error(),
+				"content_type":  unsupported.ContentType,
+				"allowed_types": unsupported.Allowed,
+			}
+		default:
+			return "", http.StatusBadRequest, gin.H{"error": err.Error()}
+		}
+	}
+
+	if allowed, resetAt := h.uploadLimiter.Allow(userID, header.Size); !allowed {
+		return "", http.StatusTooManyRequests, gin.H{
+			"error":    "Upload limit exceeded",
+			"reset_at": resetAt,
+		}
+	}
+	return contentType, http.StatusOK, nil
+}
+
+// UploadAvatar sets the caller's profile picture from an image in the file
+// form field and returns their updated profile.
+func (h *MediaHandler) UploadAvatar(c *gin.Context) {
+	userID := c.GetUint("user_id")
+
+	if max := h.mediaService.MaxUploadBytes(); max > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, max+multipartOverhead)
+	}
+
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			h.respondTooLarge(c)
+			return
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No file provided"})
+		return
+	}
+	defer file.Close()
+
+	if _, status, body := h.admit(file, header, userID); body != nil {
+		if resetAt, ok := body["reset_at"].(time.Time); ok {
+			c.Header("Retry-After", strconv.Itoa(int(time.Until(resetAt).Seconds())+1))
+		}
+		c.JSON(status, body)
+		return
+	}
+
+	user, err := h.mediaService.UploadAvatar(file, header, userID)
+	if err != nil {
+		if errors.Is(err, services.ErrNotAnImage) {
+			c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+			return
+		}
+		respondServiceError(c, err, http.StatusInternalServerError)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"user": user})
+}
+
+func (h *MediaHandler) respondTooLarge(c *gin.Context) {
+	c.JSON(http.StatusRequestEntityTooLarge, h.tooLargeBody())
+}
+
+func (h *MediaHandler) tooLargeBody() gin.H {
+	max := h.mediaService.MaxUploadBytes()
+	return gin.H{
+		"error":     fmt.Sprintf("File exceeds maximum upload size of %d bytes", max),
+		"max_bytes": max,
+	}
 }
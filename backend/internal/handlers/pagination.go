@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// PageLimits is the default and maximum page size for a list endpoint.
+type PageLimits struct {
+	Default int
+	Max     int
+}
+
+// parsePagination reads limit and offset from the query string. A missing
+// limit uses the default and an oversized one is clamped to the max;
+// non-numeric or negative values are rejected.
+func parsePagination(c *gin.Context, limits PageLimits) (limit, offset int, err error) {
+	limit = limits.Default
+
+	if l := c.Query("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			return 0, 0, errors.New("limit must be a positive integer")
+		}
+	}
+	if limits.Max > 0 && limit > limits.Max {
+		limit = limits.Max
+	}
+
+	if o := c.Query("offset"); o != "" {
+		offset, err = strconv.Atoi(o)
+		if err != nil || offset < 0 {
+			return 0, 0, errors.New("offset must be a non-negative integer")
+		}
+	}
+
+	return limit, offset, nil
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParsePagination(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	limits := PageLimits{Default: 20, Max: 100}
+
+	tests := []struct {
+		name       string
+		query      string
+		limits     PageLimits
+		wantLimit  int
+		wantOffset int
+		wantErr    bool
+	}{
+		{"defaults", "", limits, 20, 0, false},
+		{"explicit", "limit=50&offset=10", limits, 50, 10, false},
+		{"at the max", "limit=100", limits, 100, 0, false},
+		{"clamped to the max", "limit=1000", limits, 100, 0, false},
+		{"huge limit clamped", "limit=9223372036854775807", limits, 100, 0, false},
+		{"no max", "limit=1000", PageLimits{Default: 20}, 1000, 0, false},
+		{"large offset", "offset=1000000", limits, 20, 1000000, false},
+		{"empty values use defaults", "limit=&offset=", limits, 20, 0, false},
+		{"zero limit", "limit=0", limits, 0, 0, true},
+		{"negative limit", "limit=-5", limits, 0, 0, true},
+		{"negative offset", "offset=-1", limits, 0, 0, true},
+		{"non-numeric limit", "limit=ten", limits, 0, 0, true},
+		{"non-numeric offset", "offset=abc", limits, 0, 0, true},
+		{"fractional limit", "limit=2.5", limits, 0, 0, true},
+		{"limit overflowing int", "limit=99999999999999999999", limits, 0, 0, true},
+		{"offset overflowing int", "offset=99999999999999999999", limits, 0, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/?"+tt.query, nil)
+
+			limit, offset, err := parsePagination(c, tt.limits)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsePagination(%q) = %d, %d, want an error", tt.query, limit, offset)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePagination(%q): %v", tt.query, err)
+			}
+			if limit != tt.wantLimit || offset != tt.wantOffset {
+				t.Errorf("parsePagination(%q) = %d, %d, want %d, %d", tt.query, limit, offset, tt.wantLimit, tt.wantOffset)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"onechat/internal/services"
+)
+
+type ReportHandler struct {
+	reportService *services.ReportService
+	listPage      PageLimits
+}
+
+func NewReportHandler(reportService *services.ReportService, listPage PageLimits) *ReportHandler {
+	return &ReportHandler{
+		reportService: reportService,
+		listPage:      listPage,
+	}
+}
+
+type ReportMessageRequest struct {
+	Notes string `json:"notes" binding:"max=2000"`
+}
+
+func (h *ReportHandler) ReportMessage(c *gin.Context) {
+	userID := c.GetUint("user_id")
+	messageID, err := strconv.ParseUint(c.Param("messageId"), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid message ID"})
+		return
+	}
+
+	var req ReportMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondBindingError(c, err)
+		return
+	}
+
+	report, err := h.reportService.ReportMessage(uint(messageID), userID, req.Notes)
+	if err != nil {
+		respondServiceError(c, err, http.StatusForbidden)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"report": report})
+}
+
+func (h *ReportHandler) ListReports(c *gin.Context) {
+	limit, offset, err := parsePagination(c, h.listPage)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	reports, err := h.reportService.ListReports(c.Query("status"), limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"reports": reports})
+}
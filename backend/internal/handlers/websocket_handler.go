@@ -3,6 +3,7 @@ package handlers
 import (
 	"log"
 	"net/http"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -11,25 +12,68 @@ import (
 )
 
 type WebSocketHandler struct {
-	hub         *ws.Hub
-	authService *services.AuthService
-	upgrader    websocket.Upgrader
+	hub                  *ws.Hub
+	authService          *services.AuthService
+	upgrader             websocket.Upgrader
+	compressionThreshold int
 }
 
-func NewWebSocketHandler(hub *ws.Hub, authService *services.AuthService) *WebSocketHandler {
+// NewWebSocketHandler builds the upgrader. When compression is enabled,
+// per-message deflate is negotiated and applied to frames of at least
+// compressionThreshold bytes.
+func NewWebSocketHandler(hub *ws.Hub, authService *services.AuthService, allowedOrigins []string, compression bool, compressionThreshold int) *WebSocketHandler {
+	if !compression {
+		compressionThreshold = 0
+	}
+
 	return &WebSocketHandler{
 		hub:         hub,
 		authService: authService,
 		upgrader: websocket.Upgrader{
-			ReadBufferSize:  1024,
-			WriteBufferSize: 1024,
+			ReadBufferSize:    1024,
+			WriteBufferSize:   1024,
+			EnableCompression: compression,
+			Subprotocols:      []string{wsSubprotocol},
 			CheckOrigin: func(r *http.Request) bool {
-				return true // Allow all origins in development
+				return originAllowed(r.Header.Get("Origin"), allowedOrigins)
 			},
 		},
+		compressionThreshold: compressionThreshold,
 	}
 }
 
+// originAllowed matches an Origin header against the configured list, where
+// "*" allows any origin. Requests without an Origin header (non-browser
+// clients) are always allowed.
+func originAllowed(origin string, allowedOrigins []string) bool {
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// wsSubprotocol is the subprotocol the server selects. Clients sending
+// their token as a subprotocol must offer it too, since browsers drop
+// connections where the server picks none of the offered protocols, and
+// the server never echoes the token.
+const wsSubprotocol = "onechat"
+
+// Frames sockets must authenticate with when the upgrade request carried no
+// token: the first frame has to be {"type":"auth","token":"..."} and arrive
+// within authTimeout.
+const (
+	authTimeout    = 10 * time.Second
+	authFrameLimit = 4096
+)
+
+// HandleWebSocket upgrades the connection and registers the client with the
+// hub. Connections the middleware couldn't authenticate are upgraded first
+// and only registered once their auth frame checks out.
 func (h *WebSocketHandler) HandleWebSocket(c *gin.Context) {
 	userID := c.GetUint("user_id")
 
@@ -39,15 +83,76 @@ func (h *WebSocketHandler) HandleWebSocket(c *gin.Context) {
 		return
 	}
 
+	if userID == 0 {
+		go func() {
+			if userID, ok := h.awaitAuth(conn); ok {
+				h.serve(conn, userID)
+			}
+		}()
+		return
+	}
+	h.serve(conn, userID)
+}
+
+// awaitAuth reads the auth frame and validates its token, closing the
+// connection if it's missing, late or invalid.
+func (h *WebSocketHandler) awaitAuth(conn *websocket.Conn) (uint, bool) {
+	conn.SetReadLimit(authFrameLimit)
+	conn.SetReadDeadline(time.Now().Add(authTimeout))
+
+	var frame struct {
+		Type  string `json:"type"`
+		Token string `json:"token"`
+	}
+	if err := conn.ReadJSON(&frame); err != nil || frame.Type != "auth" || frame.Token == "" {
+		rejectSocket(conn, "authentication required")
+		return 0, false
+	}
+
+	claims, err := h.authService.ValidateToken(frame.Token)
+	if err != nil {
+		rejectSocket(conn, "invalid or expired token")
+		return 0, false
+	}
+
+	conn.SetReadDeadline(time.Time{})
+	if err := conn.WriteJSON(gin.H{"type": "auth_ok"}); err != nil {
+		conn.Close()
+		return 0, false
+	}
+	return claims.UserID, true
+}
+
+func rejectSocket(conn *websocket.Conn, reason string) {
+	conn.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.ClosePolicyViolation, reason),
+		time.Now().Add(time.Second),
+	)
+	conn.Close()
+}
+
+// serve registers an authenticated connection and starts its pumps.
+func (h *WebSocketHandler) serve(conn *websocket.Conn, userID uint) {
 	client := &ws.Client{
-		ID:        userID,
-		Hub:       h.hub,
-		Conn:      conn,
-		Send:      make(chan []byte, 256),
-		ChatRooms: make(map[uint]bool),
+		ID:              userID,
+		Hub:             h.hub,
+		Conn:            conn,
+		Send:            make(chan []byte, 256),
+		ChatRooms:       make(map[uint]bool),
+		CompressMinSize: h.compressionThreshold,
 	}
 
-	client.Hub.register <- client
+	if !client.Hub.Register(client) {
+		// The server is shutting down
+		conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+			time.Now().Add(time.Second),
+		)
+		conn.Close()
+		return
+	}
 
 	// Start reading and writing in goroutines
 	go client.WritePump()
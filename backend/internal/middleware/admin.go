@@ -0,0 +1,21 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"onechat/internal/services"
+)
+
+// AdminMiddleware must run after AuthMiddleware; it rejects users who are not
+// flagged as platform admins.
+func AdminMiddleware(adminService *services.AdminService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !adminService.IsAdmin(c.GetUint("user_id")) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
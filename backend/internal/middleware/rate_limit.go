@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+// RateLimitMiddleware allows each authenticated user at most limit requests
+// per window on the routes it guards. It must run after AuthMiddleware.
+func RateLimitMiddleware(limit int, window time.Duration) gin.HandlerFunc {
+	var mu sync.Mutex
+	windows := make(map[uint]*rateWindow)
+
+	return func(c *gin.Context) {
+		userID := c.GetUint("user_id")
+		now := time.Now()
+
+		mu.Lock()
+		w, ok := windows[userID]
+		if !ok || now.Sub(w.start) >= window {
+			w = &rateWindow{start: now}
+			windows[userID] = w
+		}
+		w.count++
+		exceeded := w.count > limit
+		resetAt := w.start.Add(window)
+		mu.Unlock()
+
+		if exceeded {
+			c.Header("Retry-After", strconv.Itoa(int(time.Until(resetAt).Seconds())+1))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -7,58 +7,94 @@ import (
 )
 
 type User struct {
-	ID          uint           `gorm:"primaryKey" json:"id"`
-	Phone       string         `gorm:"unique;not null" json:"phone"`
-	Username    string         `gorm:"unique;not null" json:"username"`
-	Password    string         `gorm:"not null" json:"-"`
-	ProfilePic  string         `json:"profile_pic"`
-	Status      string         `json:"status"`
-	LastSeen    *time.Time     `json:"last_seen"`
-	IsOnline    bool           `json:"is_online"`
-	CreatedAt   time.Time      `json:"created_at"`
-	UpdatedAt   time.Time      `json:"updated_at"`
-	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+	ID              uint           `gorm:"primaryKey" json:"id"`
+	Phone           string         `gorm:"unique;not null" json:"phone"`
+	Username        string         `gorm:"unique;not null" json:"username"`
+	Password        string         `gorm:"not null" json:"-"`
+	ProfilePic      string         `json:"profile_pic"`
+	AvatarPublicID  string         `json:"-"` // storage ID of an avatar uploaded through /users/me/avatar
+	Status          string         `json:"status"`
+	LastSeen        *time.Time     `json:"-"` // only shown through presence, which applies LastSeenPrivacy
+	IsOnline        bool           `json:"-"`
+	IsAdmin         bool           `gorm:"default:false" json:"is_admin"`
+	GroupAddPolicy  string         `gorm:"default:'everyone'" json:"group_add_policy"`  // everyone, contacts, nobody
+	LastSeenPrivacy string         `gorm:"default:'contacts'" json:"last_seen_privacy"` // who sees LastSeen: everyone, contacts, nobody
+	Timezone        string         `json:"timezone"`                                    // IANA name, e.g. "Europe/Paris"; empty means UTC
+	CalendarToken   *string        `gorm:"uniqueIndex" json:"-"`                        // secret for the calendar feed URL; nil when not enabled
+	SessionsResetAt *time.Time     `json:"-"`                                           // tokens issued before this are rejected
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+	DeletedAt       gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
 type Chat struct {
-	ID        uint           `gorm:"primaryKey" json:"id"`
-	Type      string         `gorm:"not null" json:"type"` // private or group
-	User1ID   *uint          `json:"user1_id"`
-	User2ID   *uint          `json:"user2_id"`
-	GroupID   *uint          `json:"group_id"`
-	LastMessage *Message     `gorm:"foreignKey:LastMessageID" json:"last_message,omitempty"`
-	LastMessageID *uint      `json:"-"`
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
-	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	ID            uint           `gorm:"primaryKey" json:"id"`
+	Type          string         `gorm:"not null" json:"type"` // private or group
+	User1ID       *uint          `json:"user1_id"`
+	User2ID       *uint          `json:"user2_id"`
+	GroupID       *uint          `json:"group_id"`
+	LastMessage   *Message       `gorm:"foreignKey:LastMessageID" json:"last_message,omitempty"`
+	LastMessageID *uint          `json:"-"`
+	PinPosition   *int           `gorm:"-" json:"pin_position,omitempty"` // per-user, filled by GetUserChats
+	UnreadCount   int64          `gorm:"-" json:"unread_count"`           // per-user, filled by GetUserChats
+	Draft         string         `gorm:"-" json:"draft,omitempty"`        // per-user, filled by GetUserChats
+	CreatedAt     time.Time      `json:"created_at"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+	DeletedAt     gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
 type Message struct {
-	ID        uint           `gorm:"primaryKey" json:"id"`
-	ChatID    uint           `gorm:"not null;index" json:"chat_id"`
-	SenderID  uint           `gorm:"not null" json:"sender_id"`
-	Sender    *User          `gorm:"foreignKey:SenderID" json:"sender,omitempty"`
-	Type      string         `gorm:"not null" json:"type"` // text, image, video, audio, document
-	Content   string         `json:"content"`
-	MediaURL  string         `json:"media_url"`
-	Status    string         `gorm:"default:'sent'" json:"status"` // sent, delivered, read
-	ReplyToID *uint          `json:"reply_to_id"`
-	CreatedAt time.Time      `json:"created_at"`
-	UpdatedAt time.Time      `json:"updated_at"`
-	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
+	ID            uint             `gorm:"primaryKey" json:"id"`
+	ChatID        uint             `gorm:"not null;index" json:"chat_id"`
+	SenderID      uint             `gorm:"not null" json:"sender_id"`
+	Sender        *User            `gorm:"foreignKey:SenderID" json:"sender,omitempty"`
+	SenderNick    string           `gorm:"-" json:"sender_nickname,omitempty"` // sender's nickname in the group, if set
+	Type          string           `gorm:"not null" json:"type"`               // text, image, video, audio, document, event, location, contact, system
+	Content       string           `json:"content"`
+	MediaURL      string           `json:"media_url"`
+	MediaID       *uint            `json:"media_id,omitempty"`           // upload behind MediaURL, for fetching a signed link
+	ThumbnailURL  string           `json:"thumbnail_url,omitempty"`      // small preview for image and video messages
+	Status        string           `gorm:"default:'sent'" json:"status"` // sent, delivered, read
+	ReplyToID     *uint            `json:"reply_to_id"`
+	ThreadRootID  *uint            `gorm:"index" json:"thread_root_id"`
+	EventID       *uint            `json:"event_id,omitempty"` // set for event messages
+	Event         *Event           `gorm:"foreignKey:EventID" json:"event,omitempty"`
+	Latitude      *float64         `json:"latitude,omitempty"` // set for location messages
+	Longitude     *float64         `json:"longitude,omitempty"`
+	LocationLabel string           `json:"location_label,omitempty"`
+	ContactName   string           `json:"contact_name,omitempty"` // set for contact messages
+	ContactPhone  string           `json:"contact_phone,omitempty"`
+	ContactUserID *uint            `json:"contact_user_id,omitempty"` // the contact's account, if they're registered
+	ReplyCount    int              `gorm:"default:0" json:"reply_count"`
+	LastReplyAt   *time.Time       `json:"last_reply_at,omitempty"`
+	IsPinned      bool             `gorm:"default:false" json:"is_pinned"`
+	PinnedAt      *time.Time       `json:"pinned_at,omitempty"`
+	PinnedByID    *uint            `json:"pinned_by_id,omitempty"`
+	PinnedBy      *User            `gorm:"foreignKey:PinnedByID" json:"pinned_by,omitempty"`
+	EditedAt      *time.Time       `json:"edited_at,omitempty"`
+	Deleted       bool             `gorm:"default:false" json:"deleted"` // deleted for everyone; content is a placeholder
+	Reactions     []ReactionCount  `gorm:"-" json:"reactions,omitempty"`
+	Mentions      []MessageMention `gorm:"foreignKey:MessageID" json:"mentions,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	UpdatedAt     time.Time        `json:"updated_at"`
+	DeletedAt     gorm.DeletedAt   `gorm:"index" json:"-"`
 }
 
 type Group struct {
-	ID          uint           `gorm:"primaryKey" json:"id"`
-	Name        string         `gorm:"not null" json:"name"`
-	Icon        string         `json:"icon"`
-	Description string         `json:"description"`
-	CreatedByID uint           `gorm:"not null" json:"created_by_id"`
-	CreatedBy   *User          `gorm:"foreignKey:CreatedByID" json:"created_by,omitempty"`
-	Members     []GroupMember  `gorm:"foreignKey:GroupID" json:"members,omitempty"`
-	CreatedAt   time.Time      `json:"created_at"`
-	UpdatedAt   time.Time      `json:"updated_at"`
-	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+	ID               uint           `gorm:"primaryKey" json:"id"`
+	Name             string         `gorm:"not null" json:"name"`
+	Icon             string         `json:"icon"`
+	Description      string         `json:"description"`
+	CreatedByID      uint           `gorm:"not null" json:"created_by_id"`
+	CreatedBy        *User          `gorm:"foreignKey:CreatedByID" json:"created_by,omitempty"`
+	MaxMessageLength int            `gorm:"default:0" json:"max_message_length"`  // overrides the global limit when > 0
+	AnnounceOnly     bool           `gorm:"default:false" json:"announce_only"`   // only admins can post
+	SlowModeSeconds  int            `gorm:"default:0" json:"slow_mode_seconds"`   // minimum gap between a member's messages
+	DefaultRole      string         `gorm:"default:'member'" json:"default_role"` // role given to newly added members: member or restricted
+	Members          []GroupMember  `gorm:"foreignKey:GroupID" json:"members,omitempty"`
+	CreatedAt        time.Time      `json:"created_at"`
+	UpdatedAt        time.Time      `json:"updated_at"`
+	DeletedAt        gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
 type GroupMember struct {
@@ -66,11 +102,25 @@ type GroupMember struct {
 	GroupID   uint           `gorm:"not null;index" json:"group_id"`
 	UserID    uint           `gorm:"not null;index" json:"user_id"`
 	User      *User          `gorm:"foreignKey:UserID" json:"user,omitempty"`
-	Role      string         `gorm:"default:'member'" json:"role"` // admin, member
+	Role      string         `gorm:"default:'member'" json:"role"` // admin, member, restricted (read-only)
+	Nickname  string         `json:"nickname"`                     // per-group display name, empty for the username
 	JoinedAt  time.Time      `json:"joined_at"`
 	DeletedAt gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
+// GroupInvite is a shareable link token that lets anyone holding it join the
+// group, until it expires or runs out of uses.
+type GroupInvite struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	GroupID     uint      `gorm:"not null;index" json:"group_id"`
+	Token       string    `gorm:"not null;uniqueIndex" json:"token"`
+	CreatedByID uint      `gorm:"not null" json:"created_by_id"`
+	MaxUses     int       `gorm:"default:0" json:"max_uses"` // 0 means unlimited
+	Uses        int       `gorm:"default:0" json:"uses"`
+	ExpiresAt   time.Time `gorm:"not null" json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
 type Event struct {
 	ID              uint           `gorm:"primaryKey" json:"id"`
 	UserID          uint           `gorm:"not null;index" json:"user_id"`
@@ -79,27 +129,206 @@ type Event struct {
 	EventDate       time.Time      `json:"event_date"`
 	Location        string         `json:"location"`
 	SourceMessageID *uint          `json:"source_message_id"`
+	RecurrenceRule  string         `json:"recurrence_rule,omitempty"`         // daily, weekly, monthly or an RRULE subset; empty for one-off events
+	Timezone        string         `json:"timezone,omitempty"`                // IANA zone recurrences keep their local time in; empty means UTC
+	ReminderMinutes int            `gorm:"default:0" json:"reminder_minutes"` // lead time for the reminder; 0 means none
+	NotifiedFor     *time.Time     `json:"notified_for,omitempty"`            // start of the last occurrence reminded about
 	CreatedAt       time.Time      `json:"created_at"`
 	UpdatedAt       time.Time      `json:"updated_at"`
 	DeletedAt       gorm.DeletedAt `gorm:"index" json:"-"`
+
+	Exceptions []EventException `gorm:"foreignKey:EventID" json:"-"` // cancelled occurrences of a recurring event
+}
+
+// EventException cancels one occurrence of a recurring event, identified by
+// the time it would have started.
+type EventException struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	EventID        uint      `gorm:"not null;uniqueIndex:idx_event_exception" json:"event_id"`
+	OccurrenceDate time.Time `gorm:"not null;uniqueIndex:idx_event_exception" json:"occurrence_date"`
+	CreatedAt      time.Time `json:"created_at"`
 }
 
 type Media struct {
-	ID          uint           `gorm:"primaryKey" json:"id"`
-	UserID      uint           `gorm:"not null;index" json:"user_id"`
-	Type        string         `gorm:"not null" json:"type"` // image, video, audio, document
-	URL         string         `gorm:"not null" json:"url"`
-	PublicID    string         `json:"public_id"`
-	Size        int64          `json:"size"`
-	ExpiresAt   time.Time      `json:"expires_at"`
-	CreatedAt   time.Time      `json:"created_at"`
-	DeletedAt   gorm.DeletedAt `gorm:"index" json:"-"`
+	ID           uint           `gorm:"primaryKey" json:"id"`
+	UserID       uint           `gorm:"not null;index" json:"user_id"`
+	Type         string         `gorm:"not null" json:"type"` // image, video, audio, document
+	URL          string         `gorm:"not null" json:"url"`
+	ThumbnailURL string         `json:"thumbnail_url,omitempty"` // small preview for images and videos
+	PublicID     string         `json:"public_id"`
+	Size         int64          `json:"size"`
+	ExpiresAt    time.Time      `json:"expires_at"`
+	CreatedAt    time.Time      `json:"created_at"`
+	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
+// MessageStatus is how far a message has got with one recipient. Each
+// recipient has at most one row per message, which only moves forward from
+// delivered to read.
 type MessageStatus struct {
 	ID        uint      `gorm:"primaryKey" json:"id"`
-	MessageID uint      `gorm:"not null;index" json:"message_id"`
-	UserID    uint      `gorm:"not null;index" json:"user_id"`
+	MessageID uint      `gorm:"not null;uniqueIndex:idx_message_status_message_user" json:"message_id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_message_status_message_user;index" json:"user_id"`
 	Status    string    `gorm:"not null" json:"status"` // delivered, read
 	Timestamp time.Time `json:"timestamp"`
 }
+
+// MessageReaction is one user's emoji reaction to a message. A user can add
+// several different emoji to the same message, but each only once.
+type MessageReaction struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	MessageID uint      `gorm:"not null;uniqueIndex:idx_message_reaction" json:"message_id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_message_reaction" json:"user_id"`
+	Emoji     string    `gorm:"not null;size:32;uniqueIndex:idx_message_reaction" json:"emoji"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MessageHide removes a message from one user's view of its chat, when
+// they delete it only for themselves.
+type MessageHide struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_message_hide_user_message" json:"user_id"`
+	MessageID uint      `gorm:"not null;uniqueIndex:idx_message_hide_user_message" json:"message_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// MessageMention records that a group message @mentioned a member.
+// Username is the name as written in the message, so clients can highlight
+// it even after the user renames themselves.
+type MessageMention struct {
+	ID        uint      `gorm:"primaryKey" json:"-"`
+	MessageID uint      `gorm:"not null;uniqueIndex:idx_message_mention" json:"message_id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_message_mention;index" json:"user_id"`
+	Username  string    `gorm:"not null" json:"username"`
+	CreatedAt time.Time `json:"-"`
+}
+
+// ReactionCount is the number of users who reacted to a message with an emoji.
+type ReactionCount struct {
+	Emoji string `json:"emoji"`
+	Count int64  `json:"count"`
+}
+
+type ChatSnooze struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_chat_snooze_user_chat" json:"user_id"`
+	ChatID    uint      `gorm:"not null;uniqueIndex:idx_chat_snooze_user_chat" json:"chat_id"`
+	RemindAt  time.Time `gorm:"not null;index" json:"remind_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ChatMute silences push notifications for a chat until MutedUntil, or
+// until the user unmutes it when MutedUntil is nil. Messages and unread
+// counts are unaffected.
+type ChatMute struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	UserID     uint       `gorm:"not null;uniqueIndex:idx_chat_mute_user_chat" json:"user_id"`
+	ChatID     uint       `gorm:"not null;uniqueIndex:idx_chat_mute_user_chat" json:"chat_id"`
+	MutedUntil *time.Time `json:"muted_until"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// ChatArchive hides a chat from the user's main chat list until they
+// unarchive it or a new message arrives in it.
+type ChatArchive struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_chat_archive_user_chat" json:"user_id"`
+	ChatID    uint      `gorm:"not null;uniqueIndex:idx_chat_archive_user_chat;index" json:"chat_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ChatDraft is the unsent text a user left in a chat's input, kept so it
+// follows them across devices.
+type ChatDraft struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_chat_draft_user_chat" json:"user_id"`
+	ChatID    uint      `gorm:"not null;uniqueIndex:idx_chat_draft_user_chat" json:"chat_id"`
+	Content   string    `gorm:"type:text;not null" json:"content"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type ChatPin struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_chat_pin_user_chat" json:"user_id"`
+	ChatID    uint      `gorm:"not null;uniqueIndex:idx_chat_pin_user_chat" json:"chat_id"`
+	Position  int       `gorm:"not null" json:"position"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ChatNotificationSetting holds a user's notification preferences for one
+// chat, stored server-side so they sync across devices.
+type ChatNotificationSetting struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	UserID     uint      `gorm:"not null;uniqueIndex:idx_chat_notification_user_chat" json:"user_id"`
+	ChatID     uint      `gorm:"not null;uniqueIndex:idx_chat_notification_user_chat" json:"chat_id"`
+	Sound      string    `json:"sound"`       // client sound identifier, empty for the default
+	CustomName string    `json:"custom_name"` // label shown in place of the chat name
+	Muted      bool      `gorm:"default:false" json:"muted"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// BlockedUser records that UserID has blocked BlockedID. Blocks stop private
+// messages in both directions and hide the blocker's presence.
+type BlockedUser struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	UserID    uint      `gorm:"not null;uniqueIndex:idx_blocked_user_pair" json:"user_id"`
+	BlockedID uint      `gorm:"not null;uniqueIndex:idx_blocked_user_pair;index" json:"blocked_id"`
+	Blocked   *User     `gorm:"foreignKey:BlockedID" json:"blocked,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AIConversation is a user's multi-turn research session. Earlier turns are
+// sent back to the model so follow-up questions have context.
+type AIConversation struct {
+	ID        uint                    `gorm:"primaryKey" json:"id"`
+	UserID    uint                    `gorm:"not null;index" json:"user_id"`
+	Title     string                  `json:"title"` // start of the first query
+	Messages  []AIConversationMessage `gorm:"foreignKey:ConversationID" json:"messages,omitempty"`
+	CreatedAt time.Time               `json:"created_at"`
+	UpdatedAt time.Time               `json:"updated_at"`
+}
+
+type AIConversationMessage struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	ConversationID uint      `gorm:"not null;index" json:"conversation_id"`
+	Role           string    `gorm:"not null" json:"role"` // user or model
+	Content        string    `gorm:"not null" json:"content"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+// RevokedToken records a JWT that was logged out before it expired. Only a
+// hash of the token is stored; rows can be dropped once ExpiresAt passes.
+type RevokedToken struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	TokenHash string    `gorm:"not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// RevokedSession records a login session that was logged out, rejecting
+// every access and refresh token issued for it. Rows can be dropped once
+// ExpiresAt passes, when no token from the session is valid anyway.
+type RevokedSession struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	SessionID string    `gorm:"not null;uniqueIndex" json:"-"`
+	ExpiresAt time.Time `gorm:"not null;index" json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Report is a user's moderation report on a message. The message content is
+// copied in so admins can review it even if the sender deletes it.
+type Report struct {
+	ID              uint      `gorm:"primaryKey" json:"id"`
+	ReporterID      uint      `gorm:"not null;index" json:"reporter_id"`
+	Reporter        *User     `gorm:"foreignKey:ReporterID" json:"reporter,omitempty"`
+	MessageID       uint      `gorm:"not null;index" json:"message_id"`
+	ChatID          uint      `gorm:"not null" json:"chat_id"`
+	SenderID        uint      `gorm:"not null" json:"sender_id"`
+	MessageType     string    `json:"message_type"`
+	ContentSnapshot string    `json:"content_snapshot"`
+	MediaSnapshot   string    `json:"media_snapshot"`
+	MessageSentAt   time.Time `json:"message_sent_at"`
+	Notes           string    `json:"notes"`
+	Status          string    `gorm:"default:'open'" json:"status"` // open, resolved
+	CreatedAt       time.Time `json:"created_at"`
+}
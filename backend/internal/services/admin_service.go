@@ -0,0 +1,221 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"gorm.io/gorm"
+	"onechat/internal/models"
+)
+
+type AdminService struct {
+	db          *gorm.DB
+	chatService *ChatService
+}
+
+func NewAdminService(db *gorm.DB, chatService *ChatService) *AdminService {
+	return &AdminService{
+		db:          db,
+		chatService: chatService,
+	}
+}
+
+func (s *AdminService) IsAdmin(userID uint) bool {
+	var user models.User
+	if err := s.db.Select("is_admin").First(&user, userID).Error; err != nil {
+		return false
+	}
+	return user.IsAdmin
+}
+
+// BroadcastSystemMessage posts a system message into each of the given chats
+// on behalf of the admin and returns the created messages.
+func (s *AdminService) BroadcastSystemMessage(adminID uint, content string, chatIDs []uint) ([]models.Message, error) {
+	if content == "" {
+		return nil, errors.New("content is required")
+	}
+
+	messages := make([]models.Message, 0, len(chatIDs))
+	for _, chatID := range chatIDs {
+		var chat models.Chat
+		if err := s.db.First(&chat, chatID).Error; err != nil {
+			return messages, err
+		}
+
+		message, err := s.chatService.CreateMessage(chatID, adminID, "system", content, "", nil, nil, nil, nil, nil)
+		if err != nil {
+			return messages, err
+		}
+		messages = append(messages, *message)
+	}
+
+	return messages, nil
+}
+
+// AdminUser is a user as platform admins see them, including the presence
+// fields other users only get through the presence endpoint.
+type AdminUser struct {
+	models.User
+	IsOnline bool       `json:"is_online"`
+	LastSeen *time.Time `json:"last_seen"`
+}
+
+// AdminListUsers pages through all users. sortBy is created_at or last_seen
+// (newest first); online, when non-nil, filters on presence.
+func (s *AdminService) AdminListUsers(limit, offset int, sortBy string, online *bool) ([]AdminUser, int64, error) {
+	query := s.db.Model(&models.User{})
+	if online != nil {
+		query = query.Where("is_online = ?", *online)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	order := "created_at DESC"
+	if sortBy == "last_seen" {
+		order = "last_seen DESC NULLS LAST"
+	}
+
+	var users []models.User
+	if err := query.Order(order).
+		Limit(limit).
+		Offset(offset).
+		Find(&users).Error; err != nil {
+		return nil, 0, err
+	}
+
+	result := make([]AdminUser, len(users))
+	for i, user := range users {
+		result[i] = AdminUser{User: user, IsOnline: user.IsOnline, LastSeen: user.LastSeen}
+	}
+	return result, total, nil
+}
+
+// MergedChat describes one set of duplicate private chats folded into a
+// single canonical chat.
+type MergedChat struct {
+	CanonicalID   uint   `json:"canonical_id"`
+	MergedIDs     []uint `json:"merged_ids"`
+	MessagesMoved int64  `json:"messages_moved"`
+}
+
+// MergeDuplicatePrivateChats finds user pairs with more than one private chat
+// and keeps the oldest chat for each. Messages, reports and each user's pins,
+// snoozes, mutes, notification settings, archives and drafts are moved onto
+// it and the extra chats are soft-deleted.
+func (s *AdminService) MergeDuplicatePrivateChats() ([]MergedChat, error) {
+	type userPair struct {
+		UserA uint
+		UserB uint
+	}
+
+	var pairs []userPair
+	err := s.db.Model(&models.Chat{}).
+		Select("LEAST(user1_id, user2_id) AS user_a, GREATEST(user1_id, user2_id) AS user_b").
+		Where("type = ?", "private").
+		Group("user_a, user_b").
+		Having("COUNT(*) > 1").
+		Scan(&pairs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]MergedChat, 0, len(pairs))
+	for _, pair := range pairs {
+		var result MergedChat
+		err := s.db.Transaction(func(tx *gorm.DB) error {
+			var chats []models.Chat
+			err := tx.Where(
+				"type = ? AND ((user1_id = ? AND user2_id = ?) OR (user1_id = ? AND user2_id = ?))",
+				"private", pair.UserA, pair.UserB, pair.UserB, pair.UserA,
+			).Order("id ASC").Find(&chats).Error
+			if err != nil {
+				return err
+			}
+			if len(chats) < 2 {
+				return nil
+			}
+
+			canonical := chats[0]
+			result.CanonicalID = canonical.ID
+			for _, dup := range chats[1:] {
+				moved := tx.Model(&models.Message{}).
+					Where("chat_id = ?", dup.ID).
+					Update("chat_id", canonical.ID)
+				if moved.Error != nil {
+					return moved.Error
+				}
+				result.MessagesMoved += moved.RowsAffected
+
+				// Per-user chat state is unique per user and chat, so drop the
+				// duplicate's rows where the user already has one on the
+				// canonical chat before moving the rest.
+				for _, rows := range userChatTables {
+					if err := mergeUserChatRows(tx, rows.model, rows.table, dup.ID, canonical.ID); err != nil {
+						return err
+					}
+				}
+
+				if err := tx.Model(&models.Report{}).
+					Where("chat_id = ?", dup.ID).
+					Update("chat_id", canonical.ID).Error; err != nil {
+					return err
+				}
+
+				if err := tx.Delete(&models.Chat{}, dup.ID).Error; err != nil {
+					return err
+				}
+				result.MergedIDs = append(result.MergedIDs, dup.ID)
+			}
+
+			var last models.Message
+			err = tx.Where("chat_id = ? AND thread_root_id IS NULL", canonical.ID).
+				Order("created_at DESC").
+				First(&last).Error
+			if err == gorm.ErrRecordNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			return tx.Model(&models.Chat{}).Where("id = ?", canonical.ID).Updates(map[string]interface{}{
+				"last_message_id": last.ID,
+				"updated_at":      last.CreatedAt,
+			}).Error
+		})
+		if err != nil {
+			return results, err
+		}
+		if len(result.MergedIDs) > 0 {
+			results = append(results, result)
+		}
+	}
+
+	return results, nil
+}
+
+// userChatTables hold per-user state for a chat, one row per user and chat.
+var userChatTables = []struct {
+	model interface{}
+	table string
+}{
+	{&models.ChatPin{}, "chat_pins"},
+	{&models.ChatSnooze{}, "chat_snoozes"},
+	{&models.ChatMute{}, "chat_mutes"},
+	{&models.ChatNotificationSetting{}, "chat_notification_settings"},
+	{&models.ChatArchive{}, "chat_archives"},
+	{&models.ChatDraft{}, "chat_drafts"},
+}
+
+func mergeUserChatRows(tx *gorm.DB, model interface{}, table string, fromChatID, toChatID uint) error {
+	err := tx.Where(
+		"chat_id = ? AND user_id IN (?)",
+		fromChatID, tx.Table(table).Select("user_id").Where("chat_id = ?", toChatID),
+	).Delete(model).Error
+	if err != nil {
+		return err
+	}
+	return tx.Model(model).Where("chat_id = ?", fromChatID).Update("chat_id", toChatID).Error
+}
@@ -1,26 +1,51 @@
 package services
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings" // Added strings package
 	"time"
+
+	"gorm.io/gorm"
+	"onechat/internal/models"
 )
 
 type AIService struct {
-	apiKey string
-	client *http.Client
+	db                 *gorm.DB
+	apiKey             string
+	model              string
+	systemPrompt       string
+	client             *http.Client
+	streamClient       *http.Client
+	maxAttempts        int
+	confirmationCutoff float64
 }
 
+const (
+	// requestTimeout bounds a Gemini call, including any retries
+	requestTimeout = 30 * time.Second
+	// initialRetryBackoff is the wait before the first retry; it doubles after
+	// each further attempt
+	initialRetryBackoff = 500 * time.Millisecond
+)
+
+// streamTimeout bounds a streamed research answer, which can take longer
+// than a single response.
+const streamTimeout = 2 * time.Minute
+
 type GeminiRequest struct {
 	Contents []GeminiContent `json:"contents"`
 }
 
 type GeminiContent struct {
+	Role  string       `json:"role,omitempty"` // user or model; needed for multi-turn requests
 	Parts []GeminiPart `json:"parts"`
 }
 
@@ -37,52 +62,446 @@ type GeminiCandidate struct {
 }
 
 type EventExtraction struct {
-	Title       string `json:"title"`
-	Date        string `json:"date"`
-	Time        string `json:"time"`
-	Location    string `json:"location"`
-	Description string `json:"description"`
+	Title       string  `json:"title"`
+	Date        string  `json:"date"`
+	Time        string  `json:"time"`
+	Location    string  `json:"location"`
+	Description string  `json:"description"`
+	Confidence  float64 `json:"confidence"` // 0-1, as reported by the model
+	// NeedsConfirmation is set when Confidence is below the configured cutoff,
+	// so clients should ask the user before saving the event
+	NeedsConfirmation bool `json:"needs_confirmation"`
 }
 
-func NewAIService(apiKey string) *AIService {
+// NewAIService creates the Gemini client. maxAttempts is how many times a
+// request is tried in total when Gemini fails transiently.
+func NewAIService(db *gorm.DB, apiKey, model, systemPrompt string, maxAttempts int, confirmationCutoff float64) *AIService {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
 	return &AIService{
-		apiKey: apiKey,
+		db:           db,
+		apiKey:       apiKey,
+		model:        model,
+		systemPrompt: systemPrompt,
 		client: &http.Client{
-			Timeout: 30 * time.Second,
+			Timeout: requestTimeout,
 		},
+		streamClient:       &http.Client{},
+		maxAttempts:        maxAttempts,
+		confirmationCutoff: confirmationCutoff,
 	}
 }
 
-func (s *AIService) Research(query string) (string, error) {
+// Configured reports whether a Gemini API key is set.
+func (s *AIService) Configured() bool {
+	return s.apiKey != ""
+}
+
+// maxAIHistoryMessages caps how many earlier turns of a conversation are sent
+// with a new query, to keep token usage bounded.
+const maxAIHistoryMessages = 20
+
+// Research answers a query within one of the user's conversations, sending
+// its recent turns as context, and records the exchange. conversationID 0
+// starts a new conversation. Nothing is stored if Gemini fails.
+func (s *AIService) Research(userID, conversationID uint, query string) (*models.AIConversation, string, error) {
+	if s.apiKey == "" {
+		return nil, "", errors.New("Gemini API key not configured")
+	}
+
+	conversation, contents, err := s.startTurn(userID, conversationID, query)
+	if err != nil {
+		return nil, "", err
+	}
+
+	response, err := s.callGeminiContents(contents)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if err := s.saveTurn(conversation, query, response); err != nil {
+		return nil, "", err
+	}
+
+	return conversation, response, nil
+}
+
+// startTurn loads the user's conversation, or makes a new unsaved one when
+// conversationID is 0, and builds the contents to send Gemini for the
+// query: its recent turns followed by the query.
+func (s *AIService) startTurn(userID, conversationID uint, query string) (*models.AIConversation, []GeminiContent, error) {
+	conversation := &models.AIConversation{UserID: userID, Title: conversationTitle(query)}
+	var history []models.AIConversationMessage
+	if conversationID != 0 {
+		if err := s.db.Where("id = ? AND user_id = ?", conversationID, userID).First(conversation).Error; err != nil {
+			return nil, nil, err
+		}
+
+		s.db.Where("conversation_id = ?", conversationID).
+			Order("created_at DESC, id DESC").
+			Limit(maxAIHistoryMessages).
+			Find(&history)
+		// Oldest first, and starting on a user turn as Gemini expects
+		for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+			history[i], history[j] = history[j], history[i]
+		}
+		for len(history) > 0 && history[0].Role != "user" {
+			history = history[1:]
+		}
+	}
+
+	contents := make([]GeminiContent, 0, len(history)+1)
+	for _, m := range history {
+		contents = append(contents, GeminiContent{Role: m.Role, Parts: []GeminiPart{{Text: m.Content}}})
+	}
+	contents = append(contents, GeminiContent{Role: "user", Parts: []GeminiPart{{Text: query}}})
+	// The system prompt leads the oldest turn sent
+	contents[0].Parts[0].Text = s.researchPrompt(contents[0].Parts[0].Text)
+	return conversation, contents, nil
+}
+
+// saveTurn records a query and its answer in the conversation, creating
+// the conversation if it's new.
+func (s *AIService) saveTurn(conversation *models.AIConversation, query, response string) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if conversation.ID == 0 {
+			if err := tx.Create(conversation).Error; err != nil {
+				return err
+			}
+		} else if err := tx.Model(conversation).Update("updated_at", time.Now()).Error; err != nil {
+			return err
+		}
+
+		return tx.Create(&[]models.AIConversationMessage{
+			{ConversationID: conversation.ID, Role: "user", Content: query},
+			{ConversationID: conversation.ID, Role: "model", Content: response},
+		}).Error
+	})
+}
+
+// GetConversations returns the user's conversations, most recently active
+// first, without their messages.
+func (s *AIService) GetConversations(userID uint, limit, offset int) ([]models.AIConversation, error) {
+	conversations := []models.AIConversation{}
+	err := s.db.Where("user_id = ?", userID).
+		Order("updated_at DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&conversations).Error
+	return conversations, err
+}
+
+// GetConversation returns one of the user's conversations with every turn.
+func (s *AIService) GetConversation(userID, conversationID uint) (*models.AIConversation, error) {
+	var conversation models.AIConversation
+	err := s.db.Preload("Messages", func(db *gorm.DB) *gorm.DB {
+		return db.Order("created_at ASC, id ASC")
+	}).Where("id = ? AND user_id = ?", conversationID, userID).First(&conversation).Error
+	if err != nil {
+		return nil, err
+	}
+	return &conversation, nil
+}
+
+// DeleteConversation removes one of the user's conversations and its turns.
+func (s *AIService) DeleteConversation(userID, conversationID uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("id = ? AND user_id = ?", conversationID, userID).Delete(&models.AIConversation{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return tx.Where("conversation_id = ?", conversationID).Delete(&models.AIConversationMessage{}).Error
+	})
+}
+
+// ClearConversations removes all of the user's conversations.
+func (s *AIService) ClearConversations(userID uint) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		ids := tx.Model(&models.AIConversation{}).Select("id").Where("user_id = ?", userID)
+		if err := tx.Where("conversation_id IN (?)", ids).Delete(&models.AIConversationMessage{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", userID).Delete(&models.AIConversation{}).Error
+	})
+}
+
+func conversationTitle(query string) string {
+	const maxTitle = 60
+	title := strings.TrimSpace(query)
+	if runes := []rune(title); len(runes) > maxTitle {
+		title = string(runes[:maxTitle]) + "…"
+	}
+	return title
+}
+
+// ResearchStream answers a research query like Research, sending the answer
+// to out in chunks as Gemini produces them. It closes out when it returns.
+// The exchange is recorded in the conversation once the whole answer has
+// arrived; nothing is stored if the stream fails or is cut short.
+// Cancelling ctx stops the request, e.g. when the client disconnects.
+func (s *AIService) ResearchStream(ctx context.Context, userID, conversationID uint, query string, out chan<- string) (*models.AIConversation, error) {
+	defer close(out)
+
+	if s.apiKey == "" {
+		return nil, errors.New("Gemini API key not configured")
+	}
+
+	conversation, contents, err := s.startTurn(userID, conversationID, query)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := s.streamGemini(ctx, contents, out)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.saveTurn(conversation, query, response); err != nil {
+		return nil, err
+	}
+	return conversation, nil
+}
+
+// streamGemini sends contents to Gemini's streaming endpoint, passing each
+// piece of the answer to out, and returns the whole answer.
+func (s *AIService) streamGemini(ctx context.Context, contents []GeminiContent, out chan<- string) (string, error) {
+	jsonData, err := json.Marshal(GeminiRequest{Contents: contents})
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, streamTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.endpoint("streamGenerateContent")+"&alt=sse", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	// The client's 30 second timeout would cut long answers off mid-stream;
+	// the context bounds the request instead
+	resp, err := s.streamClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", s.apiError(resp)
+	}
+
+	// Each SSE data line carries a partial GeminiResponse
+	var response strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+
+		var chunk GeminiResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return "", fmt.Errorf("failed to parse Gemini stream: %w", err)
+		}
+		if len(chunk.Candidates) == 0 {
+			continue
+		}
+
+		for _, part := range chunk.Candidates[0].Content.Parts {
+			if part.Text == "" {
+				continue
+			}
+			response.WriteString(part.Text)
+			select {
+			case out <- part.Text:
+			case <-ctx.Done():
+				return "", ctx.Err()
+			}
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return response.String(), nil
+}
+
+const (
+	// maxSummaryInputChars keeps a summary prompt well inside the model's
+	// context window; older messages beyond it are left out
+	maxSummaryInputChars = 60000
+	// maxSummaryMessageChars shortens any single long message in a summary
+	// prompt so one wall of text can't crowd out the rest
+	maxSummaryMessageChars = 1000
+)
+
+// SummarizeMessages asks Gemini for a short summary of a conversation.
+// messages are oldest first; when they don't all fit in the prompt the most
+// recent ones are kept. It returns an empty summary, without calling Gemini,
+// when there is nothing to summarize.
+func (s *AIService) SummarizeMessages(messages []models.Message) (string, error) {
 	if s.apiKey == "" {
 		return "", errors.New("Gemini API key not configured")
 	}
 
-	prompt := fmt.Sprintf(`You are a helpful AI assistant in a chat application. 
-Please provide a clear, concise, and informative response to the following query:
+	// Walk back from the newest message until the budget is spent
+	var lines []string
+	size := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		line := transcriptLine(messages[i])
+		if line == "" {
+			continue
+		}
+		if size+len(line) > maxSummaryInputChars {
+			break
+		}
+		lines = append(lines, line)
+		size += len(line) + 1
+	}
+	if len(lines) == 0 {
+		return "", nil
+	}
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
 
-%s
+	prompt := fmt.Sprintf(`Summarize the following chat conversation for someone catching up on it.
+Keep it concise: a few short bullet points covering the main topics, decisions and any open questions or plans. Refer to people by name. Don't add anything that isn't in the conversation.
 
-Format your response in a way that's easy to read and understand.`, query)
+Conversation:
+%s`, strings.Join(lines, "\n"))
 
 	return s.callGemini(prompt)
 }
 
-func (s *AIService) ExtractEvent(messageText string) (*EventExtraction, error) {
+// transcriptLine formats a message as "[time] sender: content" for a prompt,
+// or returns "" for messages with nothing worth summarizing.
+func transcriptLine(m models.Message) string {
+	if m.Type == "system" || m.Deleted {
+		return ""
+	}
+
+	sender := m.SenderNick
+	if sender == "" && m.Sender != nil {
+		sender = m.Sender.Username
+	}
+	if sender == "" {
+		sender = fmt.Sprintf("user %d", m.SenderID)
+	}
+
+	content := strings.TrimSpace(m.Content)
+	if m.Type == "location" && content == "" {
+		content = m.LocationLabel
+	}
+	if m.Type == "contact" && content == "" {
+		content = m.ContactName
+	}
+	if m.Type != "text" && m.Type != "" {
+		content = strings.TrimSpace(fmt.Sprintf("[%s] %s", m.Type, content))
+	}
+	if content == "" || content == DeletedMessageContent {
+		return ""
+	}
+	if runes := []rune(content); len(runes) > maxSummaryMessageChars {
+		content = string(runes[:maxSummaryMessageChars]) + "…"
+	}
+	content = strings.ReplaceAll(content, "\n", " ")
+
+	return fmt.Sprintf("[%s] %s: %s", m.CreatedAt.UTC().Format("2006-01-02 15:04"), sender, content)
+}
+
+// Translate translates text into targetLang, a language name or code such
+// as "es" or "Japanese". Text that is already in the target language is
+// returned unchanged.
+func (s *AIService) Translate(text, targetLang string) (string, error) {
+	if s.apiKey == "" {
+		return "", errors.New("Gemini API key not configured")
+	}
+
+	prompt := fmt.Sprintf(`Translate the text below into the language %q and return ONLY a valid JSON object with these fields:
+- already_in_target: true if the text is already written in that language, otherwise false
+- translation: the translated text, keeping its meaning, tone, emoji and formatting; empty if already_in_target is true
+
+Text:
+%s
+
+Return ONLY the JSON object.`, targetLang, text)
+
+	response, err := s.callGemini(prompt)
+	if err != nil {
+		return "", err
+	}
+
+	var result struct {
+		AlreadyInTarget bool   `json:"already_in_target"`
+		Translation     string `json:"translation"`
+	}
+	if err := json.Unmarshal([]byte(cleanJSONResponse(response)), &result); err != nil {
+		return "", fmt.Errorf("failed to parse translation: %w", err)
+	}
+
+	if result.AlreadyInTarget || strings.TrimSpace(result.Translation) == "" {
+		return text, nil
+	}
+	return result.Translation, nil
+}
+
+// researchPrompt puts the operator-configured system prompt, which sets the
+// assistant's persona and guardrails, ahead of the user's query.
+func (s *AIService) researchPrompt(query string) string {
+	return fmt.Sprintf(`%s
+
+Respond to the following query:
+
+%s`, s.systemPrompt, query)
+}
+
+// endpoint returns the URL of a method on the configured Gemini model.
+func (s *AIService) endpoint(method string) string {
+	return fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/%s:%s?key=%s",
+		url.PathEscape(s.model), method, url.QueryEscape(s.apiKey))
+}
+
+// apiError turns a failed Gemini response into an error. A 404 almost always
+// means the model name is wrong or retired, so it says which setting to fix.
+func (s *AIService) apiError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("Gemini model %q was not found or doesn't support this request; update GEMINI_MODEL", s.model)
+	}
+	return fmt.Errorf("Gemini API error: %s", string(body))
+}
+
+// ExtractEvent pulls event details out of a message. Relative dates and
+// times such as "3pm tomorrow" are resolved in the user's timezone, and the
+// extracted date and time are local to it.
+func (s *AIService) ExtractEvent(userID uint, messageText string) (*EventExtraction, error) {
 	if s.apiKey == "" {
 		return nil, errors.New("Gemini API key not configured")
 	}
 
-	prompt := fmt.Sprintf(`Extract event information from the following text and return ONLY a valid JSON object with these fields:
+	loc, _ := userLocation(s.db, userID)
+	now := time.Now().In(loc)
+
+	prompt := fmt.Sprintf(`It is currently %s (%s). Resolve relative dates and times such as "tomorrow" or "next Friday" from this.
+
+Extract event information from the following text and return ONLY a valid JSON object with these fields:
 - title: event name or description
 - date: date in YYYY-MM-DD format
 - time: time in HH:MM format
 - location: location or "Not specified"
 - description: brief description or empty string
+- confidence: a number from 0 to 1 for how confident you are that the text describes a real event with these details
 
 Text: "%s"
 
-Return ONLY the JSON object.`, messageText)
+Return ONLY the JSON object.`, now.Format("Monday, 2006-01-02 15:04"), loc, messageText)
 
 	response, err := s.callGemini(prompt)
 	if err != nil {
@@ -95,48 +514,85 @@ Return ONLY the JSON object.`, messageText)
 		return nil, fmt.Errorf("failed to parse event data: %w", err)
 	}
 
+	if event.Confidence < 0 {
+		event.Confidence = 0
+	} else if event.Confidence > 1 {
+		event.Confidence = 1
+	}
+	event.NeedsConfirmation = event.Confidence < s.confirmationCutoff
+
 	return &event, nil
 }
 
 func (s *AIService) callGemini(prompt string) (string, error) {
-	url := fmt.Sprintf("https://generativelanguage.googleapis.com/v1beta/models/gemini-pro:generateContent?key=%s", s.apiKey)
+	return s.callGeminiContents([]GeminiContent{{Parts: []GeminiPart{{Text: prompt}}}})
+}
 
-	reqBody := GeminiRequest{
-		Contents: []GeminiContent{{Parts: []GeminiPart{{Text: prompt}}}},
-	}
+// callGeminiContents sends a generateContent request, retrying rate limits,
+// server errors and network failures with exponential backoff. All attempts
+// share one requestTimeout, so retries never stretch a call past it.
+func (s *AIService) callGeminiContents(contents []GeminiContent) (string, error) {
+	reqBody := GeminiRequest{Contents: contents}
 
 	jsonData, err := json.Marshal(reqBody)
 	if err != nil {
 		return "", err
 	}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	backoff := initialRetryBackoff
+	for attempt := 1; ; attempt++ {
+		text, retryable, err := s.tryGemini(ctx, jsonData)
+		if err == nil {
+			return text, nil
+		}
+
+		deadline, _ := ctx.Deadline()
+		if !retryable || attempt >= s.maxAttempts || time.Until(deadline) < backoff {
+			if attempt > 1 {
+				return "", fmt.Errorf("Gemini request failed after %d attempts: %w", attempt, err)
+			}
+			return "", err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// tryGemini makes a single generateContent request and reports whether a
+// failure is worth retrying.
+func (s *AIService) tryGemini(ctx context.Context, jsonData []byte) (string, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", s.endpoint("generateContent"), bytes.NewReader(jsonData))
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 
 	req.Header.Set("Content-Type", "application/json")
 	resp, err := s.client.Do(req)
 	if err != nil {
-		return "", err
+		// Network errors are retried, but not running out of time
+		return "", ctx.Err() == nil, err
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("Gemini API error: %s", string(body))
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return "", retryable, s.apiError(resp)
 	}
 
 	var geminiResp GeminiResponse
 	if err := json.NewDecoder(resp.Body).Decode(&geminiResp); err != nil {
-		return "", err
+		return "", false, err
 	}
 
 	if len(geminiResp.Candidates) == 0 || len(geminiResp.Candidates[0].Content.Parts) == 0 {
-		return "", errors.New("no response from Gemini")
+		return "", false, errors.New("no response from Gemini")
 	}
 
-	return geminiResp.Candidates[0].Content.Parts[0].Text, nil
+	return geminiResp.Candidates[0].Content.Parts[0].Text, false, nil
 }
 
 func cleanJSONResponse(response string) string {
@@ -1,37 +1,98 @@
 package services
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"log"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"onechat/internal/models"
 )
 
 type AuthService struct {
-	db        *gorm.DB
-	jwtSecret string
+	db            *gorm.DB
+	jwtSecret     string
+	refreshSecret string
 }
 
+const (
+	tokenTypeAccess  = "access"
+	tokenTypeRefresh = "refresh"
+
+	accessTokenTTL  = 24 * time.Hour
+	refreshTokenTTL = 7 * 24 * time.Hour
+)
+
 type Claims struct {
-	UserID uint   `json:"user_id"`
-	Phone  string `json:"phone"`
+	UserID    uint   `json:"user_id"`
+	Phone     string `json:"phone"`
+	TokenType string `json:"token_type"`    // access or refresh
+	SessionID string `json:"sid,omitempty"` // shared by the tokens of one login; empty for tokens from before sessions
 	jwt.RegisteredClaims
 }
 
-func NewAuthService(db *gorm.DB, jwtSecret string) *AuthService {
+var ErrInvalidGroupAddPolicy = errors.New("group_add_policy must be everyone, contacts or nobody")
+var ErrInvalidLastSeenPrivacy = errors.New("last_seen_privacy must be everyone, contacts or nobody")
+
+// ErrBlocked is returned when a block between two users forbids an action.
+var ErrBlocked = errors.New("you can't message this user")
+
+// ErrWrongPassword is returned when the current password given to
+// ChangePassword doesn't match.
+var ErrWrongPassword = errors.New("current password is incorrect")
+
+// ErrWeakPassword is returned for a new password that doesn't meet the
+// strength rules in validatePassword.
+var ErrWeakPassword = errors.New("password must be 8 to 72 characters and use at least three of lowercase letters, uppercase letters, digits and symbols")
+
+// ErrPasswordReused is returned when the new password is the current one.
+var ErrPasswordReused = errors.New("new password must be different from the current one")
+
+// ErrInvalidUsername is returned for a username that breaks the rules in
+// validateUsername.
+var ErrInvalidUsername = errors.New("username must be 3 to 30 letters, digits, dots or underscores")
+
+// ErrInvalidPhone is returned for a phone number that can't be read as an
+// E.164 number.
+var ErrInvalidPhone = errors.New("phone must be an international number with 8 to 15 digits, e.g. +15551234567")
+
+func NewAuthService(db *gorm.DB, jwtSecret, refreshSecret string) *AuthService {
 	return &AuthService{
-		db:        db,
-		jwtSecret: jwtSecret,
+		db:            db,
+		jwtSecret:     jwtSecret,
+		refreshSecret: refreshSecret,
 	}
 }
 
+// Register creates an account. The phone number is stored in E.164 form,
+// and compared on its digits so accounts registered before numbers were
+// normalized still count as taken.
 func (s *AuthService) Register(phone, username, password string) (*models.User, string, string, error) {
+	phone, err := normalizePhone(phone)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if err := validateUsername(username); err != nil {
+		return nil, "", "", err
+	}
+	if err := validatePassword(password); err != nil {
+		return nil, "", "", err
+	}
+
 	// Check if user exists
 	var existingUser models.User
-	if err := s.db.Where("phone = ? OR username = ?", phone, username).First(&existingUser).Error; err == nil {
+	if err := s.db.Where("regexp_replace(phone, '[^0-9]', '', 'g') = ? OR username = ?", normalizePhoneDigits(phone), username).
+		First(&existingUser).Error; err == nil {
 		return nil, "", "", errors.New("user already exists")
 	}
 
@@ -55,12 +116,7 @@ func (s *AuthService) Register(phone, username, password string) (*models.User,
 	}
 
 	// Generate tokens
-	accessToken, err := s.generateToken(user.ID, user.Phone, 24*time.Hour)
-	if err != nil {
-		return nil, "", "", err
-	}
-
-	refreshToken, err := s.generateToken(user.ID, user.Phone, 7*24*time.Hour)
+	accessToken, refreshToken, err := s.startSession(user.ID, user.Phone)
 	if err != nil {
 		return nil, "", "", err
 	}
@@ -69,8 +125,14 @@ func (s *AuthService) Register(phone, username, password string) (*models.User,
 }
 
 func (s *AuthService) Login(phone, password string) (*models.User, string, string, error) {
+	// Accounts from before normalization may still hold the number as typed
+	normalized, err := normalizePhone(phone)
+	if err != nil {
+		normalized = phone
+	}
+
 	var user models.User
-	if err := s.db.Where("phone = ?", phone).First(&user).Error; err != nil {
+	if err := s.db.Where("phone = ? OR phone = ?", normalized, phone).First(&user).Error; err != nil {
 		return nil, "", "", errors.New("invalid credentials")
 	}
 
@@ -86,12 +148,7 @@ func (s *AuthService) Login(phone, password string) (*models.User, string, strin
 	s.db.Save(&user)
 
 	// Generate tokens
-	accessToken, err := s.generateToken(user.ID, user.Phone, 24*time.Hour)
-	if err != nil {
-		return nil, "", "", err
-	}
-
-	refreshToken, err := s.generateToken(user.ID, user.Phone, 7*24*time.Hour)
+	accessToken, refreshToken, err := s.startSession(user.ID, user.Phone)
 	if err != nil {
 		return nil, "", "", err
 	}
@@ -100,17 +157,31 @@ func (s *AuthService) Login(phone, password string) (*models.User, string, strin
 }
 
 func (s *AuthService) RefreshToken(oldToken string) (string, error) {
-	claims := &Claims{}
-	token, err := jwt.ParseWithClaims(oldToken, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(s.jwtSecret), nil
-	})
+	claims, err := s.parseToken(oldToken, tokenTypeRefresh)
+	if err != nil {
+		return "", errors.New("invalid refresh token")
+	}
 
-	if err != nil || !token.Valid {
+	// Deleted accounts can't mint new access tokens
+	if err := s.db.Select("id").First(&models.User{}, claims.UserID).Error; err != nil {
 		return "", errors.New("invalid refresh token")
 	}
 
-	// Generate new access token
-	return s.generateToken(claims.UserID, claims.Phone, 24*time.Hour)
+	// The new access token belongs to the refresh token's session, so
+	// logging out of it revokes both
+	return s.generateToken(claims.UserID, claims.Phone, tokenTypeAccess, claims.SessionID, accessTokenTTL)
+}
+
+// SetPresence records whether the user has any live connection. Going
+// offline also stamps LastSeen, which is returned.
+func (s *AuthService) SetPresence(userID uint, online bool) (time.Time, error) {
+	now := time.Now()
+	updates := map[string]interface{}{"is_online": online}
+	if !online {
+		updates["last_seen"] = now
+	}
+	err := s.db.Model(&models.User{}).Where("id = ?", userID).Updates(updates).Error
+	return now, err
 }
 
 func (s *AuthService) GetUserByID(userID uint) (*models.User, error) {
@@ -121,52 +192,595 @@ func (s *AuthService) GetUserByID(userID uint) (*models.User, error) {
 	return &user, nil
 }
 
-func (s *AuthService) UpdateProfile(userID uint, updates map[string]interface{}) (*models.User, error) {
+// ProfileUpdate holds the profile fields a user can change themselves. Nil
+// fields are left as they are.
+type ProfileUpdate struct {
+	Username        *string
+	Phone           *string
+	ProfilePic      *string
+	Status          *string
+	GroupAddPolicy  *string
+	LastSeenPrivacy *string
+	Timezone        *string
+}
+
+func (s *AuthService) UpdateProfile(userID uint, update ProfileUpdate) (*models.User, error) {
+	updates := make(map[string]interface{})
+	if update.Phone != nil {
+		normalized, err := normalizePhone(*update.Phone)
+		if err != nil {
+			return nil, err
+		}
+		updates["phone"] = normalized
+	}
+	if update.Username != nil {
+		if err := validateUsername(*update.Username); err != nil {
+			return nil, err
+		}
+		updates["username"] = *update.Username
+	}
+	if update.ProfilePic != nil {
+		updates["profile_pic"] = *update.ProfilePic
+	}
+	if update.Status != nil {
+		updates["status"] = *update.Status
+	}
+	if policy := update.GroupAddPolicy; policy != nil {
+		if *policy != "everyone" && *policy != "contacts" && *policy != "nobody" {
+			return nil, ErrInvalidGroupAddPolicy
+		}
+		updates["group_add_policy"] = *policy
+	}
+	if privacy := update.LastSeenPrivacy; privacy != nil {
+		if *privacy != "everyone" && *privacy != "contacts" && *privacy != "nobody" {
+			return nil, ErrInvalidLastSeenPrivacy
+		}
+		updates["last_seen_privacy"] = *privacy
+	}
+	if update.Timezone != nil {
+		if _, err := loadTimezone(*update.Timezone); err != nil {
+			return nil, err
+		}
+		updates["timezone"] = *update.Timezone
+	}
+
 	var user models.User
 	if err := s.db.First(&user, userID).Error; err != nil {
 		return nil, err
 	}
 
-	if err := s.db.Model(&user).Updates(updates).Error; err != nil {
-		return nil, err
+	if len(updates) > 0 {
+		if err := s.db.Model(&user).Updates(updates).Error; err != nil {
+			return nil, err
+		}
 	}
 
 	return &user, nil
 }
 
-func (s *AuthService) SearchUsers(query string, currentUserID uint) ([]models.User, error) {
-	var users []models.User
-	err := s.db.Where("(username LIKE ? OR phone LIKE ?) AND id != ?", 
-		"%"+query+"%", "%"+query+"%", currentUserID).
-		Limit(20).
+// ChangePassword replaces the user's password after checking the current
+// one.
+func (s *AuthService) ChangePassword(userID uint, oldPassword, newPassword string) error {
+	var user models.User
+	if err := s.db.First(&user, userID).Error; err != nil {
+		return err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(oldPassword)); err != nil {
+		return ErrWrongPassword
+	}
+	if newPassword == oldPassword {
+		return ErrPasswordReused
+	}
+	if err := validatePassword(newPassword); err != nil {
+		return err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Model(&user).Update("password", string(hashedPassword)).Error
+}
+
+// validatePassword requires at least 8 characters, no more than the 72
+// bytes bcrypt can hash, and three of the four character classes.
+func validatePassword(password string) error {
+	if utf8.RuneCountInString(password) < 8 || len(password) > 72 {
+		return ErrWeakPassword
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+
+	classes := 0
+	for _, has := range []bool{lower, upper, digit, symbol} {
+		if has {
+			classes++
+		}
+	}
+	if classes < 3 {
+		return ErrWeakPassword
+	}
+	return nil
+}
+
+// ResetSessions signs the user out everywhere by rejecting every token
+// issued so far, and returns a fresh access and refresh token for the
+// caller's own session.
+func (s *AuthService) ResetSessions(userID uint) (string, string, error) {
+	var user models.User
+	if err := s.db.First(&user, userID).Error; err != nil {
+		return "", "", err
+	}
+
+	if err := s.db.Model(&user).Update("sessions_reset_at", time.Now()).Error; err != nil {
+		return "", "", err
+	}
+
+	accessToken, refreshToken, err := s.startSession(user.ID, user.Phone)
+	if err != nil {
+		return "", "", err
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// DeletedMessageContent replaces the content of a deleted account's messages
+// when the user asks for them to be anonymized.
+const DeletedMessageContent = "[deleted user]"
+
+// DeleteAccount soft-deletes the user and removes their footprint in one
+// transaction. They leave every group, and if they were a group's only
+// admin the longest-standing remaining member is promoted; groups left empty
+// are deleted along with their chat. Their private chats are deleted too,
+// so the other side isn't left talking to nobody. The user row is scrubbed
+// so the phone number and username can be registered again, and every
+// token issued for the account stops working. With anonymizeMessages, the
+// content of the messages they sent is replaced.
+func (s *AuthService) DeleteAccount(userID uint, anonymizeMessages bool) error {
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		var user models.User
+		if err := tx.First(&user, userID).Error; err != nil {
+			return err
+		}
+
+		var memberships []models.GroupMember
+		if err := tx.Where("user_id = ?", userID).Find(&memberships).Error; err != nil {
+			return err
+		}
+		for _, membership := range memberships {
+			if _, err := leaveGroup(tx, membership); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Where("type = ? AND (user1_id = ? OR user2_id = ?)", "private", userID, userID).
+			Delete(&models.Chat{}).Error; err != nil {
+			return err
+		}
+
+		if anonymizeMessages {
+			if err := tx.Model(&models.Message{}).
+				Where("sender_id = ? AND type <> ?", userID, "system").
+				Updates(map[string]interface{}{"content": DeletedMessageContent, "media_url": "", "media_id": nil, "thumbnail_url": ""}).Error; err != nil {
+				return err
+			}
+		}
+
+		// Per-user rows that mean nothing once the account is gone
+		if err := tx.Where("conversation_id IN (?)",
+			tx.Model(&models.AIConversation{}).Select("id").Where("user_id = ?", userID)).
+			Delete(&models.AIConversationMessage{}).Error; err != nil {
+			return err
+		}
+		for _, model := range []interface{}{
+			&models.ChatPin{},
+			&models.ChatSnooze{},
+			&models.ChatMute{},
+			&models.ChatArchive{},
+			&models.ChatDraft{},
+			&models.ChatNotificationSetting{},
+			&models.MessageReaction{},
+			&models.MessageHide{},
+			&models.MessageMention{},
+			&models.Event{},
+			&models.AIConversation{},
+		} {
+			if err := tx.Where("user_id = ?", userID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		if err := tx.Where("created_by_id = ?", userID).Delete(&models.GroupInvite{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ? OR blocked_id = ?", userID, userID).Delete(&models.BlockedUser{}).Error; err != nil {
+			return err
+		}
+
+		// Hand an uploaded avatar to the media cleanup, which removes it from
+		// storage on its next run
+		if user.AvatarPublicID != "" {
+			if err := tx.Create(&models.Media{
+				UserID:    userID,
+				Type:      "image",
+				URL:       user.ProfilePic,
+				PublicID:  user.AvatarPublicID,
+				ExpiresAt: time.Now(),
+			}).Error; err != nil {
+				return err
+			}
+		}
+
+		// Free the unique phone and username, which soft-deleted rows still hold
+		placeholder := fmt.Sprintf("deleted-%d", userID)
+		if err := tx.Model(&user).Updates(map[string]interface{}{
+			"phone":            placeholder,
+			"username":         placeholder,
+			"password":         "",
+			"profile_pic":      "",
+			"avatar_public_id": "",
+			"status":           "",
+			"is_online":        false,
+			"calendar_token":   nil,
+			// Sign out every device, not just the one that deleted the account
+			"sessions_reset_at": time.Now(),
+		}).Error; err != nil {
+			return err
+		}
+
+		return tx.Delete(&user).Error
+	})
+}
+
+// likeEscaper escapes the LIKE wildcards in user input, so a search for
+// "a_b" doesn't match "axb".
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// SearchUsers finds users whose username or phone contains the query,
+// ignoring case, ordered by username. Users who blocked the searcher and
+// deleted accounts are left out. It returns the page and the total number
+// of matches.
+func (s *AuthService) SearchUsers(query string, currentUserID uint, limit, offset int) ([]models.User, int64, error) {
+	pattern := "%" + likeEscaper.Replace(query) + "%"
+	matches := s.db.Model(&models.User{}).
+		Where("(username ILIKE ? OR phone ILIKE ?) AND id != ?", pattern, pattern, currentUserID).
+		Where("deleted_at IS NULL").
+		Where("id NOT IN (?)", s.db.Model(&models.BlockedUser{}).Select("user_id").Where("blocked_id = ?", currentUserID))
+
+	var total int64
+	if err := matches.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	users := []models.User{}
+	err := matches.Order("username ASC, id ASC").
+		Limit(limit).
+		Offset(offset).
 		Find(&users).Error
-	
+
+	return users, total, err
+}
+
+// BlockUser stops the blocked user from messaging the user privately and
+// hides the user's presence from them. Blocking twice is a no-op.
+func (s *AuthService) BlockUser(userID, blockedID uint) (*models.BlockedUser, error) {
+	if userID == blockedID {
+		return nil, errors.New("you can't block yourself")
+	}
+
+	if err := s.db.Select("id").First(&models.User{}, blockedID).Error; err != nil {
+		return nil, err
+	}
+
+	block := &models.BlockedUser{UserID: userID, BlockedID: blockedID}
+	if err := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(block).Error; err != nil {
+		return nil, err
+	}
+
+	s.db.Preload("Blocked").Where("user_id = ? AND blocked_id = ?", userID, blockedID).First(block)
+	return block, nil
+}
+
+func (s *AuthService) UnblockUser(userID, blockedID uint) error {
+	result := s.db.Where("user_id = ? AND blocked_id = ?", userID, blockedID).Delete(&models.BlockedUser{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetBlockedUsers returns the users the user has blocked, most recent first.
+func (s *AuthService) GetBlockedUsers(userID uint) ([]models.BlockedUser, error) {
+	blocks := []models.BlockedUser{}
+	err := s.db.Preload("Blocked").
+		Where("user_id = ?", userID).
+		Order("created_at DESC").
+		Find(&blocks).Error
+	return blocks, err
+}
+
+// BlockedUserIDs returns the IDs of the users the user has blocked.
+func (s *AuthService) BlockedUserIDs(userID uint) ([]uint, error) {
+	var ids []uint
+	err := s.db.Model(&models.BlockedUser{}).Where("user_id = ?", userID).Pluck("blocked_id", &ids).Error
+	return ids, err
+}
+
+// blockedBetween reports whether either user has blocked the other.
+func blockedBetween(db *gorm.DB, a, b uint) bool {
+	var count int64
+	db.Model(&models.BlockedUser{}).
+		Where("(user_id = ? AND blocked_id = ?) OR (user_id = ? AND blocked_id = ?)", a, b, b, a).
+		Count(&count)
+	return count > 0
+}
+
+const maxContactMatch = 500
+
+// MatchContacts returns the registered users whose phone numbers appear in
+// the given contact list. Numbers are compared on their digits only.
+func (s *AuthService) MatchContacts(phones []string, currentUserID uint) ([]models.User, error) {
+	if len(phones) > maxContactMatch {
+		return nil, errors.New("too many contacts, maximum is 500")
+	}
+
+	normalized := make([]string, 0, len(phones))
+	for _, phone := range phones {
+		if digits := normalizePhoneDigits(phone); digits != "" {
+			normalized = append(normalized, digits)
+		}
+	}
+
+	users := []models.User{}
+	if len(normalized) == 0 {
+		return users, nil
+	}
+
+	err := s.db.Where("regexp_replace(phone, '[^0-9]', '', 'g') IN ? AND id != ?", normalized, currentUserID).
+		Where("id NOT IN (?)", s.db.Model(&models.BlockedUser{}).Select("user_id").Where("blocked_id = ?", currentUserID)).
+		Find(&users).Error
+
 	return users, err
 }
 
-func (s *AuthService) generateToken(userID uint, phone string, duration time.Duration) (string, error) {
+// validateUsername allows 3 to 30 ASCII letters, digits, dots and
+// underscores, so usernames can't carry spaces or lookalike characters.
+func validateUsername(username string) error {
+	if len(username) < 3 || len(username) > 30 {
+		return ErrInvalidUsername
+	}
+	for _, r := range username {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '.' || r == '_') {
+			return ErrInvalidUsername
+		}
+	}
+	return nil
+}
+
+// normalizePhone converts a phone number to E.164, so "+1 555-123-4567",
+// "0015551234567" and "15551234567" are all stored as "+15551234567".
+// Numbers without a + or 00 prefix are taken to include their country code.
+func normalizePhone(phone string) (string, error) {
+	phone = strings.TrimSpace(phone)
+	for _, r := range phone {
+		if !strings.ContainsRune("0123456789+ .-()", r) {
+			return "", ErrInvalidPhone
+		}
+	}
+	if strings.LastIndex(phone, "+") > 0 {
+		return "", ErrInvalidPhone
+	}
+
+	digits := normalizePhoneDigits(phone)
+	if !strings.HasPrefix(phone, "+") {
+		digits = strings.TrimPrefix(digits, "00")
+	}
+	if len(digits) < 8 || len(digits) > 15 || digits[0] == '0' {
+		return "", ErrInvalidPhone
+	}
+	return "+" + digits, nil
+}
+
+func normalizePhoneDigits(phone string) string {
+	var b strings.Builder
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// startSession issues the access and refresh token for a new login. Both
+// carry the same session ID, which Logout revokes.
+func (s *AuthService) startSession(userID uint, phone string) (string, string, error) {
+	sessionID, err := randomID()
+	if err != nil {
+		return "", "", err
+	}
+
+	accessToken, err := s.generateToken(userID, phone, tokenTypeAccess, sessionID, accessTokenTTL)
+	if err != nil {
+		return "", "", err
+	}
+
+	refreshToken, err := s.generateToken(userID, phone, tokenTypeRefresh, sessionID, refreshTokenTTL)
+	if err != nil {
+		return "", "", err
+	}
+
+	return accessToken, refreshToken, nil
+}
+
+// generateToken signs a token of the given type for a session. Access and
+// refresh tokens use separate secrets so one can never be accepted as the
+// other.
+func (s *AuthService) generateToken(userID uint, phone, tokenType, sessionID string, duration time.Duration) (string, error) {
+	// A unique ID keeps two tokens issued in the same second distinct, so
+	// revoking one doesn't revoke the other
+	jti, err := randomID()
+	if err != nil {
+		return "", err
+	}
+
 	claims := &Claims{
-		UserID: userID,
-		Phone:  phone,
+		UserID:    userID,
+		Phone:     phone,
+		TokenType: tokenType,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(duration)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(s.jwtSecret))
+	return token.SignedString([]byte(s.secretFor(tokenType)))
 }
 
+// ValidateToken checks an access token. Refresh tokens are rejected.
 func (s *AuthService) ValidateToken(tokenString string) (*Claims, error) {
+	return s.parseToken(tokenString, tokenTypeAccess)
+}
+
+func (s *AuthService) parseToken(tokenString, tokenType string) (*Claims, error) {
 	claims := &Claims{}
 	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(s.jwtSecret), nil
-	})
+		return []byte(s.secretFor(tokenType)), nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 
-	if err != nil || !token.Valid {
+	if err != nil || !token.Valid || claims.TokenType != tokenType || s.isRevoked(tokenString) ||
+		s.isSessionRevoked(claims.SessionID) || s.invalidForUser(claims) {
 		return nil, errors.New("invalid token")
 	}
 
 	return claims, nil
 }
+
+// invalidForUser reports whether the token's user has deleted their account
+// or last reset their sessions after the token was issued. Token times only
+// have second precision, so tokens issued in the same second as the reset
+// are kept.
+func (s *AuthService) invalidForUser(claims *Claims) bool {
+	var user models.User
+	if err := s.db.Select("sessions_reset_at").First(&user, claims.UserID).Error; err != nil {
+		return true
+	}
+	if user.SessionsResetAt == nil {
+		return false
+	}
+	return claims.IssuedAt == nil || claims.IssuedAt.Time.Before(user.SessionsResetAt.Truncate(time.Second))
+}
+
+func (s *AuthService) secretFor(tokenType string) string {
+	if tokenType == tokenTypeRefresh {
+		return s.refreshSecret
+	}
+	return s.jwtSecret
+}
+
+// RevokeToken invalidates an access or refresh token before it expires. The
+// revocation is kept until the token would have expired anyway.
+func (s *AuthService) RevokeToken(tokenString string) error {
+	claims, err := s.parseToken(tokenString, tokenTypeAccess)
+	if err != nil {
+		claims, err = s.parseToken(tokenString, tokenTypeRefresh)
+	}
+	if err != nil {
+		return err
+	}
+
+	expiresAt := time.Now()
+	if claims.ExpiresAt != nil {
+		expiresAt = claims.ExpiresAt.Time
+	}
+
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.RevokedToken{
+		TokenHash: hashToken(tokenString),
+		ExpiresAt: expiresAt,
+	}).Error
+}
+
+// RevokeSession logs out the session the access token belongs to, revoking
+// the token along with every other token issued for the session, including
+// its refresh token.
+func (s *AuthService) RevokeSession(accessToken string) error {
+	claims, err := s.parseToken(accessToken, tokenTypeAccess)
+	if err != nil {
+		return err
+	}
+	if err := s.RevokeToken(accessToken); err != nil {
+		return err
+	}
+	if claims.SessionID == "" {
+		return nil
+	}
+
+	// Access tokens minted just before the refresh token expires outlive it
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.RevokedSession{
+		SessionID: claims.SessionID,
+		ExpiresAt: time.Now().Add(refreshTokenTTL + accessTokenTTL),
+	}).Error
+}
+
+// StartRevokedTokenSweeper periodically deletes revocations for tokens and
+// sessions that have expired, since their tokens are rejected anyway.
+func (s *AuthService) StartRevokedTokenSweeper(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			if err := s.db.Where("expires_at < ?", time.Now()).Delete(&models.RevokedToken{}).Error; err != nil {
+				log.Printf("Failed to sweep revoked tokens: %v", err)
+			}
+			if err := s.db.Where("expires_at < ?", time.Now()).Delete(&models.RevokedSession{}).Error; err != nil {
+				log.Printf("Failed to sweep revoked sessions: %v", err)
+			}
+		}
+	}()
+}
+
+func (s *AuthService) isRevoked(tokenString string) bool {
+	var count int64
+	s.db.Model(&models.RevokedToken{}).Where("token_hash = ?", hashToken(tokenString)).Count(&count)
+	return count > 0
+}
+
+func (s *AuthService) isSessionRevoked(sessionID string) bool {
+	if sessionID == "" {
+		return false
+	}
+	var count int64
+	s.db.Model(&models.RevokedSession{}).Where("session_id = ?", sessionID).Count(&count)
+	return count > 0
+}
+
+// randomID returns 16 random bytes, hex encoded.
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(tokenString string) string {
+	sum := sha256.Sum256([]byte(tokenString))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"onechat/internal/models"
+)
+
+// defaultEventDuration is the length given to events in calendar exports,
+// since events only record when they start.
+const defaultEventDuration = time.Hour
+
+// ExportICS renders the user's events as an iCalendar (RFC 5545) document.
+// Recurring events are exported once with their RRULE, and their cancelled
+// occurrences as EXDATE, so calendar apps expand them the same way
+// GetEventOccurrences does.
+func (s *EventService) ExportICS(userID uint) ([]byte, error) {
+	var events []models.Event
+	err := s.db.Preload("Exceptions", func(db *gorm.DB) *gorm.DB {
+		return db.Order("occurrence_date ASC")
+	}).Where("user_id = ?", userID).Order("event_date ASC").Find(&events).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	writeICSLine(&b, "BEGIN:VCALENDAR")
+	writeICSLine(&b, "VERSION:2.0")
+	writeICSLine(&b, "PRODID:-//OneChat//Events//EN")
+	writeICSLine(&b, "CALSCALE:GREGORIAN")
+	writeICSLine(&b, "X-WR-CALNAME:OneChat")
+
+	for _, event := range events {
+		writeICSLine(&b, "BEGIN:VEVENT")
+		writeICSLine(&b, fmt.Sprintf("UID:event-%d@onechat", event.ID))
+		writeICSLine(&b, "DTSTAMP:"+icsUTC(event.UpdatedAt))
+
+		// Rules are validated when saved
+		rule, _ := parseRecurrence(event.RecurrenceRule)
+		var loc *time.Location
+		if rule != nil && event.Timezone != "" {
+			// Recurrences follow the local clock of their timezone
+			var err error
+			if loc, err = loadTimezone(event.Timezone); err != nil {
+				loc = time.UTC
+			}
+			writeICSLine(&b, fmt.Sprintf("DTSTART;TZID=%s:%s", loc, icsLocal(event.EventDate, loc)))
+			writeICSLine(&b, fmt.Sprintf("DTEND;TZID=%s:%s", loc, icsLocal(event.EventDate.Add(defaultEventDuration), loc)))
+		} else {
+			writeICSLine(&b, "DTSTART:"+icsUTC(event.EventDate))
+			writeICSLine(&b, "DTEND:"+icsUTC(event.EventDate.Add(defaultEventDuration)))
+		}
+		if rule != nil {
+			writeICSLine(&b, "RRULE:"+rule.rrule())
+		}
+		if rule != nil && len(event.Exceptions) > 0 {
+			// EXDATE values take the same form as DTSTART
+			dates := make([]string, len(event.Exceptions))
+			for i, exception := range event.Exceptions {
+				if loc != nil {
+					dates[i] = icsLocal(exception.OccurrenceDate, loc)
+				} else {
+					dates[i] = icsUTC(exception.OccurrenceDate)
+				}
+			}
+			if loc != nil {
+				writeICSLine(&b, fmt.Sprintf("EXDATE;TZID=%s:%s", loc, strings.Join(dates, ",")))
+			} else {
+				writeICSLine(&b, "EXDATE:"+strings.Join(dates, ","))
+			}
+		}
+
+		writeICSLine(&b, "SUMMARY:"+icsText(event.Title))
+		if event.Location != "" && event.Location != "Not specified" {
+			writeICSLine(&b, "LOCATION:"+icsText(event.Location))
+		}
+		if event.Description != "" {
+			writeICSLine(&b, "DESCRIPTION:"+icsText(event.Description))
+		}
+		writeICSLine(&b, "END:VEVENT")
+	}
+
+	writeICSLine(&b, "END:VCALENDAR")
+	return b.Bytes(), nil
+}
+
+// RotateCalendarToken gives the user a new calendar feed token, which
+// replaces any earlier one.
+func (s *EventService) RotateCalendarToken(userID uint) (string, error) {
+	buf := make([]byte, 20)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+
+	result := s.db.Model(&models.User{}).Where("id = ?", userID).Update("calendar_token", token)
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		return "", gorm.ErrRecordNotFound
+	}
+	return token, nil
+}
+
+// RevokeCalendarToken turns off the user's calendar feed URL.
+func (s *EventService) RevokeCalendarToken(userID uint) error {
+	return s.db.Model(&models.User{}).Where("id = ?", userID).Update("calendar_token", nil).Error
+}
+
+// UserForCalendarToken returns the ID of the user a calendar feed token
+// belongs to.
+func (s *EventService) UserForCalendarToken(token string) (uint, error) {
+	var user models.User
+	if err := s.db.Select("id").Where("calendar_token = ?", token).First(&user).Error; err != nil {
+		return 0, err
+	}
+	return user.ID, nil
+}
+
+func icsUTC(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// icsLocal formats t as a local time in loc, for use with a TZID.
+func icsLocal(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format("20060102T150405")
+}
+
+var icsTextEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", `\n`)
+
+// icsText escapes a TEXT value.
+func icsText(value string) string {
+	return icsTextEscaper.Replace(value)
+}
+
+// writeICSLine writes a content line, folding it at 75 octets as RFC 5545
+// requires, without splitting a UTF-8 character.
+func writeICSLine(b *bytes.Buffer, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		b.WriteString(line[:cut])
+		b.WriteString("\r\n ")
+		line = line[cut:]
+		limit = 74 // continuation lines start with a space
+	}
+	b.WriteString(line)
+	b.WriteString("\r\n")
+}
@@ -2,33 +2,275 @@ package services
 
 import (
 	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"onechat/internal/models"
 )
 
 type ChatService struct {
-	db *gorm.DB
+	db               *gorm.DB
+	maxMessageLength int
+	maxPinnedChats   int
+	deleteWindow     time.Duration
 }
 
-func NewChatService(db *gorm.DB) *ChatService {
-	return &ChatService{db: db}
+// MessageTooLongError is returned by CreateMessage when content exceeds the
+// limit that applies to the chat.
+type MessageTooLongError struct {
+	Limit int
 }
 
-func (s *ChatService) GetUserChats(userID uint) ([]models.Chat, error) {
+func (e *MessageTooLongError) Error() string {
+	return fmt.Sprintf("message exceeds maximum length of %d characters", e.Limit)
+}
+
+// ErrAnnounceOnly is returned when a non-admin posts in an announce-only group.
+var ErrAnnounceOnly = errors.New("only admins can post in this group")
+
+// ErrRestrictedMember is returned when a restricted member tries to post.
+var ErrRestrictedMember = errors.New("restricted members cannot post until promoted")
+
+// ErrInvalidEventMessage is returned when an event message does not reference
+// one of the sender's events, or another message type references an event.
+var ErrInvalidEventMessage = errors.New("event messages must reference one of your events")
+
+// ErrInvalidLocation is returned when a location message lacks valid
+// coordinates, or another message type carries them.
+var ErrInvalidLocation = errors.New("invalid location")
+
+// Location is the point shared by a location message.
+type Location struct {
+	Latitude  *float64
+	Longitude *float64
+	Label     string
+}
+
+// ErrInvalidContact is returned when a contact message lacks a valid name
+// or phone number, or another message type carries them.
+var ErrInvalidContact = errors.New("invalid contact")
+
+// Contact is the contact card shared by a contact message.
+type Contact struct {
+	Name  string
+	Phone string
+}
+
+// maxContactNameLength bounds the name on a shared contact card.
+const maxContactNameLength = 100
+
+// ErrNotChatMember is returned when a user posts into a chat they don't
+// belong to.
+var ErrNotChatMember = errors.New("not a member of this chat")
+
+// ErrPinNotAllowed is returned when a group member whose role can't pin
+// pins or unpins a message.
+var ErrPinNotAllowed = errors.New("you can't pin messages in this group")
+
+// ErrNotMessageSender is returned when a user edits someone else's message.
+var ErrNotMessageSender = errors.New("only the sender can edit this message")
+
+// ErrMessageNotEditable is returned when editing anything but a text message.
+var ErrMessageNotEditable = errors.New("only text messages can be edited")
+
+// ErrMessageDeleted is returned when editing, reacting to or pinning a
+// message that was deleted for everyone.
+var ErrMessageDeleted = errors.New("this message was deleted")
+
+// ErrDeleteWindowPassed is returned when the sender deletes a message for
+// everyone after the delete window has closed. Deleting it for themselves
+// is still allowed.
+var ErrDeleteWindowPassed = errors.New("this message is too old to delete for everyone")
+
+// ErrInvalidDeleteScope is returned for a delete scope other than
+// DeleteForMe or DeleteForEveryone.
+var ErrInvalidDeleteScope = errors.New("scope must be me or everyone")
+
+// Message delete scopes
+const (
+	DeleteForMe       = "me"
+	DeleteForEveryone = "everyone"
+)
+
+// MessageDeletedPlaceholder replaces the content of a message deleted for
+// everyone.
+const MessageDeletedPlaceholder = "This message was deleted"
+
+// SlowModeError is returned when a member posts again before the group's
+// slow mode interval has passed.
+type SlowModeError struct {
+	RetryAfter int
+}
+
+func (e *SlowModeError) Error() string {
+	return fmt.Sprintf("slow mode is on, try again in %d seconds", e.RetryAfter)
+}
+
+// ChatReadReceipt summarizes messages marked read in one chat: the latest
+// message read and the senders who should be told.
+type ChatReadReceipt struct {
+	ChatID        uint   `json:"chat_id"`
+	LastMessageID uint   `json:"last_message_id"`
+	SenderIDs     []uint `json:"-"`
+}
+
+// MessageSearchResult is a message matching a search, with the IDs of the
+// messages either side of it so clients can load the surrounding context.
+type MessageSearchResult struct {
+	Message       models.Message `json:"message"`
+	PrevMessageID *uint          `json:"prev_message_id"`
+	NextMessageID *uint          `json:"next_message_id"`
+}
+
+// ChatSearchResult is one chat's share of a cross-chat search: the chat and
+// its matching messages, newest first.
+type ChatSearchResult struct {
+	Chat     models.Chat      `json:"chat"`
+	Messages []models.Message `json:"messages"`
+}
+
+// ChatPermissions is what the user may do in a chat, computed server-side so
+// clients don't have to reimplement the rules.
+type ChatPermissions struct {
+	CanPost         bool `json:"can_post"`
+	CanPin          bool `json:"can_pin"`
+	CanAddMembers   bool `json:"can_add_members"`
+	IsAdmin         bool `json:"is_admin"`
+	AnnounceOnly    bool `json:"announce_only"`
+	SlowModeSeconds int  `json:"slow_mode_seconds"`
+}
+
+// NewChatService creates a ChatService. deleteWindow is how long after
+// sending a message its sender can still delete it for everyone; 0 means
+// there is no limit.
+func NewChatService(db *gorm.DB, maxMessageLength, maxPinnedChats int, deleteWindow time.Duration) *ChatService {
+	return &ChatService{
+		db:               db,
+		maxMessageLength: maxMessageLength,
+		maxPinnedChats:   maxPinnedChats,
+		deleteWindow:     deleteWindow,
+	}
+}
+
+// GetUserChats returns a page of the user's chats with their pinned chats
+// first, in pin order, followed by the rest by most recent activity. Chats
+// the user snoozed are left out until their remind_at.
+func (s *ChatService) GetUserChats(userID uint, archived bool, limit, offset int) ([]models.Chat, error) {
+	archivedIDs := s.db.Model(&models.ChatArchive{}).Select("chat_id").Where("user_id = ?", userID)
+	archiveFilter := "chats.id NOT IN (?)"
+	if archived {
+		archiveFilter = "chats.id IN (?)"
+	}
+	snoozedIDs := s.db.Model(&models.ChatSnooze{}).Select("chat_id").
+		Where("user_id = ? AND remind_at > ?", userID, time.Now())
+
 	var chats []models.Chat
 	err := s.db.Preload("LastMessage").
 		Preload("LastMessage.Sender").
-		Where("(user1_id = ? OR user2_id = ?) AND type = ?", userID, userID, "private").
-		Or("id IN (?)", 
-			s.db.Table("group_members").
-				Select("group_id").
-				Where("user_id = ?", userID)).
-		Order("updated_at DESC").
+		Joins("LEFT JOIN chat_pins ON chat_pins.chat_id = chats.id AND chat_pins.user_id = ?", userID).
+		Where("chats.id IN (?)", s.userChatIDs(userID)).
+		Where(archiveFilter, archivedIDs).
+		Where("chats.id NOT IN (?)", snoozedIDs).
+		Order("chat_pins.position IS NULL, chat_pins.position ASC, chats.updated_at DESC").
+		Limit(limit).
+		Offset(offset).
 		Find(&chats).Error
-	
-	return chats, err
+	if err != nil {
+		return nil, err
+	}
+
+	var pins []models.ChatPin
+	s.db.Where("user_id = ?", userID).Find(&pins)
+	positions := make(map[uint]int, len(pins))
+	for _, pin := range pins {
+		positions[pin.ChatID] = pin.Position
+	}
+
+	chatIDs := make([]uint, len(chats))
+	for i := range chats {
+		chatIDs[i] = chats[i].ID
+	}
+	unread, err := s.unreadCounts(chatIDs, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var drafts []models.ChatDraft
+	s.db.Where("user_id = ? AND chat_id IN ?", userID, chatIDs).Find(&drafts)
+	draftContent := make(map[uint]string, len(drafts))
+	for _, draft := range drafts {
+		draftContent[draft.ChatID] = draft.Content
+	}
+
+	for i := range chats {
+		if position, ok := positions[chats[i].ID]; ok {
+			position := position
+			chats[i].PinPosition = &position
+		}
+		chats[i].UnreadCount = unread[chats[i].ID]
+		chats[i].Draft = draftContent[chats[i].ID]
+	}
+
+	return chats, nil
+}
+
+// GetUnreadCounts returns the number of unread messages sent to the user in
+// each of their chats, including chats with none, plus the total.
+func (s *ChatService) GetUnreadCounts(userID uint) (map[uint]int64, int64, error) {
+	chatIDs, err := s.GetUserChatIDs(userID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	counts, err := s.unreadCounts(chatIDs, userID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var total int64
+	for _, count := range counts {
+		total += count
+	}
+
+	return counts, total, nil
+}
+
+// unreadCounts counts the messages in each chat that weren't sent by the user
+// and aren't read yet. Every requested chat has an entry, zero if need be.
+func (s *ChatService) unreadCounts(chatIDs []uint, userID uint) (map[uint]int64, error) {
+	counts := make(map[uint]int64, len(chatIDs))
+	for _, chatID := range chatIDs {
+		counts[chatID] = 0
+	}
+	if len(chatIDs) == 0 {
+		return counts, nil
+	}
+
+	var rows []struct {
+		ChatID uint
+		Count  int64
+	}
+	err := s.db.Model(&models.Message{}).
+		Select("chat_id, COUNT(*) AS count").
+		Where("chat_id IN ? AND sender_id != ?", chatIDs, userID).
+		Where("NOT EXISTS (?)", s.readBy(userID)).
+		Group("chat_id").
+		Scan(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		counts[row.ChatID] = row.Count
+	}
+
+	return counts, nil
 }
 
 func (s *ChatService) GetOrCreatePrivateChat(user1ID, user2ID uint) (*models.Chat, error) {
@@ -54,94 +296,1383 @@ func (s *ChatService) GetOrCreatePrivateChat(user1ID, user2ID uint) (*models.Cha
 	return &chat, nil
 }
 
-func (s *ChatService) GetMessages(chatID uint, limit, offset int) ([]models.Message, error) {
+// GetMessages returns a page of the chat's main conversation as userID sees
+// it: messages they deleted for themselves are left out, while messages
+// deleted for everyone stay in place as placeholders.
+func (s *ChatService) GetMessages(chatID, userID uint, limit, offset int) ([]models.Message, error) {
 	var messages []models.Message
 	err := s.db.Preload("Sender").
-		Where("chat_id = ?", chatID).
+		Preload("Event").
+		Preload("Mentions").
+		Where("chat_id = ? AND thread_root_id IS NULL", chatID).
+		Where("id NOT IN (?)", s.hiddenMessageIDs(userID)).
 		Order("created_at DESC").
 		Limit(limit).
 		Offset(offset).
 		Find(&messages).Error
-	
+
 	// Reverse to show oldest first
 	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
 		messages[i], messages[j] = messages[j], messages[i]
 	}
-	
+
+	nicknames := s.groupNicknames(chatID)
+	for i := range messages {
+		messages[i].SenderNick = nicknames[messages[i].SenderID]
+	}
+	s.attachReactions(messages)
+
 	return messages, err
 }
 
-func (s *ChatService) CreateMessage(chatID, senderID uint, msgType, content, mediaURL string, replyToID *uint) (*models.Message, error) {
+// messageSearchMatch matches message content against a plain-text query. It
+// uses the same expression as the idx_messages_content_search index; the
+// simple configuration lowercases words without language-specific stemming.
+const messageSearchMatch = "to_tsvector('simple', messages.content) @@ plainto_tsquery('simple', ?)"
+
+// SearchMessages finds messages in the chat whose content matches the query,
+// newest first.
+func (s *ChatService) SearchMessages(chatID, userID uint, query string, limit, offset int) ([]MessageSearchResult, error) {
+	if !s.IsChatMember(chatID, userID) {
+		return nil, errors.New("not a member of this chat")
+	}
+
+	var messages []models.Message
+	err := s.db.Preload("Sender").
+		Where("messages.chat_id = ?", chatID).
+		Where(messageSearchMatch, query).
+		Where("messages.deleted = ? AND messages.id NOT IN (?)", false, s.hiddenMessageIDs(userID)).
+		Order("messages.created_at DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]MessageSearchResult, len(messages))
+	if len(messages) == 0 {
+		return results, nil
+	}
+	s.attachReactions(messages)
+
+	ids := make([]uint, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+
+	// Neighbours follow the main conversation, so thread replies are skipped
+	var neighbours []struct {
+		ID     uint
+		PrevID *uint
+		NextID *uint
+	}
+	s.db.Raw(`SELECT id, prev_id, next_id FROM (
+			SELECT id,
+				LAG(id) OVER (ORDER BY created_at, id) AS prev_id,
+				LEAD(id) OVER (ORDER BY created_at, id) AS next_id
+			FROM messages
+			WHERE chat_id = ? AND thread_root_id IS NULL AND deleted_at IS NULL
+		) ordered WHERE id IN ?`, chatID, ids).
+		Scan(&neighbours)
+
+	position := make(map[uint]int, len(neighbours))
+	for i, n := range neighbours {
+		position[n.ID] = i
+	}
+
+	nicknames := s.groupNicknames(chatID)
+	for i, m := range messages {
+		m.SenderNick = nicknames[m.SenderID]
+		results[i].Message = m
+		if j, ok := position[m.ID]; ok {
+			results[i].PrevMessageID = neighbours[j].PrevID
+			results[i].NextMessageID = neighbours[j].NextID
+		}
+	}
+
+	return results, nil
+}
+
+// SearchAllMessages searches every chat the user belongs to. The page is
+// taken over matching messages by recency, then grouped by chat, with the
+// chat holding the newest match first.
+func (s *ChatService) SearchAllMessages(userID uint, query string, limit, offset int) ([]ChatSearchResult, error) {
+	var messages []models.Message
+	err := s.db.Preload("Sender").
+		Where("messages.chat_id IN (?)", s.userChatIDs(userID)).
+		Where(messageSearchMatch, query).
+		Where("messages.deleted = ? AND messages.id NOT IN (?)", false, s.hiddenMessageIDs(userID)).
+		Order("messages.created_at DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&messages).Error
+	if err != nil {
+		return nil, err
+	}
+
+	results := []ChatSearchResult{}
+	if len(messages) == 0 {
+		return results, nil
+	}
+	s.attachReactions(messages)
+
+	index := make(map[uint]int)
+	var chatIDs []uint
+	for _, m := range messages {
+		i, ok := index[m.ChatID]
+		if !ok {
+			i = len(results)
+			index[m.ChatID] = i
+			chatIDs = append(chatIDs, m.ChatID)
+			results = append(results, ChatSearchResult{Chat: models.Chat{ID: m.ChatID}})
+		}
+		results[i].Messages = append(results[i].Messages, m)
+	}
+
+	var chats []models.Chat
+	if err := s.db.Preload("LastMessage").Where("id IN ?", chatIDs).Find(&chats).Error; err != nil {
+		return nil, err
+	}
+	for _, chat := range chats {
+		results[index[chat.ID]].Chat = chat
+	}
+
+	for i := range results {
+		nicknames := s.groupNicknames(results[i].Chat.ID)
+		for j := range results[i].Messages {
+			results[i].Messages[j].SenderNick = nicknames[results[i].Messages[j].SenderID]
+		}
+	}
+
+	return results, nil
+}
+
+// mediaIDForURL finds the upload a message's media URL points at, so
+// recipients can ask for a signed link to it. URLs that aren't uploads
+// return nil.
+func (s *ChatService) mediaIDForURL(mediaURL string) *uint {
+	if mediaURL == "" {
+		return nil
+	}
+	var media models.Media
+	if err := s.db.Select("id").Where("url = ?", mediaURL).First(&media).Error; err != nil {
+		return nil
+	}
+	return &media.ID
+}
+
+// CreateMessage stores a message from a chat member. System messages come
+// from platform admins, who needn't belong to the chat, so they skip the
+// membership and block checks. Location and contact messages carry their
+// payload in location and contact, which must be nil for every other type.
+func (s *ChatService) CreateMessage(chatID, senderID uint, msgType, content, mediaURL string, replyToID, threadRootID, eventID *uint, location *Location, contact *Contact) (*models.Message, error) {
+	if msgType != "system" && !s.IsChatMember(chatID, senderID) {
+		return nil, ErrNotChatMember
+	}
+
+	if limit := s.messageLengthLimit(chatID); limit > 0 && utf8.RuneCountInString(content) > limit {
+		return nil, &MessageTooLongError{Limit: limit}
+	}
+
+	if err := s.checkGroupPostingRules(chatID, senderID, msgType); err != nil {
+		return nil, err
+	}
+
+	if msgType != "system" {
+		if err := s.checkPrivateChatBlock(chatID, senderID); err != nil {
+			return nil, err
+		}
+	}
+
+	if (msgType == "event") != (eventID != nil) {
+		return nil, ErrInvalidEventMessage
+	}
+	if eventID != nil {
+		var count int64
+		s.db.Model(&models.Event{}).Where("id = ? AND user_id = ?", *eventID, senderID).Count(&count)
+		if count == 0 {
+			return nil, ErrInvalidEventMessage
+		}
+	}
+
+	if err := validateLocation(msgType, location); err != nil {
+		return nil, err
+	}
+	if err := validateContact(msgType, contact); err != nil {
+		return nil, err
+	}
+
+	if threadRootID != nil {
+		var root models.Message
+		if err := s.db.First(&root, *threadRootID).Error; err != nil {
+			return nil, errors.New("thread root message not found")
+		}
+		if root.ChatID != chatID {
+			return nil, errors.New("thread root belongs to a different chat")
+		}
+		// Replies to a reply join the original thread
+		if root.ThreadRootID != nil {
+			threadRootID = root.ThreadRootID
+		}
+	}
+
 	message := &models.Message{
-		ChatID:    chatID,
-		SenderID:  senderID,
-		Type:      msgType,
-		Content:   content,
-		MediaURL:  mediaURL,
-		Status:    "sent",
-		ReplyToID: replyToID,
+		ChatID:       chatID,
+		SenderID:     senderID,
+		Type:         msgType,
+		Content:      content,
+		MediaURL:     mediaURL,
+		ThumbnailURL: thumbnailURL(msgType, mediaURL),
+		MediaID:      s.mediaIDForURL(mediaURL),
+		Status:       "sent",
+		ReplyToID:    replyToID,
+		ThreadRootID: threadRootID,
+		EventID:      eventID,
+	}
+	if location != nil {
+		message.Latitude = location.Latitude
+		message.Longitude = location.Longitude
+		message.LocationLabel = location.Label
+	}
+	if contact != nil {
+		message.ContactName = strings.TrimSpace(contact.Name)
+		message.ContactPhone = strings.TrimSpace(contact.Phone)
+		message.ContactUserID = s.contactUserID(message.ContactPhone, senderID)
+	}
+	if msgType != "system" {
+		message.Mentions = s.resolveMentions(chatID, senderID, content)
 	}
 
 	if err := s.db.Create(message).Error; err != nil {
 		return nil, err
 	}
 
+	if threadRootID != nil {
+		s.db.Model(&models.Message{}).Where("id = ?", *threadRootID).Updates(map[string]interface{}{
+			"reply_count":   gorm.Expr("reply_count + 1"),
+			"last_reply_at": message.CreatedAt,
+		})
+	}
+
 	// Update chat's last message
 	s.db.Model(&models.Chat{}).Where("id = ?", chatID).Updates(map[string]interface{}{
 		"last_message_id": message.ID,
 		"updated_at":      time.Now(),
 	})
 
+	// A new message brings an archived chat back to everyone's main list;
+	// system notices aren't worth resurfacing it for
+	if msgType != "system" {
+		s.db.Where("chat_id = ?", chatID).Delete(&models.ChatArchive{})
+	}
+
 	// Preload sender info
-	s.db.Preload("Sender").First(message, message.ID)
+	s.db.Preload("Sender").Preload("Event").Preload("Mentions").First(message, message.ID)
+	message.SenderNick = s.groupNicknames(chatID)[senderID]
 
 	return message, nil
 }
 
-func (s *ChatService) UpdateMessageStatus(messageID, userID uint, status string) error {
-	// Update message status
-	if err := s.db.Model(&models.Message{}).
-		Where("id = ? AND sender_id != ?", messageID, userID).
-		Update("status", status).Error; err != nil {
-		return err
+// validateLocation checks that location messages, and only they, carry
+// coordinates within range.
+func validateLocation(msgType string, location *Location) error {
+	if msgType != "location" {
+		if location != nil {
+			return fmt.Errorf("%w: only location messages can carry coordinates", ErrInvalidLocation)
+		}
+		return nil
 	}
 
-	// Create or update message status record
-	messageStatus := &models.MessageStatus{
-		MessageID: messageID,
-		UserID:    userID,
-		Status:    status,
-		Timestamp: time.Now(),
+	if location == nil || location.Latitude == nil || location.Longitude == nil {
+		return fmt.Errorf("%w: latitude and longitude are required", ErrInvalidLocation)
 	}
-
-	return s.db.Create(messageStatus).Error
+	if lat := *location.Latitude; math.IsNaN(lat) || lat < -90 || lat > 90 {
+		return fmt.Errorf("%w: latitude must be between -90 and 90", ErrInvalidLocation)
+	}
+	if lng := *location.Longitude; math.IsNaN(lng) || lng < -180 || lng > 180 {
+		return fmt.Errorf("%w: longitude must be between -180 and 180", ErrInvalidLocation)
+	}
+	return nil
 }
 
-func (s *ChatService) DeleteMessage(messageID, userID uint) error {
-	var message models.Message
-	if err := s.db.First(&message, messageID).Error; err != nil {
-		return err
+// validateContact checks that contact messages, and only they, carry a
+// name and a plausible phone number: 5 to 15 digits, optionally written
+// with +, spaces, dots, dashes and parentheses.
+func validateContact(msgType string, contact *Contact) error {
+	if msgType != "contact" {
+		if contact != nil {
+			return fmt.Errorf("%w: only contact messages can carry a contact", ErrInvalidContact)
+		}
+		return nil
 	}
 
-	if message.SenderID != userID {
-		return errors.New("unauthorized to delete this message")
+	if contact == nil {
+		return fmt.Errorf("%w: contact_name and contact_phone are required", ErrInvalidContact)
+	}
+	name := strings.TrimSpace(contact.Name)
+	if name == "" {
+		return fmt.Errorf("%w: contact_name is required", ErrInvalidContact)
+	}
+	if utf8.RuneCountInString(name) > maxContactNameLength {
+		return fmt.Errorf("%w: contact_name can be at most %d characters", ErrInvalidContact, maxContactNameLength)
+	}
+
+	digits := 0
+	for _, r := range strings.TrimSpace(contact.Phone) {
+		switch {
+		case r >= '0' && r <= '9':
+			digits++
+		case strings.ContainsRune("+ .-()", r):
+		default:
+			return fmt.Errorf("%w: contact_phone contains invalid characters", ErrInvalidContact)
+		}
 	}
+	if digits < 5 || digits > 15 {
+		return fmt.Errorf("%w: contact_phone must have between 5 and 15 digits", ErrInvalidContact)
+	}
+	return nil
+}
 
-	return s.db.Delete(&message).Error
+// contactUserID finds the registered user with the shared phone number, so
+// recipients can start a chat with them. Numbers are compared on their
+// digits only, as in contact matching, and users who blocked the sender
+// aren't revealed. Only users the sender already shares a chat with are
+// resolved, so contact messages can't be used to find out whether a number
+// is registered without going through rate-limited contact matching.
+func (s *ChatService) contactUserID(phone string, senderID uint) *uint {
+	var user models.User
+	err := s.db.Select("id").
+		Where("regexp_replace(phone, '[^0-9]', '', 'g') = ?", normalizePhoneDigits(phone)).
+		Where("id NOT IN (?)", s.db.Model(&models.BlockedUser{}).Select("user_id").Where("blocked_id = ?", senderID)).
+		First(&user).Error
+	if err != nil {
+		return nil
+	}
+	if user.ID == senderID {
+		return &user.ID
+	}
+	partners, err := chatPartners(s.db, senderID, []uint{user.ID})
+	if err != nil || len(partners) == 0 {
+		return nil
+	}
+	return &user.ID
 }
 
-func (s *ChatService) GetChatByID(chatID uint) (*models.Chat, error) {
-	var chat models.Chat
-	if err := s.db.Preload("LastMessage").First(&chat, chatID).Error; err != nil {
+// GetThreadMessages returns the replies in a message's thread, oldest first.
+func (s *ChatService) GetThreadMessages(rootID, userID uint, limit, offset int) ([]models.Message, error) {
+	var root models.Message
+	if err := s.db.First(&root, rootID).Error; err != nil {
 		return nil, err
 	}
-	return &chat, nil
+
+	if !s.IsChatMember(root.ChatID, userID) {
+		return nil, errors.New("not a member of this chat")
+	}
+
+	var messages []models.Message
+	err := s.db.Preload("Sender").
+		Preload("Event").
+		Preload("Mentions").
+		Where("thread_root_id = ?", rootID).
+		Where("id NOT IN (?)", s.hiddenMessageIDs(userID)).
+		Order("created_at ASC").
+		Limit(limit).
+		Offset(offset).
+		Find(&messages).Error
+
+	nicknames := s.groupNicknames(root.ChatID)
+	for i := range messages {
+		messages[i].SenderNick = nicknames[messages[i].SenderID]
+	}
+	s.attachReactions(messages)
+
+	return messages, err
 }
 
-func (s *ChatService) GetMessageByID(messageID uint) (*models.Message, error) {
+// ErrInvalidMessageStatus is returned for a receipt status other than
+// delivered or read.
+var ErrInvalidMessageStatus = errors.New("status must be delivered or read")
+
+// UpdateMessageStatus records that a member of the message's chat received
+// or read it, and returns the message so the sender can be told. Statuses
+// only move forward, so a late delivered receipt never undoes a read one.
+// Receipts for the user's own messages are ignored.
+func (s *ChatService) UpdateMessageStatus(messageID, userID uint, status string) (*models.Message, error) {
+	if status != "delivered" && status != "read" {
+		return nil, ErrInvalidMessageStatus
+	}
+
 	var message models.Message
-	if err := s.db.Preload("Sender").First(&message, messageID).Error; err != nil {
+	if err := s.db.Select("id", "chat_id", "sender_id").First(&message, messageID).Error; err != nil {
+		return nil, err
+	}
+	if !s.IsChatMember(message.ChatID, userID) {
+		return nil, ErrNotChatMember
+	}
+	if message.SenderID == userID {
+		return &message, nil
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		// The message's own status is the furthest any recipient has got
+		earlier := []string{"sent", "delivered"}
+		if status == "delivered" {
+			earlier = []string{"sent"}
+		}
+		if err := tx.Model(&models.Message{}).
+			Where("id = ? AND status IN ?", messageID, earlier).
+			Update("status", status).Error; err != nil {
+			return err
+		}
+
+		return upsertMessageStatuses(tx, []models.MessageStatus{{
+			MessageID: messageID,
+			UserID:    userID,
+			Status:    status,
+			Timestamp: time.Now(),
+		}})
+	})
+	if err != nil {
 		return nil, err
 	}
 	return &message, nil
 }
+
+// upsertMessageStatuses records recipients' statuses, replacing their
+// earlier status for the same message unless that one is already read.
+func upsertMessageStatuses(db *gorm.DB, statuses []models.MessageStatus) error {
+	return db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "message_id"}, {Name: "user_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"status", "timestamp"}),
+		Where: clause.Where{Exprs: []clause.Expression{
+			clause.Expr{SQL: "message_statuses.status <> ?", Vars: []interface{}{"read"}},
+		}},
+	}).CreateInBatches(statuses, 500).Error
+}
+
+// readBy is a subquery, correlated with the messages table, that finds the
+// user's read status for each message. Read state is per recipient; the
+// message's own status only tells the sender how far it has got.
+func (s *ChatService) readBy(userID uint) *gorm.DB {
+	return s.db.Model(&models.MessageStatus{}).
+		Select("1").
+		Where("message_statuses.message_id = messages.id AND message_statuses.user_id = ? AND message_statuses.status = ?", userID, "read")
+}
+
+// MarkAllChatsRead marks every unread message sent to the user, across all
+// of their chats, as read.
+func (s *ChatService) MarkAllChatsRead(userID uint) ([]ChatReadReceipt, error) {
+	return s.markRead(userID, s.userChatIDs(userID))
+}
+
+// MarkChatRead marks every unread message sent to the user in one chat as
+// read. The receipt's LastMessageID is 0 if nothing was unread.
+func (s *ChatService) MarkChatRead(chatID, userID uint) (*ChatReadReceipt, error) {
+	if !s.IsChatMember(chatID, userID) {
+		return nil, ErrNotChatMember
+	}
+
+	receipts, err := s.markRead(userID, []uint{chatID})
+	if err != nil {
+		return nil, err
+	}
+	if len(receipts) == 0 {
+		return &ChatReadReceipt{ChatID: chatID}, nil
+	}
+	return &receipts[0], nil
+}
+
+// markRead marks the messages sent to the user in chatIDs, a list or
+// subquery of chat IDs, that the user hasn't read yet as read, and returns
+// a receipt per chat touched.
+func (s *ChatService) markRead(userID uint, chatIDs interface{}) ([]ChatReadReceipt, error) {
+	var unread []models.Message
+	if err := s.db.Select("id", "chat_id", "sender_id").
+		Where("chat_id IN (?) AND sender_id != ?", chatIDs, userID).
+		Where("NOT EXISTS (?)", s.readBy(userID)).
+		Order("id ASC").
+		Find(&unread).Error; err != nil {
+		return nil, err
+	}
+
+	if len(unread) == 0 {
+		return []ChatReadReceipt{}, nil
+	}
+
+	now := time.Now()
+	ids := make([]uint, 0, len(unread))
+	statuses := make([]models.MessageStatus, 0, len(unread))
+	receipts := make(map[uint]*ChatReadReceipt)
+	var order []uint
+	for _, m := range unread {
+		ids = append(ids, m.ID)
+		statuses = append(statuses, models.MessageStatus{
+			MessageID: m.ID,
+			UserID:    userID,
+			Status:    "read",
+			Timestamp: now,
+		})
+
+		r, ok := receipts[m.ChatID]
+		if !ok {
+			r = &ChatReadReceipt{ChatID: m.ChatID}
+			receipts[m.ChatID] = r
+			order = append(order, m.ChatID)
+		}
+		r.LastMessageID = m.ID
+		if !containsUint(r.SenderIDs, m.SenderID) {
+			r.SenderIDs = append(r.SenderIDs, m.SenderID)
+		}
+	}
+
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&models.Message{}).Where("id IN ? AND status <> ?", ids, "read").Update("status", "read").Error; err != nil {
+			return err
+		}
+		return upsertMessageStatuses(tx, statuses)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]ChatReadReceipt, 0, len(order))
+	for _, chatID := range order {
+		result = append(result, *receipts[chatID])
+	}
+	return result, nil
+}
+
+// DeleteMessage deletes a message in the given scope. DeleteForMe hides it
+// from the user's own view of the chat, and works on any message in a chat
+// they belong to. DeleteForEveryone is open to the sender within the delete
+// window, and to group admins for any message at any time: the message
+// keeps its place in the conversation, but its content is replaced with
+// MessageDeletedPlaceholder and its media, event, reactions and pin are dropped.
+func (s *ChatService) DeleteMessage(messageID, userID uint, scope string) error {
+	var message models.Message
+	if err := s.db.First(&message, messageID).Error; err != nil {
+		return err
+	}
+
+	switch scope {
+	case DeleteForMe:
+		if !s.IsChatMember(message.ChatID, userID) {
+			return errors.New("not a member of this chat")
+		}
+		return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.MessageHide{
+			UserID:    userID,
+			MessageID: messageID,
+		}).Error
+	case DeleteForEveryone:
+	default:
+		return ErrInvalidDeleteScope
+	}
+
+	if message.Type == "system" {
+		return errors.New("system messages cannot be deleted")
+	}
+
+	if !s.isGroupAdmin(message.ChatID, userID) {
+		if message.SenderID != userID {
+			return errors.New("unauthorized to delete this message")
+		}
+		if s.deleteWindow > 0 && time.Since(message.CreatedAt) > s.deleteWindow {
+			return ErrDeleteWindowPassed
+		}
+	}
+
+	if message.Deleted {
+		return nil
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&message).Updates(map[string]interface{}{
+			"deleted":         true,
+			"content":         MessageDeletedPlaceholder,
+			"media_url":       "",
+			"media_id":        nil,
+			"thumbnail_url":   "",
+			"event_id":        nil,
+			"latitude":        nil,
+			"longitude":       nil,
+			"location_label":  "",
+			"contact_name":    "",
+			"contact_phone":   "",
+			"contact_user_id": nil,
+			"is_pinned":       false,
+			"pinned_at":       nil,
+			"pinned_by_id":    nil,
+		}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id = ?", messageID).Delete(&models.MessageMention{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("message_id = ?", messageID).Delete(&models.MessageReaction{}).Error
+	})
+}
+
+// EditMessage replaces the content of the sender's own text message and
+// stamps EditedAt.
+func (s *ChatService) EditMessage(messageID, userID uint, newContent string) (*models.Message, error) {
+	var message models.Message
+	if err := s.db.First(&message, messageID).Error; err != nil {
+		return nil, err
+	}
+
+	if message.SenderID != userID {
+		return nil, ErrNotMessageSender
+	}
+
+	if message.Deleted {
+		return nil, ErrMessageDeleted
+	}
+
+	if message.Type != "text" {
+		return nil, ErrMessageNotEditable
+	}
+
+	if limit := s.messageLengthLimit(message.ChatID); limit > 0 && utf8.RuneCountInString(newContent) > limit {
+		return nil, &MessageTooLongError{Limit: limit}
+	}
+
+	now := time.Now()
+	if err := s.db.Model(&message).Updates(map[string]interface{}{
+		"content":   newContent,
+		"edited_at": now,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	s.db.Preload("Sender").First(&message, message.ID)
+	message.SenderNick = s.groupNicknames(message.ChatID)[message.SenderID]
+
+	return &message, nil
+}
+
+// AddReaction records the user's emoji reaction to a message and returns the
+// message with its updated reaction counts. Reacting twice with the same
+// emoji is a no-op.
+func (s *ChatService) AddReaction(messageID, userID uint, emoji string) (*models.Message, error) {
+	var message models.Message
+	if err := s.db.First(&message, messageID).Error; err != nil {
+		return nil, err
+	}
+
+	if !s.IsChatMember(message.ChatID, userID) {
+		return nil, errors.New("not a member of this chat")
+	}
+
+	if message.Deleted {
+		return nil, ErrMessageDeleted
+	}
+
+	reaction := &models.MessageReaction{
+		MessageID: messageID,
+		UserID:    userID,
+		Emoji:     emoji,
+	}
+	if err := s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(reaction).Error; err != nil {
+		return nil, err
+	}
+
+	message.Reactions = s.reactionCounts([]uint{messageID})[messageID]
+	return &message, nil
+}
+
+// RemoveReaction deletes the user's emoji reaction to a message and returns
+// the message with its updated reaction counts.
+func (s *ChatService) RemoveReaction(messageID, userID uint, emoji string) (*models.Message, error) {
+	var message models.Message
+	if err := s.db.First(&message, messageID).Error; err != nil {
+		return nil, err
+	}
+
+	if !s.IsChatMember(message.ChatID, userID) {
+		return nil, errors.New("not a member of this chat")
+	}
+
+	result := s.db.Where("message_id = ? AND user_id = ? AND emoji = ?", messageID, userID, emoji).
+		Delete(&models.MessageReaction{})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, gorm.ErrRecordNotFound
+	}
+
+	message.Reactions = s.reactionCounts([]uint{messageID})[messageID]
+	return &message, nil
+}
+
+// attachReactions fills in the reaction counts of each message.
+func (s *ChatService) attachReactions(messages []models.Message) {
+	if len(messages) == 0 {
+		return
+	}
+
+	ids := make([]uint, len(messages))
+	for i, m := range messages {
+		ids[i] = m.ID
+	}
+
+	counts := s.reactionCounts(ids)
+	for i := range messages {
+		messages[i].Reactions = counts[messages[i].ID]
+	}
+}
+
+// reactionCounts groups the reactions on the given messages by emoji, most
+// used first.
+func (s *ChatService) reactionCounts(messageIDs []uint) map[uint][]models.ReactionCount {
+	var rows []struct {
+		MessageID uint
+		Emoji     string
+		Count     int64
+	}
+	s.db.Model(&models.MessageReaction{}).
+		Select("message_id, emoji, COUNT(*) AS count, MIN(created_at) AS first_at").
+		Where("message_id IN ?", messageIDs).
+		Group("message_id, emoji").
+		Order("count DESC, first_at ASC").
+		Scan(&rows)
+
+	counts := make(map[uint][]models.ReactionCount)
+	for _, r := range rows {
+		counts[r.MessageID] = append(counts[r.MessageID], models.ReactionCount{Emoji: r.Emoji, Count: r.Count})
+	}
+	return counts
+}
+
+// PinMessage pins a message in a chat the user belongs to, recording who
+// pinned it and when. In groups, the user's role has to allow pinning.
+func (s *ChatService) PinMessage(messageID, userID uint) (*models.Message, error) {
+	var message models.Message
+	if err := s.db.First(&message, messageID).Error; err != nil {
+		return nil, err
+	}
+
+	if err := s.checkCanPin(message.ChatID, userID); err != nil {
+		return nil, err
+	}
+
+	if message.Deleted {
+		return nil, ErrMessageDeleted
+	}
+
+	now := time.Now()
+	if err := s.db.Model(&message).Updates(map[string]interface{}{
+		"is_pinned":    true,
+		"pinned_at":    now,
+		"pinned_by_id": userID,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	s.db.Preload("Sender").Preload("PinnedBy").First(&message, messageID)
+	return &message, nil
+}
+
+// UnpinMessage unpins a message, subject to the same rules as pinning it.
+func (s *ChatService) UnpinMessage(messageID, userID uint) (*models.Message, error) {
+	var message models.Message
+	if err := s.db.First(&message, messageID).Error; err != nil {
+		return nil, err
+	}
+
+	if err := s.checkCanPin(message.ChatID, userID); err != nil {
+		return nil, err
+	}
+
+	if err := s.db.Model(&message).Updates(map[string]interface{}{
+		"is_pinned":    false,
+		"pinned_at":    nil,
+		"pinned_by_id": nil,
+	}).Error; err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// checkCanPin requires the user to belong to the chat and, in a group, to
+// hold a role that may pin messages.
+func (s *ChatService) checkCanPin(chatID, userID uint) error {
+	if !s.IsChatMember(chatID, userID) {
+		return ErrNotChatMember
+	}
+
+	var chat models.Chat
+	if err := s.db.Select("type", "group_id").First(&chat, chatID).Error; err != nil {
+		return err
+	}
+	if chat.Type != "group" || chat.GroupID == nil {
+		return nil
+	}
+
+	var group models.Group
+	if err := s.db.Select("id", "announce_only").First(&group, *chat.GroupID).Error; err != nil {
+		return err
+	}
+	var member models.GroupMember
+	if err := s.db.Select("role").Where("group_id = ? AND user_id = ?", group.ID, userID).First(&member).Error; err != nil {
+		return err
+	}
+	if !canPin(member.Role, group.AnnounceOnly) {
+		return ErrPinNotAllowed
+	}
+	return nil
+}
+
+// canPin is the group pinning rule: admins can always pin, restricted
+// members never can, and members can unless only admins may post.
+func canPin(role string, announceOnly bool) bool {
+	return role == "admin" || (role != "restricted" && !announceOnly)
+}
+
+// GetPinnedMessages returns the pinned messages of a chat the user belongs
+// to, most recently pinned first, with the pinner's info.
+func (s *ChatService) GetPinnedMessages(chatID, userID uint) ([]models.Message, error) {
+	if !s.IsChatMember(chatID, userID) {
+		return nil, ErrNotChatMember
+	}
+
+	var messages []models.Message
+	err := s.db.Preload("Sender").
+		Preload("PinnedBy").
+		Where("chat_id = ? AND is_pinned = ?", chatID, true).
+		Order("pinned_at DESC").
+		Find(&messages).Error
+
+	return messages, err
+}
+
+func (s *ChatService) GetChatByID(chatID uint) (*models.Chat, error) {
+	var chat models.Chat
+	if err := s.db.Preload("LastMessage").First(&chat, chatID).Error; err != nil {
+		return nil, err
+	}
+	return &chat, nil
+}
+
+func (s *ChatService) GetMessageByID(messageID uint) (*models.Message, error) {
+	var message models.Message
+	if err := s.db.Preload("Sender").First(&message, messageID).Error; err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// SnoozeChat hides the chat for the user until remindAt, replacing any
+// existing snooze.
+func (s *ChatService) SnoozeChat(chatID, userID uint, remindAt time.Time) (*models.ChatSnooze, error) {
+	if !remindAt.After(time.Now()) {
+		return nil, errors.New("remind_at must be in the future")
+	}
+
+	if !s.IsChatMember(chatID, userID) {
+		return nil, errors.New("not a member of this chat")
+	}
+
+	snooze := &models.ChatSnooze{
+		UserID:   userID,
+		ChatID:   chatID,
+		RemindAt: remindAt,
+	}
+
+	err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "chat_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"remind_at"}),
+	}).Create(snooze).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return snooze, nil
+}
+
+// MuteChat silences push notifications from the chat for the user until
+// the given time, or indefinitely when until is nil. Muting again replaces
+// the previous mute.
+func (s *ChatService) MuteChat(chatID, userID uint, until *time.Time) (*models.ChatMute, error) {
+	if until != nil && !until.After(time.Now()) {
+		return nil, errors.New("until must be in the future")
+	}
+
+	if !s.IsChatMember(chatID, userID) {
+		return nil, errors.New("not a member of this chat")
+	}
+
+	mute := &models.ChatMute{
+		UserID:     userID,
+		ChatID:     chatID,
+		MutedUntil: until,
+	}
+
+	err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "chat_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"muted_until"}),
+	}).Create(mute).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return mute, nil
+}
+
+// UnmuteChat lifts the user's mute on the chat, if any.
+func (s *ChatService) UnmuteChat(chatID, userID uint) error {
+	return s.db.Where("user_id = ? AND chat_id = ?", userID, chatID).Delete(&models.ChatMute{}).Error
+}
+
+// GetDraft returns the user's draft for the chat, or nil if they have none.
+func (s *ChatService) GetDraft(chatID, userID uint) (*models.ChatDraft, error) {
+	if !s.IsChatMember(chatID, userID) {
+		return nil, ErrNotChatMember
+	}
+
+	var draft models.ChatDraft
+	err := s.db.Where("user_id = ? AND chat_id = ?", userID, chatID).First(&draft).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &draft, nil
+}
+
+// SaveDraft stores the user's draft for the chat, replacing any earlier
+// one. An empty or blank draft deletes it and returns nil. Drafts are held
+// to the same length limit as messages in the chat.
+func (s *ChatService) SaveDraft(chatID, userID uint, content string) (*models.ChatDraft, error) {
+	if !s.IsChatMember(chatID, userID) {
+		return nil, ErrNotChatMember
+	}
+
+	if strings.TrimSpace(content) == "" {
+		err := s.db.Where("user_id = ? AND chat_id = ?", userID, chatID).Delete(&models.ChatDraft{}).Error
+		return nil, err
+	}
+
+	if limit := s.messageLengthLimit(chatID); limit > 0 && utf8.RuneCountInString(content) > limit {
+		return nil, &MessageTooLongError{Limit: limit}
+	}
+
+	draft := &models.ChatDraft{
+		UserID:  userID,
+		ChatID:  chatID,
+		Content: content,
+	}
+	err := s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "chat_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"content", "updated_at"}),
+	}).Create(draft).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return draft, nil
+}
+
+// GetNotificationSetting returns the user's notification preferences for a
+// chat, or the defaults if they haven't set any.
+func (s *ChatService) GetNotificationSetting(chatID, userID uint) (*models.ChatNotificationSetting, error) {
+	if !s.IsChatMember(chatID, userID) {
+		return nil, errors.New("not a member of this chat")
+	}
+
+	setting := &models.ChatNotificationSetting{UserID: userID, ChatID: chatID}
+	err := s.db.Where("user_id = ? AND chat_id = ?", userID, chatID).First(setting).Error
+	if err != nil && err != gorm.ErrRecordNotFound {
+		return nil, err
+	}
+
+	return setting, nil
+}
+
+// UpdateNotificationSetting changes the given fields of the user's
+// notification preferences for a chat; nil fields are left as they are.
+func (s *ChatService) UpdateNotificationSetting(chatID, userID uint, sound, customName *string, muted *bool) (*models.ChatNotificationSetting, error) {
+	setting, err := s.GetNotificationSetting(chatID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if sound != nil {
+		setting.Sound = *sound
+	}
+	if customName != nil {
+		setting.CustomName = *customName
+	}
+	if muted != nil {
+		setting.Muted = *muted
+	}
+
+	err = s.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "chat_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"sound", "custom_name", "muted", "updated_at"}),
+	}).Create(setting).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return setting, nil
+}
+
+// StartSnoozeScheduler periodically hands due snoozes to remind and removes
+// them.
+func (s *ChatService) StartSnoozeScheduler(interval time.Duration, remind func(snooze models.ChatSnooze)) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			var due []models.ChatSnooze
+			if err := s.db.Where("remind_at <= ?", time.Now()).Find(&due).Error; err != nil {
+				log.Printf("Failed to load due chat snoozes: %v", err)
+				continue
+			}
+			for _, snooze := range due {
+				remind(snooze)
+				s.db.Delete(&snooze)
+			}
+		}
+	}()
+}
+
+func (s *ChatService) GetChatPermissions(chatID, userID uint) (*ChatPermissions, error) {
+	var chat models.Chat
+	if err := s.db.First(&chat, chatID).Error; err != nil {
+		return nil, err
+	}
+
+	if !s.IsChatMember(chatID, userID) {
+		return nil, errors.New("not a member of this chat")
+	}
+
+	if chat.Type == "private" {
+		return &ChatPermissions{CanPost: true, CanPin: true}, nil
+	}
+
+	var group models.Group
+	if err := s.db.First(&group, *chat.GroupID).Error; err != nil {
+		return nil, err
+	}
+
+	var member models.GroupMember
+	s.db.Where("group_id = ? AND user_id = ?", group.ID, userID).First(&member)
+	isAdmin := member.Role == "admin"
+	isRestricted := member.Role == "restricted"
+
+	return &ChatPermissions{
+		CanPost:         (!group.AnnounceOnly || isAdmin) && !isRestricted,
+		CanPin:          canPin(member.Role, group.AnnounceOnly),
+		CanAddMembers:   isAdmin,
+		IsAdmin:         isAdmin,
+		AnnounceOnly:    group.AnnounceOnly,
+		SlowModeSeconds: group.SlowModeSeconds,
+	}, nil
+}
+
+// checkGroupPostingRules enforces announce-only and slow mode for group
+// chats. Admins and system messages are exempt.
+func (s *ChatService) checkGroupPostingRules(chatID, senderID uint, msgType string) error {
+	if msgType == "system" {
+		return nil
+	}
+
+	var chat models.Chat
+	if err := s.db.Select("type", "group_id").First(&chat, chatID).Error; err != nil || chat.Type != "group" || chat.GroupID == nil {
+		return nil
+	}
+
+	var group models.Group
+	if err := s.db.First(&group, *chat.GroupID).Error; err != nil {
+		return nil
+	}
+
+	var member models.GroupMember
+	s.db.Where("group_id = ? AND user_id = ?", group.ID, senderID).First(&member)
+	if member.Role == "admin" {
+		return nil
+	}
+
+	if member.Role == "restricted" {
+		return ErrRestrictedMember
+	}
+
+	if group.AnnounceOnly {
+		return ErrAnnounceOnly
+	}
+
+	if group.SlowModeSeconds > 0 {
+		var last models.Message
+		err := s.db.Where("chat_id = ? AND sender_id = ?", chatID, senderID).
+			Order("created_at DESC").
+			First(&last).Error
+		if err == nil {
+			next := last.CreatedAt.Add(time.Duration(group.SlowModeSeconds) * time.Second)
+			if wait := time.Until(next); wait > 0 {
+				return &SlowModeError{RetryAfter: int(wait.Seconds()) + 1}
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkPrivateChatBlock rejects messages in a private chat when either side
+// has blocked the other. The chat itself stays usable for reading.
+func (s *ChatService) checkPrivateChatBlock(chatID, senderID uint) error {
+	var chat models.Chat
+	if err := s.db.Select("id", "type", "user1_id", "user2_id").First(&chat, chatID).Error; err != nil {
+		return err
+	}
+	if chat.Type != "private" || chat.User1ID == nil || chat.User2ID == nil {
+		return nil
+	}
+
+	otherID := *chat.User1ID
+	if otherID == senderID {
+		otherID = *chat.User2ID
+	}
+	if blockedBetween(s.db, senderID, otherID) {
+		return ErrBlocked
+	}
+	return nil
+}
+
+// PinChat pins the chat to the top of the user's list, after any chats
+// already pinned.
+func (s *ChatService) PinChat(chatID, userID uint) error {
+	if !s.IsChatMember(chatID, userID) {
+		return errors.New("not a member of this chat")
+	}
+
+	var existing int64
+	s.db.Model(&models.ChatPin{}).Where("user_id = ? AND chat_id = ?", userID, chatID).Count(&existing)
+	if existing > 0 {
+		return nil
+	}
+
+	var count int64
+	s.db.Model(&models.ChatPin{}).Where("user_id = ?", userID).Count(&count)
+	if s.maxPinnedChats > 0 && count >= int64(s.maxPinnedChats) {
+		return fmt.Errorf("you can pin at most %d chats", s.maxPinnedChats)
+	}
+
+	var maxPosition *int
+	s.db.Model(&models.ChatPin{}).Where("user_id = ?", userID).Select("MAX(position)").Scan(&maxPosition)
+	position := 0
+	if maxPosition != nil {
+		position = *maxPosition + 1
+	}
+
+	// Pinned chats belong in the main list
+	s.db.Where("user_id = ? AND chat_id = ?", userID, chatID).Delete(&models.ChatArchive{})
+
+	return s.db.Create(&models.ChatPin{
+		UserID:   userID,
+		ChatID:   chatID,
+		Position: position,
+	}).Error
+}
+
+func (s *ChatService) UnpinChat(chatID, userID uint) error {
+	return s.db.Where("user_id = ? AND chat_id = ?", userID, chatID).Delete(&models.ChatPin{}).Error
+}
+
+// ArchiveChat hides the chat from the user's main chat list. Archived chats
+// can't stay pinned, so the chat is unpinned too. Other participants are
+// unaffected.
+func (s *ChatService) ArchiveChat(chatID, userID uint) error {
+	if !s.IsChatMember(chatID, userID) {
+		return errors.New("not a member of this chat")
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ? AND chat_id = ?", userID, chatID).Delete(&models.ChatPin{}).Error; err != nil {
+			return err
+		}
+		return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.ChatArchive{
+			UserID: userID,
+			ChatID: chatID,
+		}).Error
+	})
+}
+
+// UnarchiveChat returns the chat to the user's main chat list.
+func (s *ChatService) UnarchiveChat(chatID, userID uint) error {
+	return s.db.Where("user_id = ? AND chat_id = ?", userID, chatID).Delete(&models.ChatArchive{}).Error
+}
+
+// ReorderPinnedChats sets pin positions to match orderedChatIDs, which must
+// list exactly the user's pinned chats.
+func (s *ChatService) ReorderPinnedChats(userID uint, orderedChatIDs []uint) error {
+	var pins []models.ChatPin
+	if err := s.db.Where("user_id = ?", userID).Find(&pins).Error; err != nil {
+		return err
+	}
+
+	if len(pins) != len(orderedChatIDs) {
+		return errors.New("chat_ids must list every pinned chat exactly once")
+	}
+	pinned := make(map[uint]bool, len(pins))
+	for _, pin := range pins {
+		pinned[pin.ChatID] = true
+	}
+	for _, chatID := range orderedChatIDs {
+		if !pinned[chatID] {
+			return errors.New("chat_ids must list every pinned chat exactly once")
+		}
+		delete(pinned, chatID)
+	}
+
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		for position, chatID := range orderedChatIDs {
+			if err := tx.Model(&models.ChatPin{}).
+				Where("user_id = ? AND chat_id = ?", userID, chatID).
+				Update("position", position).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// messageLengthLimit returns the group's override for group chats, falling
+// back to the global limit. Overrides never raise the limit, even if one
+// was stored before the global limit was lowered.
+func (s *ChatService) messageLengthLimit(chatID uint) int {
+	var chat models.Chat
+	if err := s.db.Select("type", "group_id").First(&chat, chatID).Error; err != nil {
+		return s.maxMessageLength
+	}
+
+	if chat.Type == "group" && chat.GroupID != nil {
+		var group models.Group
+		if err := s.db.Select("max_message_length").First(&group, *chat.GroupID).Error; err == nil &&
+			group.MaxMessageLength > 0 && group.MaxMessageLength < s.maxMessageLength {
+			return group.MaxMessageLength
+		}
+	}
+
+	return s.maxMessageLength
+}
+
+// userChatIDs is a subquery selecting the IDs of every chat the user
+// participates in, private or group.
+func (s *ChatService) userChatIDs(userID uint) *gorm.DB {
+	return s.db.Model(&models.Chat{}).
+		Select("id").
+		Where("(type = ? AND (user1_id = ? OR user2_id = ?)) OR (type = ? AND group_id IN (?))",
+			"private", userID, userID,
+			"group", s.db.Model(&models.GroupMember{}).Select("group_id").Where("user_id = ?", userID))
+}
+
+// isGroupAdmin reports whether the chat is a group the user administers.
+func (s *ChatService) isGroupAdmin(chatID, userID uint) bool {
+	var count int64
+	s.db.Model(&models.GroupMember{}).
+		Joins("JOIN chats ON chats.group_id = group_members.group_id").
+		Where("chats.id = ? AND chats.type = ? AND group_members.user_id = ? AND group_members.role = ?",
+			chatID, "group", userID, "admin").
+		Count(&count)
+	return count > 0
+}
+
+// hiddenMessageIDs is a subquery for the messages the user deleted for
+// themselves.
+func (s *ChatService) hiddenMessageIDs(userID uint) *gorm.DB {
+	return s.db.Model(&models.MessageHide{}).Select("message_id").Where("user_id = ?", userID)
+}
+
+// GetUserChatIDs returns the IDs of every chat the user belongs to.
+func (s *ChatService) GetUserChatIDs(userID uint) ([]uint, error) {
+	var chatIDs []uint
+	err := s.userChatIDs(userID).Pluck("id", &chatIDs).Error
+	return chatIDs, err
+}
+
+func containsUint(values []uint, v uint) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// groupNicknames maps user IDs to their nicknames when chatID is a group
+// chat. Members without a nickname are left out.
+func (s *ChatService) groupNicknames(chatID uint) map[uint]string {
+	var chat models.Chat
+	if err := s.db.Select("id", "group_id").First(&chat, chatID).Error; err != nil || chat.GroupID == nil {
+		return nil
+	}
+
+	var members []models.GroupMember
+	s.db.Select("user_id", "nickname").
+		Where("group_id = ? AND nickname <> ?", *chat.GroupID, "").
+		Find(&members)
+
+	nicknames := make(map[uint]string, len(members))
+	for _, m := range members {
+		nicknames[m.UserID] = m.Nickname
+	}
+	return nicknames
+}
+
+// GetChatMemberIDs returns the users who belong to a chat: both participants
+// of a private chat, or every member of a group chat's group.
+func (s *ChatService) GetChatMemberIDs(chatID uint) ([]uint, error) {
+	var chat models.Chat
+	if err := s.db.First(&chat, chatID).Error; err != nil {
+		return nil, err
+	}
+
+	if chat.Type == "private" {
+		var ids []uint
+		if chat.User1ID != nil {
+			ids = append(ids, *chat.User1ID)
+		}
+		if chat.User2ID != nil {
+			ids = append(ids, *chat.User2ID)
+		}
+		return ids, nil
+	}
+
+	if chat.GroupID == nil {
+		return nil, nil
+	}
+
+	var ids []uint
+	err := s.db.Model(&models.GroupMember{}).
+		Where("group_id = ?", *chat.GroupID).
+		Pluck("user_id", &ids).Error
+	return ids, err
+}
+
+// IsChatMember reports whether the user participates in the chat: either side
+// of a private chat, or a member of the group behind a group chat.
+func (s *ChatService) IsChatMember(chatID, userID uint) bool {
+	var chat models.Chat
+	if err := s.db.First(&chat, chatID).Error; err != nil {
+		return false
+	}
+
+	if chat.Type == "private" {
+		return (chat.User1ID != nil && *chat.User1ID == userID) ||
+			(chat.User2ID != nil && *chat.User2ID == userID)
+	}
+
+	if chat.GroupID == nil {
+		return false
+	}
+
+	var count int64
+	s.db.Model(&models.GroupMember{}).
+		Where("group_id = ? AND user_id = ?", *chat.GroupID, userID).
+		Count(&count)
+	return count > 0
+}
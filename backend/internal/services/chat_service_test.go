@@ -0,0 +1,120 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+	"onechat/internal/database"
+	"onechat/internal/models"
+)
+
+// testDB returns a transaction on the database in TEST_DATABASE_URL that is
+// rolled back when the test ends. Tests that need it are skipped when the
+// variable isn't set.
+func testDB(t *testing.T) *gorm.DB {
+	t.Helper()
+
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+	db, err := database.InitDB(url, database.PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := database.AutoMigrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	tx := db.Begin()
+	t.Cleanup(func() {
+		tx.Rollback()
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return tx
+}
+
+func createTestUser(t *testing.T, db *gorm.DB, name string) *models.User {
+	t.Helper()
+
+	user := &models.User{
+		Phone:    fmt.Sprintf("+1555%07d", time.Now().UnixNano()%10000000),
+		Username: fmt.Sprintf("%s_%d", name, time.Now().UnixNano()),
+		Password: "hash",
+	}
+	if err := db.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestCreateMessageRequiresMembership(t *testing.T) {
+	db := testDB(t)
+	service := NewChatService(db, 4096, 5, 0)
+
+	alice := createTestUser(t, db, "alice")
+	bob := createTestUser(t, db, "bob")
+	mallory := createTestUser(t, db, "mallory")
+
+	private := &models.Chat{Type: "private", User1ID: &alice.ID, User2ID: &bob.ID}
+	if err := db.Create(private).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	group := &models.Group{Name: "Team", CreatedByID: alice.ID}
+	if err := db.Create(group).Error; err != nil {
+		t.Fatal(err)
+	}
+	members := []models.GroupMember{
+		{GroupID: group.ID, UserID: alice.ID, Role: "admin", JoinedAt: time.Now()},
+		{GroupID: group.ID, UserID: bob.ID, Role: "member", JoinedAt: time.Now()},
+	}
+	if err := db.Create(&members).Error; err != nil {
+		t.Fatal(err)
+	}
+	groupChat := &models.Chat{Type: "group", GroupID: &group.ID}
+	if err := db.Create(groupChat).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	// Bob leaves the group, which soft-deletes his membership
+	if err := db.Delete(&members[1]).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		chatID  uint
+		sender  uint
+		wantErr error
+	}{
+		{"private chat participant", private.ID, alice.ID, nil},
+		{"private chat non-member", private.ID, mallory.ID, ErrNotChatMember},
+		{"group member", groupChat.ID, alice.ID, nil},
+		{"group non-member", groupChat.ID, mallory.ID, ErrNotChatMember},
+		{"former group member", groupChat.ID, bob.ID, ErrNotChatMember},
+		{"missing chat", groupChat.ID + 1000, alice.ID, ErrNotChatMember},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			message, err := service.CreateMessage(tt.chatID, tt.sender, "text", "hello", "", nil, nil, nil, nil, nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("CreateMessage error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				var count int64
+				db.Model(&models.Message{}).Where("chat_id = ? AND sender_id = ?", tt.chatID, tt.sender).Count(&count)
+				if message != nil || count != 0 {
+					t.Errorf("message from a non-member was stored")
+				}
+			}
+		})
+	}
+}
@@ -1,37 +1,70 @@
 package services
 
 import (
+	"errors"
 	"fmt"
+	"log"
+	"sort"
+	"strings"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"onechat/internal/models"
 )
 
+// ErrEventAlreadyImported is returned when a user imports the same shared
+// event twice.
+var ErrEventAlreadyImported = errors.New("event already imported")
+
+// ErrInvalidTimezone is returned for a timezone that isn't a known IANA
+// name, such as "Europe/Paris".
+var ErrInvalidTimezone = errors.New("invalid timezone")
+
+// ErrInvalidEventTime is returned for an event time in an unrecognized
+// format.
+var ErrInvalidEventTime = errors.New("invalid event date format")
+
+// ErrNotRecurring is returned when cancelling an occurrence of an event
+// that doesn't repeat; such events are deleted instead.
+var ErrNotRecurring = errors.New("event does not repeat")
+
+// ErrNoSuchOccurrence is returned when cancelling an occurrence at a time
+// the event doesn't occur.
+var ErrNoSuchOccurrence = errors.New("event does not occur at that time")
+
 type EventService struct {
-	db        *gorm.DB
-	aiService *AIService
+	db                     *gorm.DB
+	aiService              *AIService
+	chatService            *ChatService
+	defaultReminderMinutes int
 }
 
-func NewEventService(db *gorm.DB, aiService *AIService) *EventService {
+// NewEventService creates the service. defaultReminderMinutes is the
+// reminder lead time for events created without one; 0 turns reminders off
+// by default.
+func NewEventService(db *gorm.DB, aiService *AIService, chatService *ChatService, defaultReminderMinutes int) *EventService {
 	return &EventService{
-		db:        db,
-		aiService: aiService,
+		db:                     db,
+		aiService:              aiService,
+		chatService:            chatService,
+		defaultReminderMinutes: defaultReminderMinutes,
 	}
 }
 
 func (s *EventService) CreateEventFromMessage(userID, messageID uint, messageText string) (*models.Event, error) {
 	// Extract event info using AI
-	extraction, err := s.aiService.ExtractEvent(messageText)
+	extraction, err := s.aiService.ExtractEvent(userID, messageText)
 	if err != nil {
 		return nil, fmt.Errorf("failed to extract event: %w", err)
 	}
 
-	// Parse date and time
-	eventDateTime, err := time.Parse("2006-01-02 15:04", extraction.Date+" "+extraction.Time)
+	// Parse date and time, which are local to the user
+	loc, timezone := userLocation(s.db, userID)
+	eventDateTime, err := parseLocalTime("2006-01-02 15:04", extraction.Date+" "+extraction.Time, loc)
 	if err != nil {
 		// Try with just date
-		eventDateTime, err = time.Parse("2006-01-02", extraction.Date)
+		eventDateTime, err = parseLocalTime("2006-01-02", extraction.Date, loc)
 		if err != nil {
 			return nil, fmt.Errorf("invalid date format: %w", err)
 		}
@@ -45,6 +78,8 @@ func (s *EventService) CreateEventFromMessage(userID, messageID uint, messageTex
 		EventDate:       eventDateTime,
 		Location:        extraction.Location,
 		SourceMessageID: &messageID,
+		Timezone:        timezone,
+		ReminderMinutes: s.defaultReminderMinutes,
 	}
 
 	if err := s.db.Create(event).Error; err != nil {
@@ -54,7 +89,21 @@ func (s *EventService) CreateEventFromMessage(userID, messageID uint, messageTex
 	return event, nil
 }
 
-func (s *EventService) CreateEvent(userID uint, title, description, location string, eventDate time.Time, sourceMessageID *uint) (*models.Event, error) {
+// CreateEvent adds an event to the user's calendar. reminderMinutes is how
+// long before the event to remind the user; nil uses the default. An empty
+// recurrenceRule makes a one-off event, and an empty timezone uses the
+// user's.
+func (s *EventService) CreateEvent(userID uint, title, description, location string, eventDate time.Time, sourceMessageID *uint, reminderMinutes *int, recurrenceRule, timezone string) (*models.Event, error) {
+	if _, err := parseRecurrence(recurrenceRule); err != nil {
+		return nil, err
+	}
+	if timezone == "" {
+		_, timezone = userLocation(s.db, userID)
+	}
+	if _, err := loadTimezone(timezone); err != nil {
+		return nil, err
+	}
+
 	event := &models.Event{
 		UserID:          userID,
 		Title:           title,
@@ -62,32 +111,235 @@ func (s *EventService) CreateEvent(userID uint, title, description, location str
 		EventDate:       eventDate,
 		Location:        location,
 		SourceMessageID: sourceMessageID,
+		RecurrenceRule:  strings.TrimSpace(recurrenceRule),
+		Timezone:        timezone,
+		ReminderMinutes: s.defaultReminderMinutes,
+	}
+	if reminderMinutes != nil {
+		event.ReminderMinutes = *reminderMinutes
 	}
 
 	if err := s.db.Create(event).Error; err != nil {
 		return nil, err
 	}
 
+	localizeEvent(event)
 	return event, nil
 }
 
-func (s *EventService) GetUserEvents(userID uint) ([]models.Event, error) {
+func (s *EventService) GetUserEvents(userID uint, limit, offset int) ([]models.Event, error) {
 	var events []models.Event
 	err := s.db.Where("user_id = ?", userID).
 		Order("event_date ASC").
+		Limit(limit).
+		Offset(offset).
 		Find(&events).Error
+	for i := range events {
+		localizeEvent(&events[i])
+	}
 	
 	return events, err
 }
 
+// upcomingHorizon is how far ahead GetUpcomingEvents looks for occurrences
+// of recurring events.
+const upcomingHorizon = 366 * 24 * time.Hour
+
+// GetUpcomingEvents returns the user's next events, soonest first. Recurring
+// events appear once per upcoming occurrence, with EventDate set to it.
 func (s *EventService) GetUpcomingEvents(userID uint, limit int) ([]models.Event, error) {
+	now := time.Now()
+
 	var events []models.Event
-	err := s.db.Where("user_id = ? AND event_date > ?", userID, time.Now()).
+	err := s.db.Where("user_id = ? AND recurrence_rule = '' AND event_date > ?", userID, now).
 		Order("event_date ASC").
 		Limit(limit).
 		Find(&events).Error
-	
-	return events, err
+	if err != nil {
+		return nil, err
+	}
+	for i := range events {
+		localizeEvent(&events[i])
+	}
+
+	var recurring []models.Event
+	if err := s.db.Preload("Exceptions").Where("user_id = ? AND recurrence_rule <> ''", userID).Find(&recurring).Error; err != nil {
+		return nil, err
+	}
+	for _, event := range recurring {
+		occurrences := expandEvent(event, now, now.Add(upcomingHorizon))
+		if len(occurrences) > limit {
+			occurrences = occurrences[:limit]
+		}
+		events = append(events, occurrences...)
+	}
+
+	sortEvents(events)
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return events, nil
+}
+
+// GetEventOccurrences returns every occurrence of the user's events between
+// from and to, oldest first. Recurring events appear once per occurrence,
+// with EventDate set to it.
+func (s *EventService) GetEventOccurrences(userID uint, from, to time.Time) ([]models.Event, error) {
+	var events []models.Event
+	err := s.db.Preload("Exceptions").
+		Where("user_id = ? AND event_date <= ?", userID, to).
+		Where("recurrence_rule <> '' OR event_date >= ?", from).
+		Find(&events).Error
+	if err != nil {
+		return nil, err
+	}
+
+	occurrences := []models.Event{}
+	for _, event := range events {
+		occurrences = append(occurrences, expandEvent(event, from, to)...)
+	}
+
+	sortEvents(occurrences)
+	if len(occurrences) > maxOccurrences {
+		occurrences = occurrences[:maxOccurrences]
+	}
+	return occurrences, nil
+}
+
+// expandEvent returns a copy of the event for each of its occurrences within
+// [from, to], in the event's timezone, leaving out cancelled ones. A one-off
+// event is returned as it is if it falls in the range.
+func expandEvent(event models.Event, from, to time.Time) []models.Event {
+	rule, err := parseRecurrence(event.RecurrenceRule)
+	if err != nil || rule == nil {
+		if event.EventDate.Before(from) || event.EventDate.After(to) {
+			return nil
+		}
+		localizeEvent(&event)
+		return []models.Event{event}
+	}
+
+	loc, err := loadTimezone(event.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	var out []models.Event
+	for _, start := range rule.occurrences(event.EventDate, loc, from, to) {
+		if isCancelled(event, start) {
+			continue
+		}
+		occurrence := event
+		occurrence.EventDate = start
+		out = append(out, occurrence)
+	}
+	return out
+}
+
+// isCancelled reports whether the occurrence starting at start has been
+// cancelled. Cancelled occurrences still count towards a rule's COUNT, as
+// EXDATE does in iCalendar.
+func isCancelled(event models.Event, start time.Time) bool {
+	for _, exception := range event.Exceptions {
+		if exception.OccurrenceDate.Equal(start) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortEvents(events []models.Event) {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].EventDate.Before(events[j].EventDate)
+	})
+}
+
+// eventTimeLayouts are the formats accepted for event times without a UTC
+// offset, which are read as local time in the event's timezone.
+var eventTimeLayouts = []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02 15:04"}
+
+// ParseEventTime parses an event time. RFC 3339 times carry their own
+// offset; times without one are read in loc.
+func ParseEventTime(value string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range eventTimeLayouts {
+		if t, err := parseLocalTime(layout, value, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, ErrInvalidEventTime
+}
+
+// ResolveTimezone returns the location for an event's timezone. An empty
+// timezone falls back to the user's, and then to UTC.
+func (s *EventService) ResolveTimezone(userID uint, timezone string) (*time.Location, error) {
+	if timezone == "" {
+		loc, _ := userLocation(s.db, userID)
+		return loc, nil
+	}
+	return loadTimezone(timezone)
+}
+
+// userLocation returns the user's timezone and its name, or UTC if they
+// haven't set a valid one.
+func userLocation(db *gorm.DB, userID uint) (*time.Location, string) {
+	var user models.User
+	if err := db.Select("timezone").First(&user, userID).Error; err != nil {
+		return time.UTC, ""
+	}
+	loc, err := loadTimezone(user.Timezone)
+	if err != nil {
+		return time.UTC, ""
+	}
+	return loc, user.Timezone
+}
+
+// localizeEvent presents the event's time in its timezone. The stored time
+// is absolute, so this only changes the offset it is written with.
+func localizeEvent(event *models.Event) {
+	if loc, err := loadTimezone(event.Timezone); err == nil {
+		event.EventDate = event.EventDate.In(loc)
+	}
+}
+
+// localDate is time.Date, except that a wall-clock time skipped when the
+// clocks go forward lands after the gap, as RFC 5545 reads it: 02:30 on the
+// day New York springs forward is 03:30 EDT. time.Date would put it at 01:30
+// EST instead. Times repeated when the clocks go back keep their first
+// occurrence.
+func localDate(year int, month time.Month, day, hour, min, sec, nsec int, loc *time.Location) time.Time {
+	t := time.Date(year, month, day, hour, min, sec, nsec, loc)
+	wall := time.Date(year, month, day, hour, min, sec, nsec, time.UTC)
+	got := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+	if skipped := wall.Sub(got); skipped > 0 {
+		return t.Add(skipped)
+	}
+	return t
+}
+
+// parseLocalTime is time.ParseInLocation for layouts without an offset,
+// placing times that fall in a DST gap the way localDate does.
+func parseLocalTime(layout, value string, loc *time.Location) (time.Time, error) {
+	t, err := time.Parse(layout, value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	hh, mm, ss := t.Clock()
+	return localDate(t.Year(), t.Month(), t.Day(), hh, mm, ss, t.Nanosecond(), loc), nil
+}
+
+// loadTimezone resolves an IANA timezone name; an empty name means UTC.
+func loadTimezone(name string) (*time.Location, error) {
+	if name == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidTimezone, name)
+	}
+	return loc, nil
 }
 
 func (s *EventService) UpdateEvent(eventID, userID uint, updates map[string]interface{}) (*models.Event, error) {
@@ -96,15 +348,88 @@ func (s *EventService) UpdateEvent(eventID, userID uint, updates map[string]inte
 		return nil, err
 	}
 
+	if rule, ok := updates["recurrence_rule"]; ok {
+		text, _ := rule.(string)
+		if _, err := parseRecurrence(text); err != nil {
+			return nil, err
+		}
+		updates["recurrence_rule"] = strings.TrimSpace(text)
+	}
+	loc, _ := loadTimezone(event.Timezone)
+	if timezone, ok := updates["timezone"]; ok {
+		name, _ := timezone.(string)
+		var err error
+		if loc, err = loadTimezone(name); err != nil {
+			return nil, err
+		}
+		updates["timezone"] = name
+	}
+	if date, ok := updates["event_date"]; ok {
+		// A time without an offset is local to the event's timezone
+		text, _ := date.(string)
+		eventDate, err := ParseEventTime(text, loc)
+		if err != nil {
+			return nil, err
+		}
+		updates["event_date"] = eventDate
+	}
+
+	// Moving the event or its lead time re-arms the reminder
+	if _, ok := updates["event_date"]; ok {
+		updates["notified_for"] = nil
+	}
+	if _, ok := updates["reminder_minutes"]; ok {
+		updates["notified_for"] = nil
+	}
+
 	if err := s.db.Model(&event).Updates(updates).Error; err != nil {
 		return nil, err
 	}
 
+	localizeEvent(&event)
 	return &event, nil
 }
 
+// CancelOccurrence cancels one occurrence of a recurring event, leaving the
+// rest of the series. date is the occurrence's start; a time without an
+// offset is local to the event's timezone.
+func (s *EventService) CancelOccurrence(eventID, userID uint, date string) error {
+	var event models.Event
+	if err := s.db.Where("id = ? AND user_id = ?", eventID, userID).First(&event).Error; err != nil {
+		return err
+	}
+
+	rule, _ := parseRecurrence(event.RecurrenceRule)
+	if rule == nil {
+		return ErrNotRecurring
+	}
+	loc, err := loadTimezone(event.Timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+	occurrence, err := ParseEventTime(date, loc)
+	if err != nil {
+		return err
+	}
+	if len(rule.occurrences(event.EventDate, loc, occurrence, occurrence)) == 0 {
+		return ErrNoSuchOccurrence
+	}
+
+	return s.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&models.EventException{
+		EventID:        event.ID,
+		OccurrenceDate: occurrence,
+	}).Error
+}
+
 func (s *EventService) DeleteEvent(eventID, userID uint) error {
-	return s.db.Where("id = ? AND user_id = ?", eventID, userID).Delete(&models.Event{}).Error
+	result := s.db.Where("id = ? AND user_id = ?", eventID, userID).Delete(&models.Event{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
 }
 
 func (s *EventService) GetEventByID(eventID uint) (*models.Event, error) {
@@ -112,5 +437,90 @@ func (s *EventService) GetEventByID(eventID uint) (*models.Event, error) {
 	if err := s.db.First(&event, eventID).Error; err != nil {
 		return nil, err
 	}
+	localizeEvent(&event)
 	return &event, nil
 }
+
+// ImportEventFromMessage copies the event shared in an event message into
+// the user's own calendar. The user must be a member of the message's chat.
+func (s *EventService) ImportEventFromMessage(userID, messageID uint) (*models.Event, error) {
+	var message models.Message
+	if err := s.db.Preload("Event").First(&message, messageID).Error; err != nil {
+		return nil, err
+	}
+
+	if !s.chatService.IsChatMember(message.ChatID, userID) {
+		return nil, errors.New("not a member of this chat")
+	}
+
+	if message.Type != "event" || message.Event == nil {
+		return nil, errors.New("message does not contain an event")
+	}
+
+	var count int64
+	s.db.Model(&models.Event{}).
+		Where("user_id = ? AND source_message_id = ?", userID, messageID).
+		Count(&count)
+	if count > 0 {
+		return nil, ErrEventAlreadyImported
+	}
+
+	shared := message.Event
+	return s.CreateEvent(userID, shared.Title, shared.Description, shared.Location, shared.EventDate, &messageID, nil, shared.RecurrenceRule, shared.Timezone)
+}
+
+// StartReminderScheduler periodically sends a reminder for the next
+// occurrence of each event once its lead time has been reached. The
+// occurrence reminded about is recorded in notified_for, so each one fires
+// only once and a recurring event is reminded again for the next.
+// Occurrences that have already started are not reminded.
+func (s *EventService) StartReminderScheduler(interval time.Duration, notifications *NotificationService) {
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			now := time.Now()
+			var due []models.Event
+			err := s.db.Preload("Exceptions").
+				Where("reminder_minutes > 0 AND (recurrence_rule <> '' OR event_date > ?)", now).
+				Where("event_date <= ? + reminder_minutes * interval '1 minute'", now).
+				Find(&due).Error
+			if err != nil {
+				log.Printf("Failed to load due event reminders: %v", err)
+				continue
+			}
+
+			for _, event := range due {
+				next, ok := nextReminder(event, now)
+				if !ok {
+					continue
+				}
+				// Claim the reminder first so it isn't sent twice
+				result := s.db.Model(&models.Event{}).
+					Where("id = ? AND (notified_for IS NULL OR notified_for < ?)", event.ID, next.EventDate).
+					Update("notified_for", next.EventDate)
+				if result.Error != nil || result.RowsAffected == 0 {
+					continue
+				}
+				if err := notifications.NotifyEventReminder(&next); err != nil {
+					log.Printf("Failed to send reminder for event %d: %v", event.ID, err)
+				}
+			}
+		}
+	}()
+}
+
+// nextReminder returns the event's next occurrence after now if its
+// reminder is due and hasn't been sent yet.
+func nextReminder(event models.Event, now time.Time) (models.Event, bool) {
+	lead := time.Duration(event.ReminderMinutes) * time.Minute
+	for _, occurrence := range expandEvent(event, now, now.Add(lead)) {
+		if !occurrence.EventDate.After(now) {
+			continue
+		}
+		if event.NotifiedFor != nil && !occurrence.EventDate.After(*event.NotifiedFor) {
+			return models.Event{}, false
+		}
+		return occurrence, true
+	}
+	return models.Event{}, false
+}
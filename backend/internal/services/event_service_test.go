@@ -0,0 +1,264 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"onechat/internal/models"
+)
+
+func mustLoadLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		t.Fatalf("LoadLocation(%q): %v", name, err)
+	}
+	return loc
+}
+
+func TestParseEventTime(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+	kolkata := mustLoadLocation(t, "Asia/Kolkata")
+	sydney := mustLoadLocation(t, "Australia/Sydney")
+
+	tests := []struct {
+		name  string
+		value string
+		loc   *time.Location
+		want  string // in UTC
+	}{
+		{"utc", "2024-07-04T15:00", time.UTC, "2024-07-04T15:00:00Z"},
+		{"new york summer", "2024-07-04T15:00", newYork, "2024-07-04T19:00:00Z"},
+		{"new york winter", "2024-01-15 15:00", newYork, "2024-01-15T20:00:00Z"},
+		{"with seconds", "2024-07-04T15:00:30", newYork, "2024-07-04T19:00:30Z"},
+		{"half-hour offset", "2024-07-04T15:00", kolkata, "2024-07-04T09:30:00Z"},
+		{"southern hemisphere summer", "2024-01-15T09:00", sydney, "2024-01-14T22:00:00Z"},
+		{"rfc 3339 keeps its offset", "2024-07-04T15:00:00+02:00", newYork, "2024-07-04T13:00:00Z"},
+
+		// New York springs forward at 02:00 on 2024-03-10 and falls back at
+		// 02:00 on 2024-11-03
+		{"before spring forward", "2024-03-10T01:59", newYork, "2024-03-10T06:59:00Z"},
+		{"in the spring gap", "2024-03-10T02:30", newYork, "2024-03-10T07:30:00Z"},
+		{"after spring forward", "2024-03-10T03:30", newYork, "2024-03-10T07:30:00Z"},
+		{"repeated hour on fall back", "2024-11-03T01:30", newYork, "2024-11-03T05:30:00Z"},
+		{"after fall back", "2024-11-03T02:30", newYork, "2024-11-03T07:30:00Z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseEventTime(tt.value, tt.loc)
+			if err != nil {
+				t.Fatalf("ParseEventTime(%q): %v", tt.value, err)
+			}
+			if want, _ := time.Parse(time.RFC3339, tt.want); !got.Equal(want) {
+				t.Errorf("ParseEventTime(%q) = %s, want %s", tt.value, got.UTC().Format(time.RFC3339), tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEventTimeInvalid(t *testing.T) {
+	for _, value := range []string{"", "tomorrow at 3pm", "2024-13-01T10:00", "2024-07-04", "15:00"} {
+		if _, err := ParseEventTime(value, time.UTC); !errors.Is(err, ErrInvalidEventTime) {
+			t.Errorf("ParseEventTime(%q) error = %v, want ErrInvalidEventTime", value, err)
+		}
+	}
+}
+
+func TestLoadTimezone(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"", "UTC", false},
+		{"UTC", "UTC", false},
+		{"America/New_York", "America/New_York", false},
+		{"Asia/Kolkata", "Asia/Kolkata", false},
+		{"Mars/Olympus_Mons", "", true},
+		{"America/NewYork", "", true},
+		{"EST+5", "", true},
+		{"../../etc/passwd", "", true},
+	}
+
+	for _, tt := range tests {
+		loc, err := loadTimezone(tt.name)
+		if tt.wantErr {
+			if !errors.Is(err, ErrInvalidTimezone) {
+				t.Errorf("loadTimezone(%q) error = %v, want ErrInvalidTimezone", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("loadTimezone(%q): %v", tt.name, err)
+			continue
+		}
+		if loc.String() != tt.want {
+			t.Errorf("loadTimezone(%q) = %s, want %s", tt.name, loc, tt.want)
+		}
+	}
+}
+
+func TestResolveTimezoneInvalid(t *testing.T) {
+	service := NewEventService(nil, nil, nil, 0)
+	if _, err := service.ResolveTimezone(1, "Not/A_Zone"); !errors.Is(err, ErrInvalidTimezone) {
+		t.Errorf("ResolveTimezone error = %v, want ErrInvalidTimezone", err)
+	}
+}
+
+func TestOccurrencesAcrossDST(t *testing.T) {
+	newYork := mustLoadLocation(t, "America/New_York")
+
+	tests := []struct {
+		name  string
+		rule  string
+		start string // local to New York
+		from  string
+		to    string
+		want  []string // local to New York
+	}{
+		{
+			"weekly keeps its wall time through spring forward",
+			"WEEKLY", "2024-03-03T09:00", "2024-03-01T00:00:00Z", "2024-03-18T00:00:00Z",
+			[]string{"2024-03-03T09:00:00-05:00", "2024-03-10T09:00:00-04:00", "2024-03-17T09:00:00-04:00"},
+		},
+		{
+			"weekly keeps its wall time through fall back",
+			"WEEKLY", "2024-10-27T09:00", "2024-10-26T00:00:00Z", "2024-11-11T00:00:00Z",
+			[]string{"2024-10-27T09:00:00-04:00", "2024-11-03T09:00:00-05:00", "2024-11-10T09:00:00-05:00"},
+		},
+		{
+			"daily in the spring gap moves past it that day only",
+			"DAILY", "2024-03-09T02:30", "2024-03-09T00:00:00Z", "2024-03-11T12:00:00Z",
+			[]string{"2024-03-09T02:30:00-05:00", "2024-03-10T03:30:00-04:00", "2024-03-11T02:30:00-04:00"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, err := parseRecurrence(tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start, err := ParseEventTime(tt.start, newYork)
+			if err != nil {
+				t.Fatal(err)
+			}
+			from, _ := time.Parse(time.RFC3339, tt.from)
+			to, _ := time.Parse(time.RFC3339, tt.to)
+
+			got := rule.occurrences(start, newYork, from, to)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d occurrences %v, want %d", len(got), got, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if got[i].Format(time.RFC3339) != want {
+					t.Errorf("occurrence %d = %s, want %s", i, got[i].Format(time.RFC3339), want)
+				}
+			}
+		})
+	}
+}
+
+func TestCreateEventInUserTimezone(t *testing.T) {
+	db := testDB(t)
+	service := NewEventService(db, nil, nil, 15)
+
+	user := createTestUser(t, db, "nyc")
+	if err := db.Model(user).Update("timezone", "America/New_York").Error; err != nil {
+		t.Fatal(err)
+	}
+
+	loc, err := service.ResolveTimezone(user.ID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventDate, err := ParseEventTime("2024-07-04T15:00", loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := service.CreateEvent(user.ID, "Fireworks", "", "", eventDate, nil, nil, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.Timezone != "America/New_York" {
+		t.Errorf("event timezone = %q, want America/New_York", event.Timezone)
+	}
+	if got := event.EventDate.Format(time.RFC3339); got != "2024-07-04T15:00:00-04:00" {
+		t.Errorf("event date = %s, want 2024-07-04T15:00:00-04:00", got)
+	}
+
+	var stored models.Event
+	if err := db.First(&stored, event.ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 7, 4, 19, 0, 0, 0, time.UTC); !stored.EventDate.Equal(want) {
+		t.Errorf("stored event date = %s, want %s", stored.EventDate.UTC(), want)
+	}
+}
+
+func TestNextReminder(t *testing.T) {
+	start := time.Date(2024, 7, 1, 9, 0, 0, 0, time.UTC)
+	reminded := time.Date(2024, 7, 3, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		event models.Event
+		now   string
+		want  string // start of the occurrence to remind about, or empty for none
+	}{
+		{"one-off within its lead time", models.Event{EventDate: start}, "2024-07-01T08:50:00Z", "2024-07-01T09:00:00Z"},
+		{"one-off not yet due", models.Event{EventDate: start}, "2024-07-01T08:00:00Z", ""},
+		{"one-off already reminded", models.Event{EventDate: start, NotifiedFor: &start}, "2024-07-01T08:50:00Z", ""},
+		{"one-off already started", models.Event{EventDate: start}, "2024-07-01T09:05:00Z", ""},
+		{"daily, first occurrence", models.Event{EventDate: start, RecurrenceRule: "daily"}, "2024-07-01T08:50:00Z", "2024-07-01T09:00:00Z"},
+		{"daily, a later occurrence", models.Event{EventDate: start, RecurrenceRule: "daily", NotifiedFor: &start}, "2024-07-03T08:50:00Z", "2024-07-03T09:00:00Z"},
+		{"daily, occurrence already reminded", models.Event{EventDate: start, RecurrenceRule: "daily", NotifiedFor: &reminded}, "2024-07-03T08:50:00Z", ""},
+		{"daily, between occurrences", models.Event{EventDate: start, RecurrenceRule: "daily"}, "2024-07-03T12:00:00Z", ""},
+		{"series over", models.Event{EventDate: start, RecurrenceRule: "FREQ=DAILY;COUNT=2"}, "2024-07-03T08:50:00Z", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.event.ReminderMinutes = 15
+			now, _ := time.Parse(time.RFC3339, tt.now)
+
+			next, ok := nextReminder(tt.event, now)
+			if tt.want == "" {
+				if ok {
+					t.Fatalf("nextReminder at %s = %s, want none", tt.now, next.EventDate.UTC().Format(time.RFC3339))
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("nextReminder at %s = none, want %s", tt.now, tt.want)
+			}
+			if got := next.EventDate.UTC().Format(time.RFC3339); got != tt.want {
+				t.Errorf("nextReminder at %s = %s, want %s", tt.now, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandEventSkipsCancelledOccurrences(t *testing.T) {
+	start := time.Date(2024, 7, 1, 9, 0, 0, 0, time.UTC)
+	event := models.Event{
+		EventDate:      start,
+		RecurrenceRule: "FREQ=DAILY;COUNT=4",
+		Exceptions:     []models.EventException{{OccurrenceDate: start.AddDate(0, 0, 1)}},
+	}
+
+	got := expandEvent(event, start, start.AddDate(0, 0, 10))
+	want := []time.Time{start, start.AddDate(0, 0, 2), start.AddDate(0, 0, 3)}
+	if len(got) != len(want) {
+		t.Fatalf("got %d occurrences, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if !got[i].EventDate.Equal(want[i]) {
+			t.Errorf("occurrence %d = %s, want %s", i, got[i].EventDate, want[i])
+		}
+	}
+}
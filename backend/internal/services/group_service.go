@@ -1,23 +1,61 @@
 package services
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode/utf8"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"onechat/internal/models"
 )
 
+// ErrInvalidInvite is returned when an invite token is unknown, expired or
+// used up.
+var ErrInvalidInvite = errors.New("invite link is invalid or has expired")
+
+// ErrAlreadyMember is returned when joining a group the user is already in.
+var ErrAlreadyMember = errors.New("user is already a member")
+
+// ErrGroupFull is returned when adding a member would take a group past the
+// member limit.
+var ErrGroupFull = errors.New("group has reached maximum capacity")
+
 type GroupService struct {
-	db *gorm.DB
+	db               *gorm.DB
+	maxMembers       int
+	maxMessageLength int
 }
 
-func NewGroupService(db *gorm.DB) *GroupService {
-	return &GroupService{db: db}
+// NewGroupService creates a GroupService. maxMembers is the most members a
+// group can have, including admins, and maxMessageLength is the global
+// message length limit that group overrides can't exceed.
+func NewGroupService(db *gorm.DB, maxMembers, maxMessageLength int) *GroupService {
+	return &GroupService{db: db, maxMembers: maxMembers, maxMessageLength: maxMessageLength}
 }
 
 func (s *GroupService) CreateGroup(name, description, icon string, createdByID uint, memberIDs []uint) (*models.Group, error) {
-	if len(memberIDs) > 256 {
-		return nil, errors.New("maximum 256 members allowed")
+	// The creator joins as admin, so they count towards the limit too
+	unique := make(map[uint]bool)
+	for _, memberID := range memberIDs {
+		if memberID != createdByID {
+			unique[memberID] = true
+		}
+	}
+	if len(unique)+1 > s.maxMembers {
+		return nil, fmt.Errorf("maximum %d members allowed", s.maxMembers)
+	}
+
+	for _, memberID := range memberIDs {
+		if memberID != createdByID {
+			if err := s.checkGroupAddPolicy(createdByID, memberID); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	// Create group
@@ -47,11 +85,12 @@ func (s *GroupService) CreateGroup(name, description, icon string, createdByID u
 
 	// Add other members
 	for _, memberID := range memberIDs {
-		if memberID != createdByID {
+		if unique[memberID] {
+			delete(unique, memberID)
 			member := &models.GroupMember{
 				GroupID: group.ID,
 				UserID:  memberID,
-				Role:    "member",
+				Role:    group.DefaultRole,
 			}
 			if err := tx.Create(member).Error; err != nil {
 				tx.Rollback()
@@ -88,7 +127,49 @@ func (s *GroupService) GetGroup(groupID uint) (*models.Group, error) {
 	return &group, nil
 }
 
-func (s *GroupService) UpdateGroup(groupID, userID uint, updates map[string]interface{}) (*models.Group, error) {
+// GetGroupChatID returns the ID of the group's chat.
+func (s *GroupService) GetGroupChatID(groupID uint) (uint, error) {
+	var chat models.Chat
+	if err := s.db.Select("id").Where("type = ? AND group_id = ?", "group", groupID).First(&chat).Error; err != nil {
+		return 0, err
+	}
+	return chat.ID, nil
+}
+
+// ErrInvalidDefaultRole is returned when a group's default role is set to
+// anything but member or restricted.
+var ErrInvalidDefaultRole = errors.New("default role must be member or restricted")
+
+// InvalidMaxMessageLengthError is returned when a group's message length
+// override is negative or above the global limit.
+type InvalidMaxMessageLengthError struct {
+	Max int
+}
+
+func (e *InvalidMaxMessageLengthError) Error() string {
+	return fmt.Sprintf("max_message_length must be between 0 and %d", e.Max)
+}
+
+// MaxSlowModeSeconds is the longest slow mode interval a group can set.
+const MaxSlowModeSeconds = 3600
+
+// ErrInvalidSlowMode is returned when a group's slow mode interval is
+// negative or longer than MaxSlowModeSeconds.
+var ErrInvalidSlowMode = fmt.Errorf("slow_mode_seconds must be between 0 and %d", MaxSlowModeSeconds)
+
+// GroupUpdate holds the group settings admins can change. Nil fields are
+// left as they are.
+type GroupUpdate struct {
+	Name             *string
+	Description      *string
+	Icon             *string
+	MaxMessageLength *int
+	AnnounceOnly     *bool
+	SlowModeSeconds  *int
+	DefaultRole      *string
+}
+
+func (s *GroupService) UpdateGroup(groupID, userID uint, update GroupUpdate) (*models.Group, error) {
 	// Check if user is admin
 	var member models.GroupMember
 	if err := s.db.Where("group_id = ? AND user_id = ? AND role = ?", groupID, userID, "admin").
@@ -96,13 +177,48 @@ func (s *GroupService) UpdateGroup(groupID, userID uint, updates map[string]inte
 		return nil, errors.New("only admins can update group")
 	}
 
+	updates := make(map[string]interface{})
+	if update.Name != nil {
+		updates["name"] = *update.Name
+	}
+	if update.Description != nil {
+		updates["description"] = *update.Description
+	}
+	if update.Icon != nil {
+		updates["icon"] = *update.Icon
+	}
+	if limit := update.MaxMessageLength; limit != nil {
+		// 0 means the group uses the global limit
+		if *limit < 0 || *limit > s.maxMessageLength {
+			return nil, &InvalidMaxMessageLengthError{Max: s.maxMessageLength}
+		}
+		updates["max_message_length"] = *limit
+	}
+	if update.AnnounceOnly != nil {
+		updates["announce_only"] = *update.AnnounceOnly
+	}
+	if seconds := update.SlowModeSeconds; seconds != nil {
+		if *seconds < 0 || *seconds > MaxSlowModeSeconds {
+			return nil, ErrInvalidSlowMode
+		}
+		updates["slow_mode_seconds"] = *seconds
+	}
+	if role := update.DefaultRole; role != nil {
+		if *role != "member" && *role != "restricted" {
+			return nil, ErrInvalidDefaultRole
+		}
+		updates["default_role"] = *role
+	}
+
 	var group models.Group
 	if err := s.db.First(&group, groupID).Error; err != nil {
 		return nil, err
 	}
 
-	if err := s.db.Model(&group).Updates(updates).Error; err != nil {
-		return nil, err
+	if len(updates) > 0 {
+		if err := s.db.Model(&group).Updates(updates).Error; err != nil {
+			return nil, err
+		}
 	}
 
 	s.db.Preload("Members.User").First(&group, groupID)
@@ -141,13 +257,6 @@ func (s *GroupService) DeleteGroup(groupID, userID uint) error {
 }
 
 func (s *GroupService) AddMember(groupID, userID, newMemberID uint) error {
-	// Check member limit
-	var count int64
-	s.db.Model(&models.GroupMember{}).Where("group_id = ?", groupID).Count(&count)
-	if count >= 256 {
-		return errors.New("group has reached maximum capacity")
-	}
-
 	// Check if requester is admin
 	var member models.GroupMember
 	if err := s.db.Where("group_id = ? AND user_id = ? AND role = ?", groupID, userID, "admin").
@@ -162,13 +271,205 @@ func (s *GroupService) AddMember(groupID, userID, newMemberID uint) error {
 		return errors.New("user is already a member")
 	}
 
-	newMember := &models.GroupMember{
-		GroupID: groupID,
-		UserID:  newMemberID,
-		Role:    "member",
+	if err := s.checkGroupAddPolicy(userID, newMemberID); err != nil {
+		return err
 	}
 
-	return s.db.Create(newMember).Error
+	return s.db.Transaction(func(tx *gorm.DB) error {
+		group, err := lockGroup(tx, groupID)
+		if err != nil {
+			return err
+		}
+
+		// Check member limit
+		if s.memberCount(tx, groupID) >= int64(s.maxMembers) {
+			return ErrGroupFull
+		}
+
+		newMember := &models.GroupMember{
+			GroupID: groupID,
+			UserID:  newMemberID,
+			Role:    group.DefaultRole,
+		}
+		return tx.Create(newMember).Error
+	})
+}
+
+// lockGroup loads the group and locks its row until tx ends. Member adds
+// take this lock before counting members, so concurrent adds are serialized
+// and can't push the group past the member limit together.
+func lockGroup(tx *gorm.DB, groupID uint) (*models.Group, error) {
+	var group models.Group
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Select("id", "default_role").
+		First(&group, groupID).Error; err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+func (s *GroupService) memberCount(tx *gorm.DB, groupID uint) int64 {
+	var count int64
+	tx.Model(&models.GroupMember{}).Where("group_id = ?", groupID).Count(&count)
+	return count
+}
+
+// CreateInvite issues a random invite token for the group. maxUses of 0
+// allows unlimited joins until expiresAt. Only admins can create invites.
+func (s *GroupService) CreateInvite(groupID, userID uint, maxUses int, expiresAt time.Time) (*models.GroupInvite, error) {
+	var member models.GroupMember
+	if err := s.db.Where("group_id = ? AND user_id = ? AND role = ?", groupID, userID, "admin").
+		First(&member).Error; err != nil {
+		return nil, errors.New("only admins can create invites")
+	}
+
+	if maxUses < 0 {
+		return nil, errors.New("max_uses cannot be negative")
+	}
+	if !expiresAt.After(time.Now()) {
+		return nil, errors.New("expires_at must be in the future")
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+
+	invite := &models.GroupInvite{
+		GroupID:     groupID,
+		Token:       hex.EncodeToString(token),
+		CreatedByID: userID,
+		MaxUses:     maxUses,
+		ExpiresAt:   expiresAt,
+	}
+	if err := s.db.Create(invite).Error; err != nil {
+		return nil, err
+	}
+
+	return invite, nil
+}
+
+// JoinByInvite adds the user to the invite's group with the group's default
+// role and returns the group. The invite row is locked so concurrent joins
+// can't exceed its use limit.
+func (s *GroupService) JoinByInvite(token string, userID uint) (*models.Group, error) {
+	var groupID uint
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var invite models.GroupInvite
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("token = ?", token).
+			First(&invite).Error; err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidInvite
+			}
+			return err
+		}
+
+		if !invite.ExpiresAt.After(time.Now()) || (invite.MaxUses > 0 && invite.Uses >= invite.MaxUses) {
+			return ErrInvalidInvite
+		}
+
+		group, err := lockGroup(tx, invite.GroupID)
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return ErrInvalidInvite
+			}
+			return err
+		}
+
+		var existing int64
+		tx.Model(&models.GroupMember{}).Where("group_id = ? AND user_id = ?", group.ID, userID).Count(&existing)
+		if existing > 0 {
+			return ErrAlreadyMember
+		}
+
+		if s.memberCount(tx, group.ID) >= int64(s.maxMembers) {
+			return ErrGroupFull
+		}
+
+		if err := tx.Create(&models.GroupMember{
+			GroupID: group.ID,
+			UserID:  userID,
+			Role:    group.DefaultRole,
+		}).Error; err != nil {
+			return err
+		}
+
+		groupID = group.ID
+		return tx.Model(&invite).Update("uses", gorm.Expr("uses + 1")).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetGroup(groupID)
+}
+
+// MemberAddResult reports the outcome of adding one user in AddMembers.
+type MemberAddResult struct {
+	UserID uint   `json:"user_id"`
+	Added  bool   `json:"added"`
+	Error  string `json:"error,omitempty"`
+}
+
+// AddMembers adds several users in one transaction. Users that can't be
+// added (already members, add policy, capacity) are reported in the results
+// without failing the rest.
+func (s *GroupService) AddMembers(groupID, userID uint, memberIDs []uint) ([]MemberAddResult, error) {
+	// Check if requester is admin
+	var member models.GroupMember
+	if err := s.db.Where("group_id = ? AND user_id = ? AND role = ?", groupID, userID, "admin").
+		First(&member).Error; err != nil {
+		return nil, errors.New("only admins can add members")
+	}
+
+	results := make([]MemberAddResult, 0, len(memberIDs))
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		group, err := lockGroup(tx, groupID)
+		if err != nil {
+			return err
+		}
+		count := s.memberCount(tx, groupID)
+
+		seen := make(map[uint]bool)
+		for _, memberID := range memberIDs {
+			if seen[memberID] {
+				continue
+			}
+			seen[memberID] = true
+
+			result := MemberAddResult{UserID: memberID}
+
+			var existing int64
+			tx.Model(&models.GroupMember{}).Where("group_id = ? AND user_id = ?", groupID, memberID).Count(&existing)
+			if existing > 0 {
+				result.Error = "user is already a member"
+			} else if count >= int64(s.maxMembers) {
+				result.Error = ErrGroupFull.Error()
+			} else if err := s.checkGroupAddPolicy(userID, memberID); err != nil {
+				result.Error = err.Error()
+			} else {
+				newMember := &models.GroupMember{
+					GroupID: groupID,
+					UserID:  memberID,
+					Role:    group.DefaultRole,
+				}
+				if err := tx.Create(newMember).Error; err != nil {
+					return err
+				}
+				result.Added = true
+				count++
+			}
+
+			results = append(results, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
 }
 
 func (s *GroupService) RemoveMember(groupID, userID, memberToRemoveID uint) error {
@@ -194,8 +495,66 @@ func (s *GroupService) RemoveMember(groupID, userID, memberToRemoveID uint) erro
 		Delete(&models.GroupMember{}).Error
 }
 
+// LeaveGroup removes the user from the group. If they were the only admin,
+// the longest-standing remaining member is promoted and returned so callers
+// can announce the new role. If they were the last member, the group and
+// its chat are deleted.
+func (s *GroupService) LeaveGroup(groupID, userID uint) (*models.GroupMember, error) {
+	var promoted *models.GroupMember
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var member models.GroupMember
+		if err := tx.Where("group_id = ? AND user_id = ?", groupID, userID).First(&member).Error; err != nil {
+			return err
+		}
+
+		var err error
+		promoted, err = leaveGroup(tx, member)
+		return err
+	})
+
+	return promoted, err
+}
+
+// leaveGroup deletes a membership within tx. A group left without members
+// is deleted along with its chat; one left without an admin has its
+// longest-standing member promoted, who is returned.
+func leaveGroup(tx *gorm.DB, membership models.GroupMember) (*models.GroupMember, error) {
+	if err := tx.Delete(&membership).Error; err != nil {
+		return nil, err
+	}
+
+	var next models.GroupMember
+	err := tx.Where("group_id = ?", membership.GroupID).Order("joined_at ASC, id ASC").First(&next).Error
+	if err == gorm.ErrRecordNotFound {
+		if err := tx.Where("group_id = ?", membership.GroupID).Delete(&models.Chat{}).Error; err != nil {
+			return nil, err
+		}
+		return nil, tx.Delete(&models.Group{}, membership.GroupID).Error
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if membership.Role != "admin" {
+		return nil, nil
+	}
+
+	var adminCount int64
+	tx.Model(&models.GroupMember{}).
+		Where("group_id = ? AND role = ?", membership.GroupID, "admin").
+		Count(&adminCount)
+	if adminCount > 0 {
+		return nil, nil
+	}
+
+	if err := tx.Model(&next).Update("role", "admin").Error; err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
 func (s *GroupService) UpdateMemberRole(groupID, userID, memberID uint, newRole string) error {
-	if newRole != "admin" && newRole != "member" {
+	if newRole != "admin" && newRole != "member" && newRole != "restricted" {
 		return errors.New("invalid role")
 	}
 
@@ -210,3 +569,110 @@ func (s *GroupService) UpdateMemberRole(groupID, userID, memberID uint, newRole
 		Where("group_id = ? AND user_id = ?", groupID, memberID).
 		Update("role", newRole).Error
 }
+
+const maxNicknameLength = 32
+
+// SetMemberNickname sets a member's per-group display name. Members can set
+// their own; admins can set anyone's. An empty nickname clears it.
+func (s *GroupService) SetMemberNickname(groupID, userID, memberID uint, nickname string) error {
+	nickname = strings.TrimSpace(nickname)
+	if utf8.RuneCountInString(nickname) > maxNicknameLength {
+		return fmt.Errorf("nickname must be at most %d characters", maxNicknameLength)
+	}
+
+	if userID != memberID {
+		var member models.GroupMember
+		if err := s.db.Where("group_id = ? AND user_id = ? AND role = ?", groupID, userID, "admin").
+			First(&member).Error; err != nil {
+			return errors.New("only admins can change other members' nicknames")
+		}
+	}
+
+	result := s.db.Model(&models.GroupMember{}).
+		Where("group_id = ? AND user_id = ?", groupID, memberID).
+		Update("nickname", nickname)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return gorm.ErrRecordNotFound
+	}
+	return nil
+}
+
+// checkGroupAddPolicy enforces the target's group_add_policy. "contacts" means
+// the two users already share a private chat.
+func (s *GroupService) checkGroupAddPolicy(adderID, targetID uint) error {
+	var target models.User
+	if err := s.db.Select("id", "group_add_policy").First(&target, targetID).Error; err != nil {
+		return fmt.Errorf("user %d not found", targetID)
+	}
+
+	// A block is reported like a "nobody" policy so it isn't revealed
+	if blockedBetween(s.db, adderID, targetID) {
+		return fmt.Errorf("user %d does not allow being added to groups", targetID)
+	}
+
+	switch target.GroupAddPolicy {
+	case "nobody":
+		return fmt.Errorf("user %d does not allow being added to groups", targetID)
+	case "contacts":
+		var count int64
+		s.db.Model(&models.Chat{}).
+			Where("type = ? AND ((user1_id = ? AND user2_id = ?) OR (user1_id = ? AND user2_id = ?))",
+				"private", adderID, targetID, targetID, adderID).
+			Count(&count)
+		if count == 0 {
+			return fmt.Errorf("user %d only allows contacts to add them to groups", targetID)
+		}
+	}
+
+	return nil
+}
+
+// MessageReadStat is the number of current members, excluding the sender,
+// who have received and read a group message.
+type MessageReadStat struct {
+	MessageID      uint      `json:"message_id"`
+	SenderID       uint      `json:"sender_id"`
+	CreatedAt      time.Time `json:"created_at"`
+	DeliveredCount int64     `json:"delivered_count"`
+	ReadCount      int64     `json:"read_count"`
+}
+
+// GetGroupReadStats returns aggregate delivery and read counts for the
+// group's most recent messages. Only admins can see them, and only counts are
+// exposed, never who read what.
+func (s *GroupService) GetGroupReadStats(groupID, adminID uint, limit int) (int64, []MessageReadStat, error) {
+	var member models.GroupMember
+	if err := s.db.Where("group_id = ? AND user_id = ? AND role = ?", groupID, adminID, "admin").
+		First(&member).Error; err != nil {
+		return 0, nil, errors.New("only admins can view read stats")
+	}
+
+	var chat models.Chat
+	if err := s.db.Where("group_id = ? AND type = ?", groupID, "group").First(&chat).Error; err != nil {
+		return 0, nil, err
+	}
+
+	var memberCount int64
+	if err := s.db.Model(&models.GroupMember{}).Where("group_id = ?", groupID).Count(&memberCount).Error; err != nil {
+		return 0, nil, err
+	}
+
+	members := s.db.Model(&models.GroupMember{}).Select("user_id").Where("group_id = ?", groupID)
+
+	stats := []MessageReadStat{}
+	err := s.db.Model(&models.Message{}).
+		Select(`messages.id AS message_id, messages.sender_id, messages.created_at,
+			COUNT(DISTINCT message_statuses.user_id) AS delivered_count,
+			COUNT(DISTINCT CASE WHEN message_statuses.status = 'read' THEN message_statuses.user_id END) AS read_count`).
+		Joins("LEFT JOIN message_statuses ON message_statuses.message_id = messages.id AND message_statuses.user_id <> messages.sender_id AND message_statuses.user_id IN (?)", members).
+		Where("messages.chat_id = ? AND messages.type <> ?", chat.ID, "system").
+		Group("messages.id").
+		Order("messages.created_at DESC").
+		Limit(limit).
+		Scan(&stats).Error
+
+	return memberCount, stats, err
+}
@@ -0,0 +1,55 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"gorm.io/gorm"
+	"onechat/internal/models"
+)
+
+func TestLeaveGroupDeletesEmptyGroup(t *testing.T) {
+	db := testDB(t)
+	service := NewGroupService(db, 0, 4096)
+
+	admin := createTestUser(t, db, "admin")
+	member := createTestUser(t, db, "member")
+
+	group := &models.Group{Name: "Book club", CreatedByID: admin.ID}
+	if err := db.Create(group).Error; err != nil {
+		t.Fatal(err)
+	}
+	members := []models.GroupMember{
+		{GroupID: group.ID, UserID: admin.ID, Role: "admin", JoinedAt: time.Now()},
+		{GroupID: group.ID, UserID: member.ID, Role: "member", JoinedAt: time.Now().Add(time.Second)},
+	}
+	if err := db.Create(&members).Error; err != nil {
+		t.Fatal(err)
+	}
+	chat := &models.Chat{Type: "group", GroupID: &group.ID}
+	if err := db.Create(chat).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	promoted, err := service.LeaveGroup(group.ID, admin.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if promoted == nil || promoted.UserID != member.ID {
+		t.Fatalf("promoted = %v, want the remaining member", promoted)
+	}
+	if err := db.First(&models.Group{}, group.ID).Error; err != nil {
+		t.Fatalf("group with a member left was deleted: %v", err)
+	}
+
+	if _, err := service.LeaveGroup(group.ID, member.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.First(&models.Group{}, group.ID).Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("empty group was not deleted: %v", err)
+	}
+	if err := db.First(&models.Chat{}, chat.ID).Error; !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Errorf("empty group's chat was not deleted: %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// LoginLimiter locks out a phone number from one client IP after too many
+// failed logins in a window. Keying on both means an attacker guessing from
+// one address can't lock the real user out everywhere else. Counters are kept
+// in memory.
+type LoginLimiter struct {
+	maxFailures int
+	window      time.Duration
+	mu          sync.Mutex
+	failures    map[string]*loginFailures
+	lastSweep   time.Time
+}
+
+type loginFailures struct {
+	windowStart time.Time
+	count       int
+}
+
+func NewLoginLimiter(maxFailures int, window time.Duration) *LoginLimiter {
+	return &LoginLimiter{
+		maxFailures: maxFailures,
+		window:      window,
+		failures:    make(map[string]*loginFailures),
+		lastSweep:   time.Now(),
+	}
+}
+
+// Allow reports whether a login attempt may proceed. When it may not, it
+// also returns the time the lockout ends.
+func (l *LoginLimiter) Allow(phone, ip string) (bool, time.Time) {
+	if l.maxFailures <= 0 {
+		return true, time.Time{}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	f, ok := l.failures[loginKey(phone, ip)]
+	if !ok || time.Since(f.windowStart) >= l.window {
+		return true, time.Time{}
+	}
+	if f.count >= l.maxFailures {
+		return false, f.windowStart.Add(l.window)
+	}
+	return true, time.Time{}
+}
+
+// RecordFailure counts a failed login. The window starts at the first
+// failure, so a lockout lasts at most one window.
+func (l *LoginLimiter) RecordFailure(phone, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	key := loginKey(phone, ip)
+	f, ok := l.failures[key]
+	if !ok || now.Sub(f.windowStart) >= l.window {
+		f = &loginFailures{windowStart: now}
+		l.failures[key] = f
+	}
+	f.count++
+
+	// Keys are attacker-chosen, so drop expired ones now and then to keep the
+	// map from growing without bound
+	if now.Sub(l.lastSweep) >= l.window {
+		for k, v := range l.failures {
+			if now.Sub(v.windowStart) >= l.window {
+				delete(l.failures, k)
+			}
+		}
+		l.lastSweep = now
+	}
+}
+
+// Reset clears the failure count after a successful login.
+func (l *LoginLimiter) Reset(phone, ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, loginKey(phone, ip))
+}
+
+func loginKey(phone, ip string) string {
+	return normalizePhoneDigits(phone) + "|" + ip
+}
@@ -1,46 +1,63 @@
 package services
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
-	// Removed unused "io" import
+	"io"
 	"log"
 	"mime/multipart"
+	"net/http"
+	"strings"
 	"time"
 
-	"[github.com/cloudinary/cloudinary-go/v2](https://github.com/cloudinary/cloudinary-go/v2)"
-	"[github.com/cloudinary/cloudinary-go/v2/api/uploader](https://github.com/cloudinary/cloudinary-go/v2/api/uploader)"
 	"gorm.io/gorm"
 	"onechat/internal/models"
 )
 
 type MediaService struct {
-	db            *gorm.DB
-	cloudinary    *cloudinary.Cloudinary
-	cloudinaryURL string
+	db             *gorm.DB
+	storage        Storage
+	maxUploadBytes int64
+	allowedTypes   []string
 }
 
-type UploadResult struct {
-	URL      string `json:"url"`
-	PublicID string `json:"public_id"`
-	Type     string `json:"type"`
+// UploadTooLargeError is returned by CheckUpload when a file exceeds the
+// per-file size limit.
+type UploadTooLargeError struct {
+	Limit int64
 }
 
-func NewMediaService(cloudinaryURL string) *MediaService {
-	var cld *cloudinary.Cloudinary
-	var err error
+func (e *UploadTooLargeError) Error() string {
+	return fmt.Sprintf("file exceeds maximum upload size of %d bytes", e.Limit)
+}
 
-	if cloudinaryURL != "" {
-		cld, err = cloudinary.NewFromURL(cloudinaryURL)
-		if err != nil {
-			log.Printf("Failed to initialize Cloudinary: %v", err)
-		}
-	}
+// UnsupportedMediaTypeError is returned by CheckUpload when a file's type is
+// not on the allowlist.
+type UnsupportedMediaTypeError struct {
+	ContentType string
+	Allowed     []string
+}
+
+func (e *UnsupportedMediaTypeError) Error() string {
+	return fmt.Sprintf("file type %s is not allowed", e.ContentType)
+}
 
+type UploadResult struct {
+	ID           uint   `json:"id,omitempty"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	PublicID     string `json:"public_id"`
+	Type         string `json:"type"`
+}
+
+// NewMediaService keeps uploads in storage. A nil storage disables uploads.
+func NewMediaService(storage Storage, maxUploadBytes int64, allowedTypes []string) *MediaService {
 	return &MediaService{
-		cloudinary:    cld,
-		cloudinaryURL: cloudinaryURL,
+		storage:        storage,
+		maxUploadBytes: maxUploadBytes,
+		allowedTypes:   allowedTypes,
 	}
 }
 
@@ -48,46 +65,58 @@ func (s *MediaService) SetDB(db *gorm.DB) {
 	s.db = db
 }
 
-func (s *MediaService) Upload(file multipart.File, fileHeader *multipart.FileHeader, userID uint) (*UploadResult, error) {
-	if s.cloudinary == nil {
-		return nil, errors.New("Cloudinary not configured")
+// Configured reports whether a storage backend was set up successfully.
+func (s *MediaService) Configured() bool {
+	return s.storage != nil
+}
+
+// CheckUpload enforces the size limit and type allowlist and returns the
+// file's content type, sniffing it when the client didn't send a useful one.
+func (s *MediaService) CheckUpload(file multipart.File, fileHeader *multipart.FileHeader) (string, error) {
+	if s.maxUploadBytes > 0 && fileHeader.Size > s.maxUploadBytes {
+		return "", &UploadTooLargeError{Limit: s.maxUploadBytes}
 	}
 
 	contentType := fileHeader.Header.Get("Content-Type")
-	var resourceType string
-	var folder string
+	if contentType == "" || contentType == "application/octet-stream" {
+		var err error
+		if contentType, err = sniffContentType(file); err != nil {
+			return "", fmt.Errorf("failed to read upload: %w", err)
+		}
+	}
 
-	switch {
-	case len(contentType) >= 5 && contentType[:5] == "image":
-		resourceType = "image"
-		folder = "onechat/images"
-	case len(contentType) >= 5 && contentType[:5] == "video":
-		resourceType = "video"
-		folder = "onechat/videos"
-	case len(contentType) >= 5 && contentType[:5] == "audio":
-		resourceType = "video" 
-		folder = "onechat/audio"
-	default:
-		resourceType = "raw"
-		folder = "onechat/documents"
+	for _, allowed := range s.allowedTypes {
+		if strings.HasPrefix(contentType, allowed) {
+			return contentType, nil
+		}
 	}
+	return "", &UnsupportedMediaTypeError{ContentType: contentType, Allowed: s.allowedTypes}
+}
 
-	ctx := context.Background()
-	uploadParams := uploader.UploadParams{
-		Folder:       folder,
-		ResourceType: resourceType,
+// MaxUploadBytes is the per-file size limit, or 0 for none.
+func (s *MediaService) MaxUploadBytes() int64 {
+	return s.maxUploadBytes
+}
+
+// Upload stores a file that has passed CheckUpload, using the content type
+// it returned.
+func (s *MediaService) Upload(file multipart.File, fileHeader *multipart.FileHeader, contentType string, userID uint) (*UploadResult, error) {
+	if s.storage == nil {
+		return nil, ErrStorageNotConfigured
 	}
 
-	result, err := s.cloudinary.Upload.Upload(ctx, file, uploadParams)
+	resourceType, folder := classifyMedia(contentType)
+
+	result, err := s.storage.Upload(context.Background(), file, folder, resourceType, fileHeader.Filename, false)
 	if err != nil {
-		return nil, fmt.Errorf("failed to upload to Cloudinary: %w", err)
+		return nil, err
 	}
 
 	media := &models.Media{
 		UserID:    userID,
 		Type:      resourceType,
-		URL:       result.SecureURL,
-		PublicID:  result.PublicID,
+		URL:       result.URL,
+		PublicID:  result.ID,
 		Size:      fileHeader.Size,
 		ExpiresAt: time.Now().Add(10 * 24 * time.Hour),
 	}
@@ -96,32 +125,265 @@ func (s *MediaService) Upload(file multipart.File, fileHeader *multipart.FileHea
 		s.db.Create(media)
 	}
 
+	// Uploads are private, so the preview comes with a signature that
+	// doesn't expire
+	thumbnail, err := s.GetThumbnailURL(media, 0)
+	if err != nil {
+		log.Printf("Failed to sign thumbnail for %s: %v", result.ID, err)
+	}
+
 	return &UploadResult{
-		URL:      result.SecureURL,
-		PublicID: result.PublicID,
-		Type:     resourceType,
+		ID:           media.ID,
+		URL:          result.URL,
+		ThumbnailURL: thumbnail,
+		PublicID:     result.ID,
+		Type:         resourceType,
 	}, nil
 }
 
-func (s *MediaService) Delete(publicID string) error {
-	if s.cloudinary == nil {
-		return errors.New("Cloudinary not configured")
+// GetThumbnailURL returns a link to a preview of an image or video upload
+// that expires after ttl where the storage supports it, or "" for other
+// kinds of file. Audio is stored as video but has no frames to show.
+func (s *MediaService) GetThumbnailURL(media *models.Media, ttl time.Duration) (string, error) {
+	if media.ThumbnailURL != "" {
+		// Public uploads from before media was made private
+		return media.ThumbnailURL, nil
+	}
+	if s.storage == nil {
+		return "", ErrStorageNotConfigured
+	}
+
+	kind := media.Type
+	if kind == "video" && strings.Contains(media.PublicID, "onechat/audio/") {
+		return "", nil
+	}
+	if kind != "image" && kind != "video" {
+		return "", nil
+	}
+	return s.storage.SignedThumbnailURL(media.PublicID, kind, media.URL, ttl)
+}
+
+// thumbnailWidth is the width, in pixels, of generated thumbnails.
+const thumbnailWidth = 200
+
+// thumbnailURL derives a preview of the Cloudinary asset at url by adding a
+// delivery transformation: a scaled-down copy for images, and a JPEG poster
+// of the first frame for videos. Other kinds, such as audio and documents,
+// and files kept in other storage backends have no thumbnail and return "".
+func thumbnailURL(kind, url string) string {
+	const marker = "/upload/"
+	i := strings.Index(url, marker)
+	if i < 0 || !strings.Contains(url[:i], "res.cloudinary.com") {
+		return ""
+	}
+	base, rest := url[:i+len(marker)], url[i+len(marker):]
+
+	switch kind {
+	case "image":
+		if !strings.Contains(url[:i], "/image") {
+			return ""
+		}
+		return fmt.Sprintf("%sc_limit,w_%d/%s", base, thumbnailWidth, rest)
+	case "video":
+		if !strings.Contains(url[:i], "/video") {
+			return ""
+		}
+		if dot := strings.LastIndex(rest, "."); dot > strings.LastIndex(rest, "/") {
+			rest = rest[:dot]
+		}
+		return fmt.Sprintf("%sso_0,c_limit,w_%d/%s.jpg", base, thumbnailWidth, rest)
+	}
+	return ""
+}
+
+// classifyMedia picks the Cloudinary resource type and folder for a MIME
+// type. Anything unrecognised is stored as a raw document.
+func classifyMedia(contentType string) (resourceType, folder string) {
+	switch {
+	case strings.HasPrefix(contentType, "image/"):
+		return "image", "onechat/images"
+	case strings.HasPrefix(contentType, "video/"):
+		return "video", "onechat/videos"
+	case strings.HasPrefix(contentType, "audio/"):
+		// Cloudinary handles audio under the video resource type
+		return "video", "onechat/audio"
+	default:
+		return "raw", "onechat/documents"
+	}
+}
+
+// sniffContentType guesses the MIME type from the first 512 bytes and rewinds
+// the file so the whole of it is still uploaded.
+func sniffContentType(file multipart.File) (string, error) {
+	head := make([]byte, 512)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// ErrNotMediaOwner is returned when a user deletes media someone else uploaded.
+var ErrNotMediaOwner = errors.New("you can only delete your own media")
+
+// ErrNotAnImage is returned for an avatar whose contents aren't an image.
+var ErrNotAnImage = errors.New("avatar must be a JPEG, PNG, GIF or WebP image")
+
+// UploadAvatar stores an image as the user's profile picture and returns
+// the updated user. Avatars are public and never expire; the previous one
+// is deleted from storage once replaced. The file must have passed
+// CheckUpload, and its contents, not the type the client declared, have to
+// be an image.
+func (s *MediaService) UploadAvatar(file multipart.File, fileHeader *multipart.FileHeader, userID uint) (*models.User, error) {
+	if s.storage == nil {
+		return nil, ErrStorageNotConfigured
+	}
+	if s.db == nil {
+		return nil, errors.New("media storage not configured")
 	}
 
-	ctx := context.Background()
-	_, err := s.cloudinary.Upload.Destroy(ctx, uploader.DestroyParams{PublicID: publicID})
+	contentType, err := sniffContentType(file)
 	if err != nil {
+		return nil, fmt.Errorf("failed to read upload: %w", err)
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, ErrNotAnImage
+	}
+
+	var user models.User
+	if err := s.db.First(&user, userID).Error; err != nil {
+		return nil, err
+	}
+	previous := user.AvatarPublicID
+
+	result, err := s.storage.Upload(context.Background(), file, "onechat/avatars", "image", fileHeader.Filename, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.db.Model(&user).Updates(map[string]interface{}{
+		"profile_pic":      result.URL,
+		"avatar_public_id": result.ID,
+	}).Error; err != nil {
+		s.storage.Delete(context.Background(), result.ID, "image")
+		return nil, err
+	}
+
+	if previous != "" {
+		if err := s.storage.Delete(context.Background(), previous, "image"); err != nil {
+			log.Printf("Failed to delete previous avatar %s: %v", previous, err)
+		}
+	}
+	return &user, nil
+}
+
+// ErrMediaAccessDenied is returned when a user asks for a link to media
+// uploaded by someone they don't share a chat with.
+var ErrMediaAccessDenied = errors.New("you don't share a chat with this file's uploader")
+
+// GetSignedURL returns a link to an upload that expires after ttl.
+func (s *MediaService) GetSignedURL(publicID string, ttl time.Duration) (string, error) {
+	if s.storage == nil {
+		return "", ErrStorageNotConfigured
+	}
+
+	media := models.Media{PublicID: publicID}
+	if s.db != nil {
+		if err := s.db.Where("public_id = ?", publicID).First(&media).Error; err != nil {
+			return "", err
+		}
+	}
+	return s.storage.SignedURL(media.PublicID, media.Type, media.URL, ttl)
+}
+
+// GetViewableMedia returns an upload the user may view: their own, or one
+// from someone they share a private chat or group with.
+func (s *MediaService) GetViewableMedia(mediaID, userID uint) (*models.Media, error) {
+	if s.db == nil {
+		return nil, errors.New("media storage not configured")
+	}
+
+	var media models.Media
+	if err := s.db.First(&media, mediaID).Error; err != nil {
+		return nil, err
+	}
+	if media.UserID == userID {
+		return &media, nil
+	}
+
+	partners, err := chatPartners(s.db, userID, []uint{media.UserID})
+	if err != nil {
+		return nil, err
+	}
+	if len(partners) == 0 {
+		return nil, ErrMediaAccessDenied
+	}
+	return &media, nil
+}
+
+// GetUserMedia returns the user's uploads that haven't expired, newest first.
+func (s *MediaService) GetUserMedia(userID uint, limit, offset int) ([]models.Media, error) {
+	if s.db == nil {
+		return nil, errors.New("media storage not configured")
+	}
+
+	media := []models.Media{}
+	err := s.db.Where("user_id = ? AND expires_at > ?", userID, time.Now()).
+		Order("created_at DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&media).Error
+	return media, err
+}
+
+// DeleteUserMedia removes one of the user's uploads from storage and the
+// database before it expires.
+func (s *MediaService) DeleteUserMedia(publicID string, userID uint) error {
+	if s.db == nil {
+		return errors.New("media storage not configured")
+	}
+
+	var media models.Media
+	if err := s.db.Where("public_id = ?", publicID).First(&media).Error; err != nil {
+		return err
+	}
+
+	if media.UserID != userID {
+		return ErrNotMediaOwner
+	}
+
+	return s.deleteMedia(&media)
+}
+
+func (s *MediaService) Delete(publicID string) error {
+	media := &models.Media{PublicID: publicID}
+	if s.db != nil {
+		s.db.Where("public_id = ?", publicID).First(media)
+	}
+	return s.deleteMedia(media)
+}
+
+// deleteMedia removes the stored file and its row.
+func (s *MediaService) deleteMedia(media *models.Media) error {
+	if s.storage == nil {
+		return ErrStorageNotConfigured
+	}
+
+	if err := s.storage.Delete(context.Background(), media.PublicID, media.Type); err != nil {
 		return err
 	}
 
 	if s.db != nil {
-		s.db.Where("public_id = ?", publicID).Delete(&models.Media{})
+		s.db.Where("public_id = ?", media.PublicID).Delete(&models.Media{})
 	}
 	return nil
 }
 
 func (s *MediaService) StartCleanupScheduler(interval time.Duration) {
-	if s.cloudinary == nil || s.db == nil {
+	if s.storage == nil || s.db == nil {
 		return
 	}
 	ticker := time.NewTicker(interval)
@@ -129,29 +391,26 @@ func (s *MediaService) StartCleanupScheduler(interval time.Duration) {
 		for range ticker.C {
 			var expired []models.Media
 			s.db.Where("expires_at < ?", time.Now()).Find(&expired)
-			for _, m := range expired {
-				s.Delete(m.PublicID)
+			for i := range expired {
+				s.deleteMedia(&expired[i])
 			}
 		}
 	}()
 }
 
 func (s *MediaService) UploadFromBytes(data []byte, filename string, userID uint) (*UploadResult, error) {
-	if s.cloudinary == nil {
-		return nil, errors.New("Cloudinary not configured")
+	if s.storage == nil {
+		return nil, ErrStorageNotConfigured
 	}
 
-	ctx := context.Background()
-	result, err := s.cloudinary.Upload.Upload(ctx, bytes.NewReader(data), uploader.UploadParams{
-		Folder: "onechat/files",
-	})
+	result, err := s.storage.Upload(context.Background(), bytes.NewReader(data), "onechat/files", "auto", filename, false)
 	if err != nil {
 		return nil, err
 	}
 
 	return &UploadResult{
-		URL: result.SecureURL,
-		PublicID: result.PublicID,
-		Type: "file",
+		URL:      result.URL,
+		PublicID: result.ID,
+		Type:     "file",
 	}, nil
 }
@@ -0,0 +1,160 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"onechat/internal/models"
+)
+
+// recordingStorage keeps what it was asked to store instead of storing it.
+type recordingStorage struct {
+	folder       string
+	resourceType string
+}
+
+func (s *recordingStorage) Upload(ctx context.Context, r io.Reader, folder, resourceType, filename string, public bool) (*StoredFile, error) {
+	s.folder, s.resourceType = folder, resourceType
+	return &StoredFile{URL: "https://files.example.com/" + filename, ID: filename}, nil
+}
+
+func (s *recordingStorage) Delete(ctx context.Context, id, resourceType string) error {
+	return nil
+}
+
+func (s *recordingStorage) SignedURL(id, resourceType, url string, ttl time.Duration) (string, error) {
+	return url, nil
+}
+
+func (s *recordingStorage) SignedThumbnailURL(id, kind, url string, ttl time.Duration) (string, error) {
+	return url + "?thumbnail=" + kind, nil
+}
+
+// formFile builds a multipart upload of body, sent with the given
+// Content-Type header, or none when it's empty.
+func formFile(t *testing.T, body []byte, contentType string) (multipart.File, *multipart.FileHeader) {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="file"; filename="upload.bin"`)
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	part, err := w.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(body)
+	w.Close()
+
+	form, err := multipart.NewReader(&buf, w.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { form.RemoveAll() })
+
+	fileHeader := form.File["file"][0]
+	file, err := fileHeader.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { file.Close() })
+	return file, fileHeader
+}
+
+func TestMediaServiceUploadContentTypes(t *testing.T) {
+	png := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR")
+	text := []byte("meeting notes")
+
+	tests := []struct {
+		name         string
+		body         []byte
+		header       string
+		resourceType string
+		folder       string
+	}{
+		{"no content type", text, "", "raw", "onechat/documents"},
+		{"no content type, sniffed image", png, "", "image", "onechat/images"},
+		{"octet stream, sniffed image", png, "application/octet-stream", "image", "onechat/images"},
+		{"shorter than a prefix", text, "img", "raw", "onechat/documents"},
+		{"prefix without subtype", text, "image", "raw", "onechat/documents"},
+		{"text", text, "text/plain", "raw", "onechat/documents"},
+		{"pdf", text, "application/pdf", "raw", "onechat/documents"},
+		{"image", png, "image/png", "image", "onechat/images"},
+		{"video", text, "video/mp4", "video", "onechat/videos"},
+		{"audio", text, "audio/mpeg", "video", "onechat/audio"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := &recordingStorage{}
+			service := NewMediaService(storage, 0, []string{""})
+			file, fileHeader := formFile(t, tt.body, tt.header)
+
+			contentType, err := service.CheckUpload(file, fileHeader)
+			if err != nil {
+				t.Fatalf("CheckUpload: %v", err)
+			}
+			result, err := service.Upload(file, fileHeader, contentType, 1)
+			if err != nil {
+				t.Fatalf("Upload: %v", err)
+			}
+
+			if result.Type != tt.resourceType || storage.resourceType != tt.resourceType {
+				t.Errorf("resource type = %q (stored as %q), want %q", result.Type, storage.resourceType, tt.resourceType)
+			}
+			if storage.folder != tt.folder {
+				t.Errorf("folder = %q, want %q", storage.folder, tt.folder)
+			}
+		})
+	}
+}
+
+func TestMediaServiceUploadEmptyContentType(t *testing.T) {
+	storage := &recordingStorage{}
+	service := NewMediaService(storage, 0, nil)
+	file, fileHeader := formFile(t, []byte("notes"), "")
+
+	result, err := service.Upload(file, fileHeader, "", 1)
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if result.Type != "raw" {
+		t.Errorf("resource type = %q, want raw", result.Type)
+	}
+}
+
+func TestMediaServiceGetThumbnailURL(t *testing.T) {
+	service := NewMediaService(&recordingStorage{}, 0, nil)
+
+	tests := []struct {
+		name  string
+		media models.Media
+		want  string
+	}{
+		{"image", models.Media{Type: "image", PublicID: "onechat/images/a", URL: "https://files.example.com/a"}, "https://files.example.com/a?thumbnail=image"},
+		{"video", models.Media{Type: "video", PublicID: "onechat/videos/b", URL: "https://files.example.com/b"}, "https://files.example.com/b?thumbnail=video"},
+		{"audio", models.Media{Type: "video", PublicID: "onechat/audio/c", URL: "https://files.example.com/c"}, ""},
+		{"document", models.Media{Type: "raw", PublicID: "onechat/documents/d", URL: "https://files.example.com/d"}, ""},
+		{"stored public thumbnail", models.Media{Type: "image", PublicID: "onechat/images/e", ThumbnailURL: "https://files.example.com/e_small"}, "https://files.example.com/e_small"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := service.GetThumbnailURL(&tt.media, time.Hour)
+			if err != nil {
+				t.Fatalf("GetThumbnailURL: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("GetThumbnailURL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
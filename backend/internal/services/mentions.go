@@ -0,0 +1,73 @@
+package services
+
+import (
+	"regexp"
+	"strings"
+
+	"onechat/internal/models"
+)
+
+// mentionPattern matches @username tokens, using the characters usernames
+// may contain. The @ has to start the text or follow whitespace or an
+// opening bracket or quote, so email addresses and URLs such as
+// https://example.com/@name aren't mistaken for mentions.
+var mentionPattern = regexp.MustCompile(`(?:^|[\s(\[{"'])@([A-Za-z0-9._]+)`)
+
+// codePattern matches fenced code blocks and inline code spans, whose
+// contents never mention anyone.
+var codePattern = regexp.MustCompile("(?s)```.*?```|`[^`\n]*`")
+
+// resolveMentions finds the members of a group chat that content mentions,
+// other than the sender. Tokens only count when they name an actual member,
+// ignoring case; anything else that looks like a mention is left alone.
+func (s *ChatService) resolveMentions(chatID, senderID uint, content string) []models.MessageMention {
+	if !strings.Contains(content, "@") {
+		return nil
+	}
+
+	// Lowercased candidate name to the name as written. A token may end
+	// with sentence punctuation, which usernames can also contain, so both
+	// readings are tried.
+	written := make(map[string]string)
+	for _, match := range mentionPattern.FindAllStringSubmatch(codePattern.ReplaceAllString(content, " "), -1) {
+		for _, name := range []string{match[1], strings.TrimRight(match[1], ".")} {
+			if name != "" {
+				if _, ok := written[strings.ToLower(name)]; !ok {
+					written[strings.ToLower(name)] = name
+				}
+			}
+		}
+	}
+	if len(written) == 0 {
+		return nil
+	}
+
+	var chat models.Chat
+	if err := s.db.Select("id", "type", "group_id").First(&chat, chatID).Error; err != nil ||
+		chat.Type != "group" || chat.GroupID == nil {
+		return nil
+	}
+
+	names := make([]string, 0, len(written))
+	for name := range written {
+		names = append(names, name)
+	}
+	var members []models.User
+	if err := s.db.Select("users.id", "users.username").
+		Joins("JOIN group_members ON group_members.user_id = users.id AND group_members.deleted_at IS NULL").
+		Where("group_members.group_id = ? AND LOWER(users.username) IN ?", *chat.GroupID, names).
+		Where("users.id <> ?", senderID).
+		Order("users.id").
+		Find(&members).Error; err != nil {
+		return nil
+	}
+
+	mentions := make([]models.MessageMention, 0, len(members))
+	for _, member := range members {
+		mentions = append(mentions, models.MessageMention{
+			UserID:   member.ID,
+			Username: written[strings.ToLower(member.Username)],
+		})
+	}
+	return mentions
+}
@@ -1,8 +1,17 @@
 package services
 
-import "log"
+import (
+	"fmt"
+	"log"
+	"time"
+	"unicode/utf8"
+
+	"gorm.io/gorm"
+	"onechat/internal/models"
+)
 
 type NotificationService struct {
+	db *gorm.DB
 	// FCM client will go here in future
 }
 
@@ -13,8 +22,8 @@ type Notification struct {
 	Data   map[string]string
 }
 
-func NewNotificationService() *NotificationService {
-	return &NotificationService{}
+func NewNotificationService(db *gorm.DB) *NotificationService {
+	return &NotificationService{db: db}
 }
 
 func (s *NotificationService) SendNotification(notification *Notification) error {
@@ -35,3 +44,127 @@ func (s *NotificationService) SendBulkNotifications(notifications []*Notificatio
 	}
 	return nil
 }
+
+const notificationPreviewLength = 100
+
+// NotifyNewMessage pushes a new message to the given recipients. Recipients
+// who muted the chat, through its notification settings or a mute that
+// hasn't expired, are skipped, and each one's chosen sound and custom chat
+// name are applied.
+func (s *NotificationService) NotifyNewMessage(message *models.Message, recipientIDs []uint) error {
+	if len(recipientIDs) == 0 {
+		return nil
+	}
+
+	var settings []models.ChatNotificationSetting
+	if err := s.db.Where("chat_id = ? AND user_id IN ?", message.ChatID, recipientIDs).
+		Find(&settings).Error; err != nil {
+		return err
+	}
+	byUser := make(map[uint]models.ChatNotificationSetting, len(settings))
+	for _, setting := range settings {
+		byUser[setting.UserID] = setting
+	}
+
+	var mutedIDs []uint
+	if err := s.db.Model(&models.ChatMute{}).
+		Where("chat_id = ? AND user_id IN ?", message.ChatID, recipientIDs).
+		Where("muted_until IS NULL OR muted_until > ?", time.Now()).
+		Pluck("user_id", &mutedIDs).Error; err != nil {
+		return err
+	}
+	muted := make(map[uint]bool, len(mutedIDs))
+	for _, id := range mutedIDs {
+		muted[id] = true
+	}
+
+	title := "New message"
+	if message.Sender != nil {
+		title = message.Sender.Username
+	}
+
+	notifications := make([]*Notification, 0, len(recipientIDs))
+	for _, userID := range recipientIDs {
+		setting := byUser[userID]
+		if setting.Muted || muted[userID] {
+			continue
+		}
+
+		notif := &Notification{
+			UserID: userID,
+			Title:  title,
+			Body:   messagePreview(message),
+			Data: map[string]string{
+				"chat_id":    fmt.Sprint(message.ChatID),
+				"message_id": fmt.Sprint(message.ID),
+			},
+		}
+		if setting.CustomName != "" {
+			notif.Title = fmt.Sprintf("%s (%s)", title, setting.CustomName)
+		}
+		if setting.Sound != "" {
+			notif.Data["sound"] = setting.Sound
+		}
+		notifications = append(notifications, notif)
+	}
+
+	return s.SendBulkNotifications(notifications)
+}
+
+// NotifyMention tells the given users a message mentioned them. Unlike
+// NotifyNewMessage it ignores mutes: being mentioned is meant to get through.
+func (s *NotificationService) NotifyMention(message *models.Message, userIDs []uint) error {
+	title := "You were mentioned"
+	if message.Sender != nil {
+		title = message.Sender.Username + " mentioned you"
+	}
+
+	notifications := make([]*Notification, 0, len(userIDs))
+	for _, userID := range userIDs {
+		notifications = append(notifications, &Notification{
+			UserID: userID,
+			Title:  title,
+			Body:   messagePreview(message),
+			Data: map[string]string{
+				"chat_id":    fmt.Sprint(message.ChatID),
+				"message_id": fmt.Sprint(message.ID),
+				"mention":    "true",
+			},
+		})
+	}
+	return s.SendBulkNotifications(notifications)
+}
+
+// NotifyEventReminder reminds the event's owner that it starts soon.
+func (s *NotificationService) NotifyEventReminder(event *models.Event) error {
+	body := fmt.Sprintf("Starts at %s", event.EventDate.Format("Mon 2 Jan 15:04"))
+	if event.Location != "" && event.Location != "Not specified" {
+		body += " · " + event.Location
+	}
+
+	return s.SendNotification(&Notification{
+		UserID: event.UserID,
+		Title:  event.Title,
+		Body:   body,
+		Data: map[string]string{
+			"type":     "event_reminder",
+			"event_id": fmt.Sprint(event.ID),
+		},
+	})
+}
+
+func messagePreview(message *models.Message) string {
+	if message.Type == "location" && message.LocationLabel != "" {
+		return "📍 " + message.LocationLabel
+	}
+	if message.Type == "contact" {
+		return "👤 " + message.ContactName
+	}
+	if message.Type != "text" && message.Type != "system" {
+		return fmt.Sprintf("[%s]", message.Type)
+	}
+	if utf8.RuneCountInString(message.Content) <= notificationPreviewLength {
+		return message.Content
+	}
+	return string([]rune(message.Content)[:notificationPreviewLength]) + "…"
+}
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+	"onechat/internal/models"
+)
+
+// MaxPresenceQuery bounds how many users one presence query can ask about.
+const MaxPresenceQuery = 100
+
+// UserPresence is a user's online state as another user may see it.
+// LastSeen is only set while the user is offline, and only if their
+// last_seen_privacy lets the viewer see it.
+type UserPresence struct {
+	UserID   uint       `json:"user_id"`
+	IsOnline bool       `json:"is_online"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// GetPresence returns the stored presence of those of userIDs that share a
+// private chat or group with viewerID and haven't blocked them. Other IDs
+// are left out, so presence can't be probed for strangers. The stored state
+// lags behind live connections on this instance, which callers can overlay.
+func (s *ChatService) GetPresence(viewerID uint, userIDs []uint) ([]UserPresence, error) {
+	partners, err := chatPartners(s.db, viewerID, userIDs)
+	if err != nil || len(partners) == 0 {
+		return []UserPresence{}, err
+	}
+
+	contacts, err := privateChatPartners(s.db, viewerID, partners)
+	if err != nil {
+		return nil, err
+	}
+	isContact := make(map[uint]bool, len(contacts))
+	for _, id := range contacts {
+		isContact[id] = true
+	}
+
+	var users []models.User
+	if err := s.db.Select("id", "is_online", "last_seen", "last_seen_privacy").
+		Where("id IN ?", partners).
+		Where("id NOT IN (?)", s.db.Model(&models.BlockedUser{}).Select("user_id").Where("blocked_id = ?", viewerID)).
+		Order("id").
+		Find(&users).Error; err != nil {
+		return nil, err
+	}
+
+	presence := make([]UserPresence, 0, len(users))
+	for _, user := range users {
+		p := UserPresence{UserID: user.ID, IsOnline: user.IsOnline}
+		if !user.IsOnline && LastSeenVisible(user.LastSeenPrivacy, isContact[user.ID]) {
+			p.LastSeen = user.LastSeen
+		}
+		presence = append(presence, p)
+	}
+	return presence, nil
+}
+
+// LastSeenVisible reports whether a user's last_seen_privacy setting lets
+// a viewer see when they were last online. Contacts are users who share a
+// private chat, as for group_add_policy.
+func LastSeenVisible(privacy string, contact bool) bool {
+	switch privacy {
+	case "everyone":
+		return true
+	case "nobody":
+		return false
+	default:
+		return contact
+	}
+}
+
+// LastSeenAudience returns the user's last_seen_privacy setting and, when
+// it's "contacts", the users allowed to see their last seen time.
+func (s *ChatService) LastSeenAudience(userID uint) (string, []uint, error) {
+	var user models.User
+	if err := s.db.Select("id", "last_seen_privacy").First(&user, userID).Error; err != nil {
+		return "", nil, err
+	}
+	if user.LastSeenPrivacy != "contacts" {
+		return user.LastSeenPrivacy, nil, nil
+	}
+	contacts, err := privateChatPartners(s.db, userID, nil)
+	return user.LastSeenPrivacy, contacts, err
+}
+
+// chatPartners returns those of candidates that share a private chat or a
+// group with userID.
+func chatPartners(db *gorm.DB, userID uint, candidates []uint) ([]uint, error) {
+	if len(candidates) == 0 {
+		return nil, nil
+	}
+
+	private, err := privateChatPartners(db, userID, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	var grouped []uint
+	if err := db.Table("group_members AS a").
+		Joins("JOIN group_members AS b ON b.group_id = a.group_id AND b.deleted_at IS NULL").
+		Where("a.user_id = ? AND a.deleted_at IS NULL AND b.user_id IN ?", userID, candidates).
+		Distinct().
+		Pluck("b.user_id", &grouped).Error; err != nil {
+		return nil, err
+	}
+
+	seen := make(map[uint]bool)
+	var partners []uint
+	for _, id := range append(private, grouped...) {
+		if !seen[id] {
+			seen[id] = true
+			partners = append(partners, id)
+		}
+	}
+	return partners, nil
+}
+
+// privateChatPartners returns the users userID has a private chat with,
+// limited to candidates unless that's nil.
+func privateChatPartners(db *gorm.DB, userID uint, candidates []uint) ([]uint, error) {
+	query := db.Model(&models.Chat{}).Where("type = ?", "private")
+	if candidates == nil {
+		query = query.Where("user1_id = ? OR user2_id = ?", userID, userID)
+	} else {
+		query = query.Where("(user1_id = ? AND user2_id IN ?) OR (user2_id = ? AND user1_id IN ?)", userID, candidates, userID, candidates)
+	}
+
+	var partners []uint
+	err := query.Select("CASE WHEN user1_id = ? THEN user2_id ELSE user1_id END", userID).
+		Scan(&partners).Error
+	return partners, err
+}
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidRecurrence is returned for a recurrence rule that can't be
+// parsed.
+var ErrInvalidRecurrence = errors.New("invalid recurrence rule")
+
+// recurrence is a parsed Event.RecurrenceRule. Rules are either one of the
+// shorthands "daily", "weekly" and "monthly", or a subset of an iCalendar
+// RRULE: FREQ (DAILY, WEEKLY or MONTHLY) with optional INTERVAL, COUNT and
+// UNTIL, e.g. "FREQ=WEEKLY;INTERVAL=2;COUNT=10".
+type recurrence struct {
+	freq     string // daily, weekly or monthly
+	interval int
+	count    int       // total occurrences including the first; 0 means unbounded
+	until    time.Time // last possible start; zero means unbounded
+}
+
+// maxOccurrences bounds how many occurrences one expansion returns.
+const maxOccurrences = 1000
+
+// parseRecurrence parses a recurrence rule. An empty rule means the event
+// doesn't repeat, and returns nil.
+func parseRecurrence(rule string) (*recurrence, error) {
+	rule = strings.TrimSpace(rule)
+	if rule == "" {
+		return nil, nil
+	}
+
+	switch strings.ToLower(rule) {
+	case "daily", "weekly", "monthly":
+		return &recurrence{freq: strings.ToLower(rule), interval: 1}, nil
+	}
+
+	r := &recurrence{interval: 1}
+	for _, part := range strings.Split(strings.TrimPrefix(strings.ToUpper(rule), "RRULE:"), ";") {
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidRecurrence, part)
+		}
+
+		switch key {
+		case "FREQ":
+			switch value {
+			case "DAILY", "WEEKLY", "MONTHLY":
+				r.freq = strings.ToLower(value)
+			default:
+				return nil, fmt.Errorf("%w: FREQ must be DAILY, WEEKLY or MONTHLY", ErrInvalidRecurrence)
+			}
+		case "INTERVAL", "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("%w: %s must be a positive integer", ErrInvalidRecurrence, key)
+			}
+			if key == "INTERVAL" {
+				r.interval = n
+			} else {
+				r.count = n
+			}
+		case "UNTIL":
+			until, err := parseRRuleTime(value)
+			if err != nil {
+				return nil, fmt.Errorf("%w: UNTIL must be YYYYMMDD or YYYYMMDDTHHMMSSZ", ErrInvalidRecurrence)
+			}
+			r.until = until
+		default:
+			return nil, fmt.Errorf("%w: %s is not supported", ErrInvalidRecurrence, key)
+		}
+	}
+
+	if r.freq == "" {
+		return nil, fmt.Errorf("%w: FREQ is required", ErrInvalidRecurrence)
+	}
+	if r.count > 0 && !r.until.IsZero() {
+		return nil, fmt.Errorf("%w: COUNT and UNTIL can't both be set", ErrInvalidRecurrence)
+	}
+	return r, nil
+}
+
+func parseRRuleTime(value string) (time.Time, error) {
+	if t, err := time.Parse("20060102T150405Z", value); err == nil {
+		return t, nil
+	}
+	// A date-only UNTIL includes the whole of that day
+	t, err := time.Parse("20060102", value)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t.Add(24*time.Hour - time.Nanosecond), nil
+}
+
+// occurrences returns the starts of the series beginning at start that fall
+// within [from, to], oldest first. Occurrences are computed on the wall
+// clock in loc, so a weekly 9:00 event stays at 9:00 across DST changes.
+// Monthly events on a day some months lack, such as the 31st, skip those
+// months, as RFC 5545 does, rather than spilling into the next month.
+func (r *recurrence) occurrences(start time.Time, loc *time.Location, from, to time.Time) []time.Time {
+	start = start.In(loc)
+	y, m, d := start.Date()
+	hh, mm, ss := start.Clock()
+	ns := start.Nanosecond()
+
+	// Daily and weekly series never skip, so they can jump close to from
+	// rather than stepping through every earlier occurrence
+	k := 0
+	if r.freq != "monthly" && from.After(start) {
+		days := 1
+		if r.freq == "weekly" {
+			days = 7
+		}
+		k = int(from.Sub(start).Hours()/24)/(days*r.interval) - 1
+		if k < 0 {
+			k = 0
+		}
+	}
+
+	var out []time.Time
+	for n := k; len(out) < maxOccurrences; k++ {
+		var t time.Time
+		switch r.freq {
+		case "daily":
+			t = localDate(y, m, d+k*r.interval, hh, mm, ss, ns, loc)
+		case "weekly":
+			t = localDate(y, m, d+7*k*r.interval, hh, mm, ss, ns, loc)
+		case "monthly":
+			t = localDate(y, m+time.Month(k*r.interval), d, hh, mm, ss, ns, loc)
+		}
+
+		if t.After(to) || (!r.until.IsZero() && t.After(r.until)) {
+			break
+		}
+		if r.freq == "monthly" && t.Day() != d {
+			continue // this month is too short
+		}
+		n++
+		if r.count > 0 && n > r.count {
+			break
+		}
+		if !t.Before(from) {
+			out = append(out, t)
+		}
+	}
+	return out
+}
+
+// rrule renders the recurrence as an iCalendar RRULE value.
+func (r *recurrence) rrule() string {
+	parts := []string{"FREQ=" + strings.ToUpper(r.freq)}
+	if r.interval > 1 {
+		parts = append(parts, fmt.Sprintf("INTERVAL=%d", r.interval))
+	}
+	if r.count > 0 {
+		parts = append(parts, fmt.Sprintf("COUNT=%d", r.count))
+	}
+	if !r.until.IsZero() {
+		parts = append(parts, "UNTIL="+r.until.UTC().Format("20060102T150405Z"))
+	}
+	return strings.Join(parts, ";")
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+	"onechat/internal/models"
+)
+
+type ReportService struct {
+	db          *gorm.DB
+	chatService *ChatService
+}
+
+func NewReportService(db *gorm.DB, chatService *ChatService) *ReportService {
+	return &ReportService{
+		db:          db,
+		chatService: chatService,
+	}
+}
+
+// ReportMessage files a report against a message, snapshotting its content
+// at the time of reporting.
+func (s *ReportService) ReportMessage(messageID, reporterID uint, notes string) (*models.Report, error) {
+	var message models.Message
+	if err := s.db.First(&message, messageID).Error; err != nil {
+		return nil, err
+	}
+
+	if !s.chatService.IsChatMember(message.ChatID, reporterID) {
+		return nil, errors.New("not a member of this chat")
+	}
+
+	if message.SenderID == reporterID {
+		return nil, errors.New("cannot report your own message")
+	}
+
+	report := &models.Report{
+		ReporterID:      reporterID,
+		MessageID:       message.ID,
+		ChatID:          message.ChatID,
+		SenderID:        message.SenderID,
+		MessageType:     message.Type,
+		ContentSnapshot: message.Content,
+		MediaSnapshot:   message.MediaURL,
+		MessageSentAt:   message.CreatedAt,
+		Notes:           notes,
+		Status:          "open",
+	}
+
+	if err := s.db.Create(report).Error; err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// ListReports returns reports newest first, optionally filtered by status.
+func (s *ReportService) ListReports(status string, limit, offset int) ([]models.Report, error) {
+	query := s.db.Preload("Reporter")
+	if status != "" {
+		query = query.Where("status = ?", status)
+	}
+
+	var reports []models.Report
+	err := query.Order("created_at DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&reports).Error
+
+	return reports, err
+}
@@ -0,0 +1,65 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// UploadLimiter enforces a per-user cap on uploads per minute and bytes per
+// day. Counters are kept in memory and reset when their window elapses.
+type UploadLimiter struct {
+	perMinute  int
+	dailyBytes int64
+	mu         sync.Mutex
+	usage      map[uint]*uploadUsage
+}
+
+type uploadUsage struct {
+	minuteStart time.Time
+	minuteCount int
+	dayStart    time.Time
+	dayBytes    int64
+}
+
+func NewUploadLimiter(perMinute int, dailyBytes int64) *UploadLimiter {
+	return &UploadLimiter{
+		perMinute:  perMinute,
+		dailyBytes: dailyBytes,
+		usage:      make(map[uint]*uploadUsage),
+	}
+}
+
+// Allow records an upload of size bytes for the user if it fits within both
+// limits. When it doesn't, it returns false and the time the blocking limit
+// resets.
+func (l *UploadLimiter) Allow(userID uint, size int64) (bool, time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	u, ok := l.usage[userID]
+	if !ok {
+		u = &uploadUsage{minuteStart: now, dayStart: now}
+		l.usage[userID] = u
+	}
+
+	if now.Sub(u.minuteStart) >= time.Minute {
+		u.minuteStart = now
+		u.minuteCount = 0
+	}
+	if now.Sub(u.dayStart) >= 24*time.Hour {
+		u.dayStart = now
+		u.dayBytes = 0
+	}
+
+	if l.perMinute > 0 && u.minuteCount >= l.perMinute {
+		return false, u.minuteStart.Add(time.Minute)
+	}
+	if l.dailyBytes > 0 && u.dayBytes+size > l.dailyBytes {
+		return false, u.dayStart.Add(24 * time.Hour)
+	}
+
+	u.minuteCount++
+	u.dayBytes += size
+	return true, time.Time{}
+}
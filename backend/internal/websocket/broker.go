@@ -0,0 +1,162 @@
+package websocket
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Broker relays broadcasts between server instances, so clients connected
+// to different instances behind a load balancer still reach each other.
+type Broker interface {
+	Publish(payload []byte) error
+	// Subscribe hands every published payload to handle until ctx is done.
+	Subscribe(ctx context.Context, handle func(payload []byte))
+	Close() error
+}
+
+// envelope is a broadcast as sent between instances. Origin lets an
+// instance skip its own broadcasts, which it has already delivered locally.
+type envelope struct {
+	Origin       string          `json:"origin"`
+	Kind         string          `json:"kind"` // chat, user, all, evict or disconnect
+	ChatID       uint            `json:"chat_id,omitempty"`
+	UserID       uint            `json:"user_id,omitempty"`
+	Conn         string          `json:"conn,omitempty"` // connection to close, for evict
+	Exclude      uint            `json:"exclude,omitempty"`
+	ExcludeUsers []uint          `json:"exclude_users,omitempty"`
+	MessageID    uint            `json:"message_id,omitempty"`
+	Message      json.RawMessage `json:"message,omitempty"`
+}
+
+// SetBroker makes the hub share its broadcasts with other instances through
+// broker. It must be called before Run. Without a broker the hub only
+// reaches clients connected to this instance.
+func (h *Hub) SetBroker(broker Broker) {
+	h.broker = broker
+}
+
+// newInstanceID returns a random ID for this instance, used as the origin
+// of its broadcasts and to name its connections.
+func newInstanceID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// publish sends a broadcast to the other instances, if there are any.
+func (h *Hub) publish(env envelope) {
+	if h.broker == nil {
+		return
+	}
+	select {
+	case <-h.quit:
+		return
+	default:
+	}
+
+	env.Origin = h.origin
+	payload, err := json.Marshal(env)
+	if err != nil {
+		log.Printf("Failed to encode broadcast: %v", err)
+		return
+	}
+	if err := h.broker.Publish(payload); err != nil {
+		log.Printf("Failed to publish broadcast: %v", err)
+	}
+}
+
+// handleRemote delivers a broadcast from another instance to the clients
+// connected here.
+func (h *Hub) handleRemote(payload []byte) {
+	var env envelope
+	if err := json.Unmarshal(payload, &env); err != nil {
+		log.Printf("Failed to decode broadcast: %v", err)
+		return
+	}
+	if env.Origin == h.origin {
+		return
+	}
+
+	switch env.Kind {
+	case "chat":
+		h.queue(&BroadcastMessage{
+			ChatID:       env.ChatID,
+			Message:      env.Message,
+			Exclude:      env.Exclude,
+			ExcludeUsers: env.ExcludeUsers,
+			MessageID:    env.MessageID,
+		})
+	case "user":
+		h.sendToUserLocal(env.UserID, env.Message)
+	case "all":
+		h.sendToAllLocal(env.Message)
+	case "evict":
+		h.evictLocal(env.UserID, env.Conn)
+	case "disconnect":
+		h.disconnectLocal(env.UserID)
+	}
+}
+
+// redisChannel is the pub/sub channel instances share.
+const redisChannel = "onechat:ws"
+
+// RedisBroker relays broadcasts over Redis pub/sub.
+type RedisBroker struct {
+	client *redis.Client
+}
+
+// NewRedisBroker connects to the Redis server at url, e.g.
+// redis://:password@host:6379/0.
+func NewRedisBroker(url string) (*RedisBroker, error) {
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Redis URL: %w", err)
+	}
+
+	client := redis.NewClient(opts)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+
+	return &RedisBroker{client: client}, nil
+}
+
+func (b *RedisBroker) Publish(payload []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	return b.client.Publish(ctx, redisChannel, payload).Err()
+}
+
+// Subscribe listens on the shared channel. The client reconnects on its own
+// if the connection to Redis drops.
+func (b *RedisBroker) Subscribe(ctx context.Context, handle func(payload []byte)) {
+	pubsub := b.client.Subscribe(ctx, redisChannel)
+	defer pubsub.Close()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			handle([]byte(msg.Payload))
+		}
+	}
+}
+
+func (b *RedisBroker) Close() error {
+	return b.client.Close()
+}
@@ -1,36 +1,101 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
+	"onechat/internal/models"
 	"onechat/internal/services"
 )
 
+const (
+	// Time allowed to write a frame to the peer
+	writeWait = 10 * time.Second
+	// Time allowed to read the next pong from the peer
+	pongWait = 60 * time.Second
+	// Pings are sent at this interval, which must be shorter than pongWait
+	pingPeriod = (pongWait * 9) / 10
+	// Largest frame accepted from a client unless SetFrameLimits says otherwise
+	defaultMaxFrameSize = 64 * 1024
+	// A typing indicator is cleared if no typing frame follows within this
+	typingTimeout = 5 * time.Second
+)
+
 type Client struct {
-	ID       uint
-	Hub      *Hub
-	Conn     *websocket.Conn
-	Send     chan []byte
-	ChatRooms map[uint]bool
+	ID              uint
+	Hub             *Hub
+	Conn            *websocket.Conn
+	Send            chan []byte
+	ChatRooms       map[uint]bool
+	CompressMinSize int // Frames smaller than this are sent uncompressed; 0 disables compression
+
+	closed bool   // Send has been closed; guarded by Hub.mu
+	connID string // names the connection in the shared presence
 }
 
 type Hub struct {
-	clients       map[uint]*Client
-	chatRooms     map[uint]map[*Client]bool
-	register      chan *Client
-	unregister    chan *Client
-	broadcast     chan *BroadcastMessage
-	mu            sync.RWMutex
-	chatService   *services.ChatService
+	clients     map[uint][]*Client // A user's connections, oldest first
+	chatRooms   map[uint]map[*Client]bool
+	register    chan *Client
+	unregister  chan *Client
+	broadcast   chan *BroadcastMessage
+	mu          sync.RWMutex
+	chatService *services.ChatService
+	authService *services.AuthService
+	maxPerUser  int
+
+	typingMu  sync.Mutex
+	typing    map[typingKey]typingState
+	typingSeq uint64
+
+	quit     chan struct{} // closed by Stop
+	stopped  chan struct{} // closed when Run has returned
+	stopOnce sync.Once
+
+	broker Broker // shares broadcasts with other instances; nil when running alone
+	origin string // identifies this instance's broadcasts and connections
+
+	presence        Presence                       // shares online state with other instances; nil when running alone
+	presenceOps     chan func(ctx context.Context) // updates for runPresence to apply in order
+	presenceStarted bool                           // a heartbeat has succeeded; used only by runPresence
+	connSeq         uint64                         // numbers connections; used only by Run
+
+	sendMessage MessageSender // handles send_message frames; nil disables them
+
+	maxFrameSize int64   // largest frame accepted from a client
+	frameRate    float64 // frames per second a client may send; 0 means unlimited
+	frameBurst   int     // frames a client may send at once before frameRate applies
+}
+
+// MessageSender stores and broadcasts a message a client sent over its
+// socket. payload has the same fields as the REST send request. It acks the
+// message to the sender itself, and returns an error the hub reports back.
+type MessageSender func(senderID, chatID uint, payload json.RawMessage) error
+
+type typingKey struct {
+	chatID uint
+	userID uint
+}
+
+// typingState holds the pending stop_typing timer. seq identifies the timer
+// so one that fires after being replaced does nothing.
+type typingState struct {
+	seq   uint64
+	timer *time.Timer
 }
 
 type BroadcastMessage struct {
-	ChatID  uint
-	Message []byte
-	Exclude uint // User ID to exclude from broadcast
+	ChatID       uint
+	Message      []byte
+	Exclude      uint   // User ID to exclude from broadcast
+	ExcludeUsers []uint // Further user IDs to skip, e.g. users blocked by the sender
+	MessageID    uint   // Set for new_message broadcasts so recipients get delivery receipts
 }
 
 type WSMessage struct {
@@ -39,65 +104,390 @@ type WSMessage struct {
 	Payload json.RawMessage `json:"payload"`
 }
 
-func NewHub(chatService *services.ChatService) *Hub {
+// NewHub creates a hub that allows each user up to maxPerUser simultaneous
+// connections; 0 means unlimited.
+func NewHub(chatService *services.ChatService, authService *services.AuthService, maxPerUser int) *Hub {
 	return &Hub{
-		clients:     make(map[uint]*Client),
+		clients:     make(map[uint][]*Client),
 		chatRooms:   make(map[uint]map[*Client]bool),
 		register:    make(chan *Client),
 		unregister:  make(chan *Client),
 		broadcast:   make(chan *BroadcastMessage, 256),
 		chatService: chatService,
+		authService: authService,
+		maxPerUser:  maxPerUser,
+		typing:      make(map[typingKey]typingState),
+		quit:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+		origin:      newInstanceID(),
+
+		maxFrameSize: defaultMaxFrameSize,
+	}
+}
+
+// SetFrameLimits bounds what each client may send: frames larger than
+// maxFrameSize bytes close the connection, and frames beyond a token bucket
+// of framesPerSecond with the given burst are dropped. A client that keeps
+// sending while limited is disconnected. A framesPerSecond of 0 turns off
+// rate limiting. It must be called before clients connect.
+func (h *Hub) SetFrameLimits(maxFrameSize int64, framesPerSecond float64, burst int) {
+	if maxFrameSize > 0 {
+		h.maxFrameSize = maxFrameSize
+	}
+	h.frameRate = framesPerSecond
+	h.frameBurst = burst
+}
+
+// Stop ends Run and closes every connection with a going-away frame, so
+// clients know to reconnect rather than treating it as an error. It returns
+// once all connections have been closed.
+func (h *Hub) Stop() {
+	h.stopOnce.Do(func() { close(h.quit) })
+	<-h.stopped
+}
+
+// closeAll disconnects every client as the hub shuts down.
+func (h *Hub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	closed := 0
+	for _, conns := range h.clients {
+		// removeClient edits the slice being ranged over, so work on a copy
+		for _, client := range append([]*Client(nil), conns...) {
+			h.removeClient(client)
+			client.Conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"),
+				time.Now().Add(time.Second),
+			)
+			closed++
+		}
+	}
+	log.Printf("Closed %d WebSocket connections", closed)
+}
+
+// broadcastChat delivers a chat broadcast here and on other instances.
+func (h *Hub) broadcastChat(message *BroadcastMessage) {
+	h.queue(message)
+	h.publish(envelope{
+		Kind:         "chat",
+		ChatID:       message.ChatID,
+		Exclude:      message.Exclude,
+		ExcludeUsers: message.ExcludeUsers,
+		MessageID:    message.MessageID,
+		Message:      message.Message,
+	})
+}
+
+// queue hands a message to Run, dropping it if the hub has stopped so
+// callers never block on a hub that is no longer reading.
+func (h *Hub) queue(message *BroadcastMessage) {
+	select {
+	case h.broadcast <- message:
+	case <-h.quit:
 	}
 }
 
 func (h *Hub) Run() {
+	defer close(h.stopped)
+
+	if h.broker != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer func() {
+			cancel()
+			h.broker.Close()
+		}()
+		go h.broker.Subscribe(ctx, h.handleRemote)
+	}
+
+	var presenceDone chan struct{}
+	if h.presence != nil {
+		presenceDone = make(chan struct{})
+		go h.runPresence(presenceDone)
+	}
+
 	for {
 		select {
+		case <-h.quit:
+			h.closeAll()
+			if h.presence != nil {
+				// Wait for pending updates so none lands after leaving
+				<-presenceDone
+				h.leaveShared()
+			}
+			return
+
 		case client := <-h.register:
 			h.mu.Lock()
-			h.clients[client.ID] = client
+			h.connSeq++
+			client.connID = fmt.Sprintf("%s:%d", h.origin, h.connSeq)
+			cameOnline := len(h.clients[client.ID]) == 0
+			// Make room by closing the user's oldest connection. With shared
+			// presence the limit covers every instance instead
+			if h.presence == nil && h.maxPerUser > 0 && len(h.clients[client.ID]) >= h.maxPerUser {
+				oldest := h.clients[client.ID][0]
+				h.removeClient(oldest)
+				oldest.Conn.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "connection limit reached"),
+					time.Now().Add(time.Second),
+				)
+				log.Printf("Client %d exceeded %d connections, closed oldest", client.ID, h.maxPerUser)
+			}
+			h.clients[client.ID] = append(h.clients[client.ID], client)
 			h.mu.Unlock()
 			log.Printf("Client %d connected", client.ID)
 
+			if h.presence != nil {
+				h.connectShared(client)
+			} else if cameOnline {
+				go h.announcePresence(client.ID, true)
+			}
+
 		case client := <-h.unregister:
 			h.mu.Lock()
-			if _, ok := h.clients[client.ID]; ok {
-				delete(h.clients, client.ID)
-				close(client.Send)
-				
-				// Remove from all chat rooms
-				for chatID := range client.ChatRooms {
-					if room, exists := h.chatRooms[chatID]; exists {
-						delete(room, client)
-						if len(room) == 0 {
-							delete(h.chatRooms, chatID)
-						}
-					}
-				}
-			}
+			removed := h.removeClient(client)
+			wentOffline := removed && len(h.clients[client.ID]) == 0
 			h.mu.Unlock()
 			log.Printf("Client %d disconnected", client.ID)
 
+			if h.presence != nil {
+				if removed {
+					h.disconnectShared(client)
+				}
+			} else if wentOffline {
+				go h.announcePresence(client.ID, false)
+			}
+
 		case message := <-h.broadcast:
+			var delivered []uint
+			var stalled []*Client
 			h.mu.RLock()
 			if room, ok := h.chatRooms[message.ChatID]; ok {
 				for client := range room {
-					if client.ID != message.Exclude {
+					if client.ID != message.Exclude && !message.excludes(client.ID) {
 						select {
 						case client.Send <- message.Message:
+							delivered = append(delivered, client.ID)
 						default:
-							close(client.Send)
-							delete(h.clients, client.ID)
+							stalled = append(stalled, client)
 						}
 					}
 				}
 			}
 			h.mu.RUnlock()
+
+			// Clients that can't keep up are dropped under the write lock;
+			// mutating the maps under RLock would race with other readers
+			if len(stalled) > 0 {
+				h.dropClients(stalled)
+			}
+
+			if message.MessageID != 0 && len(delivered) > 0 {
+				go h.markDelivered(message.MessageID, delivered)
+			}
+		}
+	}
+}
+
+func (m *BroadcastMessage) excludes(userID uint) bool {
+	for _, id := range m.ExcludeUsers {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// removeClient drops a connection, closes its send channel and takes it out
+// of its chat rooms. It reports whether the client was still registered. The
+// caller must hold the write lock.
+func (h *Hub) removeClient(client *Client) bool {
+	if !h.removeConnection(client) {
+		return false
+	}
+	client.closed = true
+	close(client.Send)
+
+	for chatID := range client.ChatRooms {
+		if room, exists := h.chatRooms[chatID]; exists {
+			delete(room, client)
+			if len(room) == 0 {
+				delete(h.chatRooms, chatID)
+			}
 		}
 	}
+	return true
 }
 
-func (h *Hub) JoinChatRoom(client *Client, chatID uint) {
+// dropClients disconnects clients whose send buffer is full and announces
+// any user left without a connection as offline.
+func (h *Hub) dropClients(clients []*Client) {
+	var offline []uint
+	var removed []*Client
+	h.mu.Lock()
+	for _, client := range clients {
+		if h.removeClient(client) {
+			log.Printf("Send buffer full for client %d, disconnecting", client.ID)
+			removed = append(removed, client)
+			if len(h.clients[client.ID]) == 0 {
+				offline = append(offline, client.ID)
+			}
+		}
+	}
+	h.mu.Unlock()
+
+	if h.presence != nil {
+		for _, client := range removed {
+			h.disconnectShared(client)
+		}
+		return
+	}
+	for _, userID := range offline {
+		go h.announcePresence(userID, false)
+	}
+}
+
+// DisconnectUser closes every connection the user has, on any instance,
+// for example once their account is deleted and their tokens stop working.
+func (h *Hub) DisconnectUser(userID uint) {
+	h.disconnectLocal(userID)
+	h.publish(envelope{Kind: "disconnect", UserID: userID})
+}
+
+// disconnectLocal closes the user's connections on this instance and
+// announces them as offline.
+func (h *Hub) disconnectLocal(userID uint) {
+	h.mu.Lock()
+	clients := append([]*Client(nil), h.clients[userID]...)
+	for _, client := range clients {
+		h.removeClient(client)
+		client.Conn.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "signed out"),
+			time.Now().Add(time.Second),
+		)
+	}
+	h.mu.Unlock()
+
+	if len(clients) == 0 {
+		return
+	}
+	log.Printf("Closed %d connections of user %d", len(clients), userID)
+	if h.presence != nil {
+		for _, client := range clients {
+			h.disconnectShared(client)
+		}
+		return
+	}
+	go h.announcePresence(userID, false)
+}
+
+// announcePresence stores the user's online state and tells every chat they
+// belong to. Offline events carry the new last_seen time for the users the
+// user's last_seen_privacy allows; with "contacts", those get their event
+// directly and the chat rooms get one without it.
+func (h *Hub) announcePresence(userID uint, online bool) {
+	lastSeen, err := h.authService.SetPresence(userID, online)
+	if err != nil {
+		log.Printf("Failed to update presence for user %d: %v", userID, err)
+	}
+
+	chatIDs, err := h.chatService.GetUserChatIDs(userID)
+	if err != nil {
+		log.Printf("Failed to load chats for user %d: %v", userID, err)
+		return
+	}
+
+	// Users they've blocked don't get to see them come and go
+	blocked, err := h.authService.BlockedUserIDs(userID)
+	if err != nil {
+		log.Printf("Failed to load blocks for user %d: %v", userID, err)
+		return
+	}
+
+	event := map[string]interface{}{
+		"type":      "presence",
+		"user_id":   userID,
+		"is_online": online,
+	}
+	exclude := blocked
+	if !online {
+		privacy, contacts, err := h.chatService.LastSeenAudience(userID)
+		if err != nil {
+			log.Printf("Failed to load last seen privacy for user %d: %v", userID, err)
+		}
+
+		if services.LastSeenVisible(privacy, false) {
+			event["last_seen"] = lastSeen
+		} else if len(contacts) > 0 {
+			withLastSeen := map[string]interface{}{"last_seen": lastSeen}
+			for key, value := range event {
+				withLastSeen[key] = value
+			}
+			full, _ := json.Marshal(withLastSeen)
+
+			isBlocked := make(map[uint]bool, len(blocked))
+			for _, id := range blocked {
+				isBlocked[id] = true
+			}
+			for _, contactID := range contacts {
+				if !isBlocked[contactID] {
+					h.SendToUser(contactID, full)
+				}
+			}
+			exclude = append(append([]uint{}, blocked...), contacts...)
+		}
+	}
+	presence, _ := json.Marshal(event)
+
+	for _, chatID := range chatIDs {
+		h.broadcastChat(&BroadcastMessage{
+			ChatID:       chatID,
+			Message:      presence,
+			Exclude:      userID,
+			ExcludeUsers: exclude,
+		})
+	}
+}
+
+// removeConnection deletes the client from its user's connection list and
+// reports whether it was there.
+func (h *Hub) removeConnection(client *Client) bool {
+	conns := h.clients[client.ID]
+	for i, c := range conns {
+		if c == client {
+			conns = append(conns[:i], conns[i+1:]...)
+			if len(conns) == 0 {
+				delete(h.clients, client.ID)
+			} else {
+				h.clients[client.ID] = conns
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Register adds the client to the hub. It reports false if the hub has
+// stopped, in which case the connection should be closed.
+func (h *Hub) Register(client *Client) bool {
+	select {
+	case h.register <- client:
+		return true
+	case <-h.quit:
+		return false
+	}
+}
+
+// JoinChatRoom subscribes the client to a chat's broadcasts. Only members of
+// the chat may join.
+func (h *Hub) JoinChatRoom(client *Client, chatID uint) error {
+	if !h.chatService.IsChatMember(chatID, client.ID) {
+		return errors.New("not a member of this chat")
+	}
+
 	h.mu.Lock()
 	defer h.mu.Unlock()
 
@@ -108,6 +498,66 @@ func (h *Hub) JoinChatRoom(client *Client, chatID uint) {
 	client.ChatRooms[chatID] = true
 	
 	log.Printf("Client %d joined chat room %d", client.ID, chatID)
+	return nil
+}
+
+// inChatRoom reports whether the client has joined the chat's room.
+func (h *Hub) inChatRoom(client *Client, chatID uint) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.chatRooms[chatID][client]
+}
+
+// sendError queues an error frame for the client without blocking.
+func (c *Client) sendError(chatID uint, msg string) {
+	frame, _ := json.Marshal(map[string]interface{}{
+		"type":    "error",
+		"chat_id": chatID,
+		"error":   msg,
+	})
+	c.Hub.sendToClient(c, frame)
+}
+
+// sendToClient queues a frame for one connection without blocking. The read
+// lock keeps removeClient from closing Send mid-send, and a client it has
+// already removed gets nothing.
+func (h *Hub) sendToClient(client *Client, frame []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if client.closed {
+		return
+	}
+	select {
+	case client.Send <- frame:
+	default:
+	}
+}
+
+// handleSendMessage creates a message from a send_message frame. Failures
+// are answered with an error frame carrying the client's temporary ID, so
+// the client can tell which of its pending messages failed.
+func (c *Client) handleSendMessage(wsMsg WSMessage) {
+	var ids struct {
+		ClientID string `json:"client_id"`
+	}
+	json.Unmarshal(wsMsg.Payload, &ids)
+
+	err := errors.New("sending messages over WebSocket is not enabled")
+	if c.Hub.sendMessage != nil {
+		err = c.Hub.sendMessage(c.ID, wsMsg.ChatID, wsMsg.Payload)
+	}
+	if err == nil {
+		return
+	}
+
+	frame, _ := json.Marshal(map[string]interface{}{
+		"type":      "error",
+		"chat_id":   wsMsg.ChatID,
+		"client_id": ids.ClientID,
+		"error":     err.Error(),
+	})
+	c.Hub.sendToClient(c, frame)
 }
 
 func (h *Hub) LeaveChatRoom(client *Client, chatID uint) {
@@ -126,19 +576,234 @@ func (h *Hub) LeaveChatRoom(client *Client, chatID uint) {
 }
 
 func (h *Hub) BroadcastToChat(chatID uint, message []byte, excludeUserID uint) {
-	h.broadcast <- &BroadcastMessage{
+	h.broadcastChat(&BroadcastMessage{
 		ChatID:  chatID,
 		Message: message,
 		Exclude: excludeUserID,
+	})
+}
+
+// BroadcastNewMessage fans a new_message payload out to the chat room and
+// records a delivered receipt for every recipient it reaches.
+func (h *Hub) BroadcastNewMessage(chatID, messageID uint, message []byte, senderID uint) {
+	h.broadcastChat(&BroadcastMessage{
+		ChatID:    chatID,
+		Message:   message,
+		Exclude:   senderID,
+		MessageID: messageID,
+	})
+}
+
+// SetMessageSender lets clients send messages with send_message frames,
+// handled by send. It must be called before clients connect.
+func (h *Hub) SetMessageSender(send MessageSender) {
+	h.sendMessage = send
+}
+
+// SendAck confirms to the sender's connections that their message was
+// stored, with its final ID and server timestamp. clientID is the temporary
+// ID the client gave the message, so it can reconcile its optimistic copy;
+// the sender's other devices use the message itself, since new_message
+// broadcasts skip the sender.
+func (h *Hub) SendAck(message *models.Message, clientID string) {
+	ack, _ := json.Marshal(map[string]interface{}{
+		"type":       "message_ack",
+		"client_id":  clientID,
+		"chat_id":    message.ChatID,
+		"message_id": message.ID,
+		"created_at": message.CreatedAt,
+		"message":    message,
+	})
+	h.SendToUser(message.SenderID, ack)
+}
+
+// SendToUser pushes a message directly to a connected user, regardless of
+// which chat rooms they have joined.
+func (h *Hub) SendToUser(userID uint, message []byte) {
+	h.sendToUserLocal(userID, message)
+	h.publish(envelope{Kind: "user", UserID: userID, Message: message})
+}
+
+func (h *Hub) sendToUserLocal(userID uint, message []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, client := range h.clients[userID] {
+		select {
+		case client.Send <- message:
+		default:
+			log.Printf("Send buffer full for client %d, dropping message", userID)
+		}
+	}
+}
+
+// IsOnline reports whether the user has at least one open connection, on
+// any instance when presence is shared.
+func (h *Hub) IsOnline(userID uint) bool {
+	h.mu.RLock()
+	local := len(h.clients[userID]) > 0
+	h.mu.RUnlock()
+	if local || h.presence == nil {
+		return local
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+	online, err := h.presence.IsOnline(ctx, userID)
+	if err != nil {
+		log.Printf("Failed to check presence of user %d: %v", userID, err)
+	}
+	return online
+}
+
+// SendToAll pushes a message to every connected client.
+func (h *Hub) SendToAll(message []byte) {
+	h.sendToAllLocal(message)
+	h.publish(envelope{Kind: "all", Message: message})
+}
+
+func (h *Hub) sendToAllLocal(message []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, conns := range h.clients {
+		for _, client := range conns {
+			select {
+			case client.Send <- message:
+			default:
+				log.Printf("Send buffer full for client %d, dropping message", client.ID)
+			}
+		}
 	}
 }
 
+// recordReceipt stores a delivered/read frame from a client and tells the
+// message's sender. The receipt is rebuilt from what was stored, so clients
+// can't spoof one for another user or a chat they aren't in.
+func (h *Hub) recordReceipt(userID uint, status string, payload json.RawMessage) {
+	var receipt struct {
+		MessageID uint `json:"message_id"`
+	}
+	if err := json.Unmarshal(payload, &receipt); err != nil || receipt.MessageID == 0 {
+		return
+	}
+
+	message, err := h.chatService.UpdateMessageStatus(receipt.MessageID, userID, status)
+	if err != nil {
+		return
+	}
+	h.SendReceipt(message, userID, status)
+}
+
+// SendReceipt tells the sender of a message, and nobody else, that userID
+// has received or read it.
+func (h *Hub) SendReceipt(message *models.Message, userID uint, status string) {
+	if message.SenderID == userID {
+		return
+	}
+	statusUpdate, _ := json.Marshal(map[string]interface{}{
+		"type":       "message_status",
+		"chat_id":    message.ChatID,
+		"message_id": message.ID,
+		"status":     status,
+		"user_id":    userID,
+	})
+	h.SendToUser(message.SenderID, statusUpdate)
+}
+
+func (h *Hub) markDelivered(messageID uint, recipientIDs []uint) {
+	seen := make(map[uint]bool)
+	for _, userID := range recipientIDs {
+		// A user with several connections is only marked once
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+
+		message, err := h.chatService.UpdateMessageStatus(messageID, userID, "delivered")
+		if err != nil {
+			log.Printf("Failed to record delivery of message %d to user %d: %v", messageID, userID, err)
+			continue
+		}
+		h.SendReceipt(message, userID, "delivered")
+	}
+}
+
+// touchTyping (re)starts the timer that sends stop_typing for the user if
+// they don't send another typing frame in time. This clears the indicator on
+// other clients even when the sender disconnects mid-typing.
+func (h *Hub) touchTyping(chatID, userID uint) {
+	key := typingKey{chatID: chatID, userID: userID}
+
+	h.typingMu.Lock()
+	defer h.typingMu.Unlock()
+
+	if state, ok := h.typing[key]; ok {
+		state.timer.Stop()
+	}
+	h.typingSeq++
+	seq := h.typingSeq
+	h.typing[key] = typingState{
+		seq:   seq,
+		timer: time.AfterFunc(typingTimeout, func() { h.expireTyping(key, seq) }),
+	}
+}
+
+// clearTyping cancels the user's pending stop_typing timer and reports
+// whether they were typing.
+func (h *Hub) clearTyping(chatID, userID uint) bool {
+	key := typingKey{chatID: chatID, userID: userID}
+
+	h.typingMu.Lock()
+	defer h.typingMu.Unlock()
+
+	state, ok := h.typing[key]
+	if ok {
+		state.timer.Stop()
+		delete(h.typing, key)
+	}
+	return ok
+}
+
+func (h *Hub) expireTyping(key typingKey, seq uint64) {
+	h.typingMu.Lock()
+	state, ok := h.typing[key]
+	if !ok || state.seq != seq {
+		h.typingMu.Unlock()
+		return
+	}
+	delete(h.typing, key)
+	h.typingMu.Unlock()
+
+	stop, _ := json.Marshal(map[string]interface{}{
+		"type":    "stop_typing",
+		"chat_id": key.chatID,
+		"user_id": key.userID,
+	})
+	h.BroadcastToChat(key.chatID, stop, key.userID)
+}
+
 func (c *Client) ReadPump() {
 	defer func() {
-		c.Hub.unregister <- c
+		// Once the hub has stopped it has already removed the client
+		select {
+		case c.Hub.unregister <- c:
+		case <-c.Hub.quit:
+		}
 		c.Conn.Close()
 	}()
 
+	// A peer that stops answering pings hits the read deadline, which ends
+	// this loop and unregisters the client
+	c.Conn.SetReadLimit(c.Hub.maxFrameSize)
+	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	limiter := newFrameLimiter(c.Hub.frameRate, c.Hub.frameBurst)
+	dropped := 0
+
 	for {
 		_, message, err := c.Conn.ReadMessage()
 		if err != nil {
@@ -148,6 +813,26 @@ func (c *Client) ReadPump() {
 			break
 		}
 
+		// Frames over the rate are dropped; a client that sends another
+		// burst's worth while limited is flooding and gets disconnected
+		if !limiter.allow(time.Now()) {
+			dropped++
+			if float64(dropped) > limiter.burst {
+				log.Printf("Disconnecting client %d for exceeding the frame rate", c.ID)
+				c.Conn.WriteControl(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"),
+					time.Now().Add(writeWait),
+				)
+				break
+			}
+			if dropped == 1 {
+				c.sendError(0, "rate limit exceeded, frames are being dropped")
+			}
+			continue
+		}
+		dropped = 0
+
 		var wsMsg WSMessage
 		if err := json.Unmarshal(message, &wsMsg); err != nil {
 			log.Printf("Error unmarshaling message: %v", err)
@@ -156,28 +841,61 @@ func (c *Client) ReadPump() {
 
 		switch wsMsg.Type {
 		case "join_chat":
-			c.Hub.JoinChatRoom(c, wsMsg.ChatID)
+			if err := c.Hub.JoinChatRoom(c, wsMsg.ChatID); err != nil {
+				c.sendError(wsMsg.ChatID, err.Error())
+			}
 		case "leave_chat":
 			c.Hub.LeaveChatRoom(c, wsMsg.ChatID)
 		case "typing":
-			c.Hub.BroadcastToChat(wsMsg.ChatID, message, c.ID)
+			// Only relay typing for rooms the client was allowed to join
+			if c.Hub.inChatRoom(c, wsMsg.ChatID) {
+				c.Hub.BroadcastToChat(wsMsg.ChatID, message, c.ID)
+				c.Hub.touchTyping(wsMsg.ChatID, c.ID)
+			}
+		case "stop_typing":
+			if c.Hub.inChatRoom(c, wsMsg.ChatID) && c.Hub.clearTyping(wsMsg.ChatID, c.ID) {
+				c.Hub.BroadcastToChat(wsMsg.ChatID, message, c.ID)
+			}
 		case "message_delivered":
-			c.Hub.BroadcastToChat(wsMsg.ChatID, message, c.ID)
+			c.Hub.recordReceipt(c.ID, "delivered", wsMsg.Payload)
 		case "message_read":
-			c.Hub.BroadcastToChat(wsMsg.ChatID, message, c.ID)
+			c.Hub.recordReceipt(c.ID, "read", wsMsg.Payload)
+		case "send_message":
+			// Handled in line so a client's messages are stored in the
+			// order it sent them
+			c.handleSendMessage(wsMsg)
 		}
 	}
 }
 
 func (c *Client) WritePump() {
+	ticker := time.NewTicker(pingPeriod)
 	defer func() {
+		ticker.Stop()
 		c.Conn.Close()
 	}()
 
-	for message := range c.Send {
-		if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
-			log.Printf("WebSocket write error: %v", err)
-			return
+	for {
+		select {
+		case message, ok := <-c.Send:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// The hub closed the channel
+				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			c.Conn.EnableWriteCompression(c.CompressMinSize > 0 && len(message) >= c.CompressMinSize)
+			if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				log.Printf("WebSocket write error: %v", err)
+				return
+			}
+
+		case <-ticker.C:
+			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
 		}
 	}
 }
@@ -0,0 +1,150 @@
+package websocket
+
+import (
+	"sync"
+	"testing"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"onechat/internal/services"
+)
+
+// newTestHub starts a hub whose services run against a database that is
+// never contacted: queries are only built, so presence updates the hub
+// makes as clients come and go succeed without doing anything.
+func newTestHub(t *testing.T) *Hub {
+	t.Helper()
+
+	db, err := gorm.Open(postgres.New(postgres.Config{DSN: "host=localhost dbname=onechat_test"}), &gorm.Config{
+		DryRun:               true,
+		DisableAutomaticPing: true,
+		Logger:               logger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hub := NewHub(services.NewChatService(db, 4096, 5, 0), services.NewAuthService(db, "secret", "refresh-secret"), 0)
+	go hub.Run()
+	return hub
+}
+
+// connect registers a client for the user with the given send buffer and
+// puts it in the chat's room. Rooms are joined directly because joining
+// through JoinChatRoom checks membership in the database.
+func connect(hub *Hub, userID, chatID uint, buffer int) *Client {
+	client := &Client{
+		ID:        userID,
+		Hub:       hub,
+		Send:      make(chan []byte, buffer),
+		ChatRooms: map[uint]bool{chatID: true},
+	}
+	hub.Register(client)
+
+	hub.mu.Lock()
+	if hub.chatRooms[chatID] == nil {
+		hub.chatRooms[chatID] = make(map[*Client]bool)
+	}
+	hub.chatRooms[chatID][client] = true
+	hub.mu.Unlock()
+	return client
+}
+
+// TestHubBroadcastWhileClientsDisconnect broadcasts to a room while clients
+// in it leave, join and fall behind, so that run with -race it catches
+// broadcasts touching clients or their channels as they are removed.
+func TestHubBroadcastWhileClientsDisconnect(t *testing.T) {
+	const (
+		chatID     = 1
+		users      = 10
+		senders    = 8
+		broadcasts = 200
+		churns     = 50
+	)
+	hub := newTestHub(t)
+
+	var clientsMu sync.Mutex
+	var clients []*Client
+	track := func(client *Client) {
+		clientsMu.Lock()
+		clients = append(clients, client)
+		clientsMu.Unlock()
+	}
+	drain := func(client *Client) {
+		go func() {
+			for range client.Send {
+			}
+		}()
+	}
+
+	// Each user keeps one connection that reads everything, next to one
+	// that never reads and is dropped once its buffer fills
+	var stalled []*Client
+	for userID := uint(1); userID <= users; userID++ {
+		anchor := connect(hub, userID, chatID, 256)
+		drain(anchor)
+		track(anchor)
+
+		slow := connect(hub, userID, chatID, 1)
+		stalled = append(stalled, slow)
+		track(slow)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < broadcasts; j++ {
+				hub.BroadcastToChat(chatID, []byte(`{"type":"new_message"}`), 0)
+				hub.SendToUser(uint(j%users)+1, []byte(`{"type":"chat_reminder"}`))
+			}
+		}()
+	}
+	for userID := uint(1); userID <= users; userID++ {
+		wg.Add(1)
+		go func(userID uint) {
+			defer wg.Done()
+			for j := 0; j < churns; j++ {
+				client := connect(hub, userID, chatID, 1)
+				track(client)
+				hub.sendToClient(client, []byte(`{"type":"error"}`))
+				if j%2 == 0 {
+					drain(client)
+				}
+				hub.unregister <- client
+			}
+		}(userID)
+	}
+	wg.Wait()
+
+	// Run handles broadcasts one at a time in the order they were queued, so
+	// once one queued now arrives, every earlier one was delivered or dropped
+	marker := connect(hub, users+1, chatID+1, 1)
+	hub.BroadcastToChat(chatID+1, []byte(`{"type":"new_message"}`), 0)
+	<-marker.Send
+	track(marker)
+
+	hub.mu.RLock()
+	for _, client := range stalled {
+		if !client.closed {
+			t.Errorf("client of user %d with a full send buffer was not dropped", client.ID)
+		}
+	}
+	for _, conns := range hub.clients {
+		for _, client := range conns {
+			if client.closed {
+				t.Errorf("closed client of user %d is still registered", client.ID)
+			}
+		}
+	}
+	hub.mu.RUnlock()
+
+	// Connections have no socket to send a close frame on, so remove them
+	// all before stopping
+	for _, client := range clients {
+		hub.unregister <- client
+	}
+	hub.Stop()
+}
@@ -0,0 +1,384 @@
+package websocket
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/redis/go-redis/v9"
+)
+
+// Presence tracks users' connections across every instance, so online state
+// and the per-user connection limit don't depend on which instance a user
+// happens to be connected to. Connections are named "<origin>:<n>", where
+// origin identifies the instance holding them.
+type Presence interface {
+	// Connect records one of the user's connections and reports whether
+	// it's their only one. When max > 0 and the user now has more than max
+	// connections, the oldest are dropped and returned for their instances
+	// to close.
+	Connect(ctx context.Context, userID uint, conn string, max int) (first bool, evicted []string, err error)
+	// Disconnect drops a connection and reports whether it was the user's
+	// last one anywhere.
+	Disconnect(ctx context.Context, userID uint, conn string) (last bool, err error)
+	// IsOnline reports whether the user has a connection on any instance.
+	IsOnline(ctx context.Context, userID uint) (bool, error)
+	// Heartbeat marks the instance as alive. It drops the connections of
+	// instances that stopped sending heartbeats and returns the users that
+	// left offline. expired reports that the instance wasn't marked alive
+	// before, either because it's new or because it missed its heartbeats
+	// and may have been given up for dead.
+	Heartbeat(ctx context.Context, origin string) (offline []uint, expired bool, err error)
+	// Leave drops all of the instance's connections as it shuts down and
+	// returns the users that left offline.
+	Leave(ctx context.Context, origin string) ([]uint, error)
+}
+
+const (
+	// Instances send heartbeats this often
+	presenceHeartbeat = 10 * time.Second
+	// An instance that hasn't sent a heartbeat for this long is taken to be
+	// gone, and its connections are dropped
+	presenceInstanceTTL = 30 * time.Second
+)
+
+// SetPresence makes the hub share online state and connection counts with
+// other instances through presence. It must be called before Run. Without
+// it both only cover this instance.
+func (h *Hub) SetPresence(presence Presence) {
+	h.presence = presence
+	h.presenceOps = make(chan func(ctx context.Context), 256)
+}
+
+// sharePresence queues a presence update. Updates run one at a time in the
+// order they were queued, so a connection is never dropped from the shared
+// state before it was recorded there.
+func (h *Hub) sharePresence(op func(ctx context.Context)) {
+	select {
+	case h.presenceOps <- op:
+	case <-h.quit:
+	}
+}
+
+// runPresence applies queued presence updates and sends heartbeats until
+// the hub stops. The first heartbeat goes out before any connection is
+// recorded, so other instances never take this one for dead.
+func (h *Hub) runPresence(done chan struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(presenceHeartbeat)
+	defer ticker.Stop()
+
+	h.heartbeat()
+	for {
+		select {
+		case <-h.quit:
+			return
+		case op := <-h.presenceOps:
+			ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+			op(ctx)
+			cancel()
+		case <-ticker.C:
+			h.heartbeat()
+		}
+	}
+}
+
+func (h *Hub) heartbeat() {
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+
+	offline, expired, err := h.presence.Heartbeat(ctx, h.origin)
+	if err != nil {
+		log.Printf("Failed to send presence heartbeat: %v", err)
+		return
+	}
+	for _, userID := range offline {
+		go h.announcePresence(userID, false)
+	}
+	if expired && h.presenceStarted {
+		h.restorePresence(ctx)
+	}
+	h.presenceStarted = true
+}
+
+// restorePresence records every local connection again after another
+// instance dropped them, taking this one for dead.
+func (h *Hub) restorePresence(ctx context.Context) {
+	h.mu.RLock()
+	var clients []*Client
+	for _, conns := range h.clients {
+		clients = append(clients, conns...)
+	}
+	h.mu.RUnlock()
+
+	log.Printf("Presence heartbeat was lost, recording %d connections again", len(clients))
+	for _, client := range clients {
+		first, _, err := h.presence.Connect(ctx, client.ID, client.connID, 0)
+		if err != nil {
+			log.Printf("Failed to record connection for user %d: %v", client.ID, err)
+			continue
+		}
+		if first {
+			go h.announcePresence(client.ID, true)
+		}
+	}
+}
+
+// connectShared records a new connection in the shared presence, announces
+// the user if it's their first anywhere, and closes connections that took
+// them past the limit.
+func (h *Hub) connectShared(client *Client) {
+	h.sharePresence(func(ctx context.Context) {
+		first, evicted, err := h.presence.Connect(ctx, client.ID, client.connID, h.maxPerUser)
+		if err != nil {
+			log.Printf("Failed to record connection for user %d: %v", client.ID, err)
+			return
+		}
+		if first {
+			go h.announcePresence(client.ID, true)
+		}
+		for _, conn := range evicted {
+			log.Printf("Client %d exceeded %d connections, closing oldest", client.ID, h.maxPerUser)
+			if strings.HasPrefix(conn, h.origin+":") {
+				h.evictLocal(client.ID, conn)
+			} else {
+				h.publish(envelope{Kind: "evict", UserID: client.ID, Conn: conn})
+			}
+		}
+	})
+}
+
+// disconnectShared drops a connection from the shared presence and
+// announces the user as offline if it was their last anywhere.
+func (h *Hub) disconnectShared(client *Client) {
+	h.sharePresence(func(ctx context.Context) {
+		last, err := h.presence.Disconnect(ctx, client.ID, client.connID)
+		if err != nil {
+			log.Printf("Failed to drop connection for user %d: %v", client.ID, err)
+			return
+		}
+		if last {
+			go h.announcePresence(client.ID, false)
+		}
+	})
+}
+
+// leaveShared drops this instance's connections from the shared presence
+// as the hub stops. Only the stored presence is updated, since broadcasts
+// are no longer delivered.
+func (h *Hub) leaveShared() {
+	ctx, cancel := context.WithTimeout(context.Background(), writeWait)
+	defer cancel()
+
+	offline, err := h.presence.Leave(ctx, h.origin)
+	if err != nil {
+		log.Printf("Failed to drop connections from shared presence: %v", err)
+		return
+	}
+	for _, userID := range offline {
+		if _, err := h.authService.SetPresence(userID, false); err != nil {
+			log.Printf("Failed to update presence for user %d: %v", userID, err)
+		}
+	}
+}
+
+// evictLocal closes one of the user's connections on this instance, if it
+// is here, because the user went over the connection limit. The connection
+// has already been dropped from the shared presence.
+func (h *Hub) evictLocal(userID uint, conn string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, client := range h.clients[userID] {
+		if client.connID == conn {
+			h.removeClient(client)
+			client.Conn.WriteControl(
+				websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "connection limit reached"),
+				time.Now().Add(time.Second),
+			)
+			return
+		}
+	}
+}
+
+// Redis keys for shared presence. Each user has a sorted set of their
+// connections scored by when they connected. Each instance has a key that
+// expires unless its heartbeats keep it alive, and a set of the users it
+// has had connections for, so their connections can be found if it dies.
+const redisPresenceInstances = "onechat:presence:instances"
+
+func redisPresenceUser(userID uint) string {
+	return fmt.Sprintf("onechat:presence:user:%d", userID)
+}
+
+func redisPresenceInstance(origin string) string {
+	return "onechat:presence:instance:" + origin
+}
+
+func redisPresenceInstanceUsers(origin string) string {
+	return "onechat:presence:instance-users:" + origin
+}
+
+// connectScript adds a connection, then trims the set to the newest
+// ARGV[3] connections when that's above 0. It returns the number of
+// connections left and the ones trimmed.
+var connectScript = redis.NewScript(`
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+local count = redis.call('ZCARD', KEYS[1])
+local max = tonumber(ARGV[3])
+local evicted = {}
+if max > 0 and count > max then
+	evicted = redis.call('ZRANGE', KEYS[1], 0, count - max - 1)
+	redis.call('ZREMRANGEBYRANK', KEYS[1], 0, count - max - 1)
+	count = max
+end
+return {count, evicted}
+`)
+
+// disconnectScript removes the connections in ARGV and returns how many
+// were removed and how many are left.
+var disconnectScript = redis.NewScript(`
+local removed = redis.call('ZREM', KEYS[1], unpack(ARGV))
+return {removed, redis.call('ZCARD', KEYS[1])}
+`)
+
+func (b *RedisBroker) Connect(ctx context.Context, userID uint, conn string, max int) (bool, []string, error) {
+	origin, _, _ := strings.Cut(conn, ":")
+	if err := b.client.SAdd(ctx, redisPresenceInstanceUsers(origin), userID).Err(); err != nil {
+		return false, nil, err
+	}
+
+	result, err := connectScript.Run(ctx, b.client, []string{redisPresenceUser(userID)},
+		conn, time.Now().UnixMilli(), max).Slice()
+	if err != nil {
+		return false, nil, err
+	}
+	count, _ := result[0].(int64)
+	var evicted []string
+	if trimmed, ok := result[1].([]interface{}); ok {
+		for _, member := range trimmed {
+			if s, ok := member.(string); ok {
+				evicted = append(evicted, s)
+			}
+		}
+	}
+	return count == 1, evicted, nil
+}
+
+func (b *RedisBroker) Disconnect(ctx context.Context, userID uint, conn string) (bool, error) {
+	return b.removeConnections(ctx, userID, []string{conn})
+}
+
+// removeConnections drops connections of the user and reports whether
+// that left them with none.
+func (b *RedisBroker) removeConnections(ctx context.Context, userID uint, conns []string) (bool, error) {
+	args := make([]interface{}, len(conns))
+	for i, conn := range conns {
+		args[i] = conn
+	}
+	result, err := disconnectScript.Run(ctx, b.client, []string{redisPresenceUser(userID)}, args...).Int64Slice()
+	if err != nil {
+		return false, err
+	}
+	return result[0] > 0 && result[1] == 0, nil
+}
+
+func (b *RedisBroker) IsOnline(ctx context.Context, userID uint) (bool, error) {
+	count, err := b.client.ZCard(ctx, redisPresenceUser(userID)).Result()
+	return count > 0, err
+}
+
+func (b *RedisBroker) Heartbeat(ctx context.Context, origin string) ([]uint, bool, error) {
+	alive, err := b.client.Expire(ctx, redisPresenceInstance(origin), presenceInstanceTTL).Result()
+	if err != nil {
+		return nil, false, err
+	}
+	if !alive {
+		if err := b.client.Set(ctx, redisPresenceInstance(origin), 1, presenceInstanceTTL).Err(); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := b.client.SAdd(ctx, redisPresenceInstances, origin).Err(); err != nil {
+		return nil, !alive, err
+	}
+
+	origins, err := b.client.SMembers(ctx, redisPresenceInstances).Result()
+	if err != nil {
+		return nil, !alive, err
+	}
+
+	var offline []uint
+	for _, other := range origins {
+		if other == origin {
+			continue
+		}
+		exists, err := b.client.Exists(ctx, redisPresenceInstance(other)).Result()
+		if err != nil || exists > 0 {
+			continue
+		}
+		// Whichever instance takes it out of the set cleans up after it
+		if claimed, err := b.client.SRem(ctx, redisPresenceInstances, other).Result(); err != nil || claimed == 0 {
+			continue
+		}
+		users, err := b.dropInstance(ctx, other)
+		if err != nil {
+			log.Printf("Failed to drop connections of instance %s: %v", other, err)
+		}
+		offline = append(offline, users...)
+	}
+	return offline, !alive, nil
+}
+
+func (b *RedisBroker) Leave(ctx context.Context, origin string) ([]uint, error) {
+	if err := b.client.Del(ctx, redisPresenceInstance(origin)).Err(); err != nil {
+		return nil, err
+	}
+	if err := b.client.SRem(ctx, redisPresenceInstances, origin).Err(); err != nil {
+		return nil, err
+	}
+	return b.dropInstance(ctx, origin)
+}
+
+// dropInstance removes every connection held by an instance and returns
+// the users left without one.
+func (b *RedisBroker) dropInstance(ctx context.Context, origin string) ([]uint, error) {
+	ids, err := b.client.SMembers(ctx, redisPresenceInstanceUsers(origin)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var offline []uint
+	for _, id := range ids {
+		userID, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			continue
+		}
+		conns, err := b.client.ZRange(ctx, redisPresenceUser(uint(userID)), 0, -1).Result()
+		if err != nil {
+			return offline, err
+		}
+		var held []string
+		for _, conn := range conns {
+			if strings.HasPrefix(conn, origin+":") {
+				held = append(held, conn)
+			}
+		}
+		if len(held) == 0 {
+			continue
+		}
+		last, err := b.removeConnections(ctx, uint(userID), held)
+		if err != nil {
+			return offline, err
+		}
+		if last {
+			offline = append(offline, uint(userID))
+		}
+	}
+	return offline, b.client.Del(ctx, redisPresenceInstanceUsers(origin)).Err()
+}
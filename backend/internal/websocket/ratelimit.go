@@ -0,0 +1,43 @@
+package websocket
+
+import "time"
+
+// frameLimiter is a token bucket for the frames one client sends. It is
+// only used from the client's ReadPump, so it needs no locking.
+type frameLimiter struct {
+	rate   float64 // tokens added per second; 0 disables the limit
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newFrameLimiter(rate float64, burst int) *frameLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &frameLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token for one frame, reporting false if none is left.
+func (l *frameLimiter) allow(now time.Time) bool {
+	if l.rate <= 0 {
+		return true
+	}
+
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}